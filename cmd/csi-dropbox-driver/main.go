@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/woohhan/dropbox-csi/pkg/dropbox"
+
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Default of --version, set at build time with -ldflags "-X main.version=..."
+var version = "v1.0.0"
+
+var (
+	endpoint      = flag.String("endpoint", "unix:///tmp/csi.sock", "CSI endpoint, unix:///path/to/csi.sock or tcp://host:port")
+	endpointMode  = flag.String("endpoint-mode", "", "octal permissions of the unix socket endpoint, e.g. 0660. Default is the umask of the driver")
+	driverName    = flag.String("drivername", "dropbox.csi.k8s.io", "name of the driver")
+	nodeID        = flag.String("nodeid", "", "node id")
+	driverVersion = flag.String("version", version, "version of the driver reported in GetPluginInfo")
+	mode          = flag.String("mode", "", "services the driver serves, controller or node. Both if empty")
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+func main() {
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "version":
+		fmt.Println(path.Base(os.Args[0]), *driverVersion)
+		return
+	case "verify":
+		verify()
+		return
+	case "preflight":
+		preflight()
+		return
+	}
+
+	handle()
+	os.Exit(0)
+}
+
+func handle() {
+	driver, err := dropbox.NewDropboxDriver(newConfig())
+	if err != nil {
+		fmt.Printf("Failed to initialize driver: %s", err.Error())
+		os.Exit(1)
+	}
+	driver.Run()
+}
+
+// preflight checks the node prerequisites without serving CSI, e.g. from an
+// init container.
+func preflight() {
+	err := dropbox.Preflight(context.Background(), newConfig())
+	if err != nil {
+		fmt.Printf("FAIL: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+// verify checks the Dropbox settings without serving CSI, e.g. from an init
+// container.
+func verify() {
+	token, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		fmt.Printf("FAIL: can't read token file: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = dropbox.Verify(context.Background(), newConfig(), strings.TrimSpace(string(token)), *verifyMount)
+	if err != nil {
+		fmt.Printf("FAIL: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
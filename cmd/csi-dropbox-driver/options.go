@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/woohhan/dropbox-csi/pkg/dropbox"
+
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options of the driver beyond its endpoint and identity
+var (
+	backend           = flag.String("backend", "dbxfs", "default mount backend, dbxfs, rclone or native. A volume can choose another one with the backend volume attribute")
+	dropboxAPIURL     = flag.String("dropbox-api-url", "", "base URL of the Dropbox API, for testing against a fake Dropbox")
+	dropboxContentURL = flag.String("dropbox-content-url", "", "base URL of the Dropbox content API, for testing against a fake Dropbox")
+
+	rootDir        = flag.String("root-dir", "/mnt/csi-dropbox", "directory for the driver state and ephemeral volumes")
+	credentialsDir = flag.String("credentials-dir", "/run/csi-dropbox", "directory for the config and token of staged volumes, should be a tmpfs")
+	retainCache    = flag.Bool("retain-cache", false, "keep the caches of volumes in --root-dir when they are unstaged, so that they are warm when staged again")
+	dbxfsPath      = flag.String("dbxfs-path", "", "path of the dbxfs executable, dbxfs is looked up on PATH if empty")
+	dbxfsExtraArgs = flag.String("dbxfs-extra-args", "", "space separated arguments added to every dbxfs mount, e.g. \"-o big_writes\"")
+
+	allowOther         = flag.Bool("allow-other", false, "mount volumes with the FUSE allow_other option, so that pods running as another user than the driver can access them, unless the volume sets allowOther")
+	defaultPermissions = flag.Bool("default-permissions", false, "mount volumes with the FUSE default_permissions option, so that the kernel checks the permissions of their files, unless the volume sets defaultPermissions")
+	umask              = flag.String("umask", "", "octal umask of the files of the volumes which don't set umask, e.g. 0022. Default is the one of the backend")
+
+	mountTimeout       = flag.Duration("mount-timeout", 2*time.Minute, "maximum duration of a mount including retries, after which the mount command is killed. 0 for unlimited")
+	mountRetries       = flag.Int("mount-retries", 3, "number of retries for transient mount failures")
+	mountRetryInterval = flag.Duration("mount-retry-interval", time.Second, "initial interval between mount retries")
+	mountRestarts      = flag.Int("mount-restarts", 5, "number of restarts of a crashing foreground mount process before the volume is reported abnormal")
+
+	maxConcurrentMounts   = flag.Int("max-concurrent-mounts", 0, "maximum number of concurrent mount operations, 0 for unlimited")
+	maxConcurrentUnmounts = flag.Int("max-concurrent-unmounts", 0, "maximum number of concurrent unmount operations, 0 for unlimited")
+
+	tokenFile   = flag.String("token-file", "", "file containing a Dropbox access token, used by the verify command and to check the Dropbox API for readiness")
+	verifyMount = flag.Bool("verify-mount", false, "mount and unmount the default backend to a temporary directory in the verify command")
+
+	tokenShareWarnThreshold = flag.Int("token-share-warn-threshold", 10, "warn when more volumes than this share the same token, 0 to disable")
+
+	maxVolumesPerNode = flag.Int64("max-volumes-per-node", 0, "maximum number of volumes the scheduler puts on a node, 0 for unlimited")
+	topologyAccount   = flag.String("topology-account", "", "Dropbox account or team the node holds credentials of, reported as the topology.dropbox.csi.k8s.io/account topology key")
+
+	metricsAddress = flag.String("metrics-address", "", "address to expose prometheus metrics on, e.g. :9090. Disabled if empty")
+	apiUsageProxy  = flag.String("api-usage-proxy", "", "local address of a proxy the mount processes reach Dropbox through, to account their traffic to the volumes, e.g. 127.0.0.1:9810. Disabled if empty")
+
+	maxCommandOutput = flag.Int("max-command-output", 4096, "maximum bytes of mount command output kept for logs and errors, 0 for unlimited")
+	dbxfsForeground  = flag.Bool("dbxfs-foreground", true, "run dbxfs in foreground as a child of the driver instead of letting it daemonize")
+
+	usageCheckInterval    = flag.Duration("usage-check-interval", 5*time.Minute, "interval to check the Dropbox space usage of staged volumes, 0 to disable")
+	quotaWarningThreshold = flag.Float64("quota-warning-threshold", 0.9, "used fraction of the Dropbox account space to warn at, 0 to disable")
+
+	statsInterval = flag.Duration("stats-interval", 0, "interval to collect the stats of staged volumes, which NodeGetVolumeStats serves from the last collection. 0 to collect them on every request")
+
+	mirrorSyncInterval = flag.Duration("mirror-sync-interval", time.Minute, "interval to sync the local copies of volumes with syncMode mirror with Dropbox, 0 to only sync them on mount and unmount")
+
+	shareMounts = flag.Bool("share-mounts", false, "mount the volumes of the same Dropbox credentials and mount options once and bind mount it to their staging paths, instead of a mount process per volume")
+
+	healthCheckInterval  = flag.Duration("health-check-interval", 30*time.Second, "interval to check the mounts of staged volumes and remount dead ones, 0 to disable")
+	probeDropboxAPI      = flag.Bool("probe-dropbox-api", false, "fail Probe too while the Dropbox API is unreachable with the token of --token-file, so that the livenessprobe sidecar restarts the driver")
+	livenessMountTimeout = flag.Duration("liveness-mount-timeout", 0, "time the mounts of staged volumes are given to respond in Probe, which fails if one doesn't. 0 to not check them")
+
+	events = flag.Bool("events", false, "post Kubernetes events on the claims of volumes failing to mount, crashing or running out of Dropbox space")
+
+	secretWatchInterval = flag.Duration("secret-watch-interval", 0, "resync interval of the watch on the nodeStageSecretRef of staged volumes, which writes changed tokens to their mounts, 0 to disable")
+
+	shutdownTimeout            = flag.Duration("shutdown-timeout", 20*time.Second, "time given to in-flight operations to finish on SIGTERM before they are canceled")
+	unmountEphemeralOnShutdown = flag.Bool("unmount-ephemeral-on-shutdown", false, "unmount ephemeral inline volumes on shutdown to flush their writes, pods lose them until restarted")
+
+	deleteProvisionedFolders = flag.Bool("delete-provisioned-folders", false, "delete the Dropbox folder of a provisioned volume when it is deleted")
+	archiveDir               = flag.String("archive-dir", ".csi-archive", "folder in Dropbox that volumes with the archive onDelete policy are moved to")
+	reconcileInterval        = flag.Duration("reconcile-interval", 0, "interval to look for provisioned folders in Dropbox which no persistent volume uses, 0 to disable. Requires --token-file and running in a cluster")
+	orphanedFolders          = flag.String("orphaned-folders", "report", "what is done with provisioned folders no persistent volume uses: report, archive or delete")
+
+	leaderElection          = flag.Bool("leader-election", false, "elect one of several controller replicas with a lease to look for orphaned folders")
+	leaderElectionNamespace = flag.String("leader-election-namespace", "", "namespace of the leader election lease, the one of the driver pod if empty")
+)
+
+func newConfig() *dropbox.Config {
+	var socketMode uint64
+	if *endpointMode != "" {
+		var err error
+		if socketMode, err = strconv.ParseUint(*endpointMode, 8, 32); err != nil {
+			fmt.Printf("Invalid endpoint mode %q: %s\n", *endpointMode, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return &dropbox.Config{
+		DriverName:         *driverName,
+		NodeID:             *nodeID,
+		Endpoint:           *endpoint,
+		EndpointMode:       os.FileMode(socketMode),
+		Mode:               *mode,
+		Version:            *driverVersion,
+		TokenFile:          *tokenFile,
+		Backend:            *backend,
+		DropboxAPIURL:      *dropboxAPIURL,
+		DropboxContentURL:  *dropboxContentURL,
+		RootDir:            *rootDir,
+		CredentialsDir:     *credentialsDir,
+		RetainCache:        *retainCache,
+		DbxfsPath:          *dbxfsPath,
+		DbxfsExtraArgs:     strings.Fields(*dbxfsExtraArgs),
+		AllowOther:         *allowOther,
+		DefaultPermissions: *defaultPermissions,
+		Umask:              *umask,
+		MountTimeout:       *mountTimeout,
+		MountRetries:       *mountRetries,
+		MountRetryInterval: *mountRetryInterval,
+		MountRestarts:      *mountRestarts,
+
+		MaxConcurrentMounts:   *maxConcurrentMounts,
+		MaxConcurrentUnmounts: *maxConcurrentUnmounts,
+
+		TokenShareWarnThreshold: *tokenShareWarnThreshold,
+
+		MaxVolumesPerNode: *maxVolumesPerNode,
+		TopologyAccount:   *topologyAccount,
+
+		MetricsAddress: *metricsAddress,
+
+		APIUsageProxyAddress: *apiUsageProxy,
+
+		MaxCommandOutput: *maxCommandOutput,
+		DbxfsForeground:  *dbxfsForeground,
+
+		UsageCheckInterval:    *usageCheckInterval,
+		QuotaWarningThreshold: *quotaWarningThreshold,
+
+		StatsInterval: *statsInterval,
+
+		MirrorSyncInterval: *mirrorSyncInterval,
+
+		ShareMounts: *shareMounts,
+
+		HealthCheckInterval:  *healthCheckInterval,
+		LivenessMountTimeout: *livenessMountTimeout,
+		ProbeDropboxAPI:      *probeDropboxAPI,
+
+		DeleteProvisionedFolders: *deleteProvisionedFolders,
+		ArchiveDir:               *archiveDir,
+		ReconcileInterval:        *reconcileInterval,
+		OrphanedFolders:          *orphanedFolders,
+
+		LeaderElection:          *leaderElection,
+		LeaderElectionNamespace: *leaderElectionNamespace,
+
+		Events: *events,
+
+		SecretWatchInterval: *secretWatchInterval,
+
+		ShutdownTimeout:            *shutdownTimeout,
+		UnmountEphemeralOnShutdown: *unmountEphemeralOnShutdown,
+	}
+}
@@ -1,12 +1,21 @@
 module github.com/woohhan/dropbox-csi
 
-go 1.12
+go 1.15
 
 require (
-	github.com/container-storage-interface/spec v1.2.0
+	github.com/container-storage-interface/spec v1.6.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/golang/protobuf v1.5.2
+	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/kubernetes-csi/csi-lib-utils v0.7.0
-	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
-	google.golang.org/grpc v1.27.0
-	k8s.io/utils v0.0.0-20200124190032-861946025e34
+	github.com/kubernetes-csi/csi-test/v4 v4.4.0
+	github.com/onsi/ginkgo v1.16.5
+	github.com/prometheus/client_golang v1.5.1
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	google.golang.org/grpc v1.47.0
+	k8s.io/api v0.20.15
+	k8s.io/apimachinery v0.20.15
+	k8s.io/client-go v0.20.15
+	k8s.io/utils v0.0.0-20201110183641-67b214c5f920
 )
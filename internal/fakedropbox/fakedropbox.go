@@ -0,0 +1,419 @@
+// Package fakedropbox serves the parts of the Dropbox API used by the driver
+// from a local directory, for testing the driver without a Dropbox account.
+package fakedropbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Space the fake Dropbox account is allocated
+const allocated int64 = 1 << 40
+
+// Server serves the fake Dropbox of a directory. Any token is accepted, and
+// the team space headers are ignored.
+type Server struct {
+	dir string
+
+	mu sync.Mutex
+	// Recursive listings by their cursor, to list the changes since
+	listings map[string]*listing
+	cursors  int
+}
+
+// listing is the state of a folder listed recursively. Its entries are
+// compared with the folder to list the changes since.
+type listing struct {
+	path    string
+	entries map[string]*metadata
+}
+
+// NewServer returns the server of the fake Dropbox in dir.
+func NewServer(dir string) *Server {
+	return &Server{dir: dir, listings: map[string]*listing{}}
+}
+
+// Start serves the fake Dropbox of dir on a local port, and returns the base
+// URL of its API and content endpoints.
+func Start(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(l, NewServer(dir)); err != nil {
+			glog.Errorf("Fake Dropbox stopped: %v", err)
+		}
+	}()
+	return "http://" + l.Addr().String() + "/2", nil
+}
+
+type metadata struct {
+	Tag            string     `json:".tag"`
+	Name           string     `json:"name"`
+	PathLower      string     `json:"path_lower"`
+	PathDisplay    string     `json:"path_display"`
+	Size           uint64     `json:"size"`
+	ServerModified *time.Time `json:"server_modified,omitempty"`
+}
+
+type apiError struct {
+	status  int
+	summary string
+}
+
+func (e *apiError) Error() string {
+	return e.summary
+}
+
+// conflict is the error of a failed endpoint, which Dropbox returns with 409
+// Conflict.
+func conflict(summary string) error {
+	return &apiError{http.StatusConflict, summary}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		writeError(w, &apiError{http.StatusUnauthorized, "invalid_access_token/"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Content endpoints take the argument in a header and data in the body
+	argJSON, data := body, []byte(nil)
+	if h := r.Header.Get("Dropbox-API-Arg"); h != "" {
+		argJSON, data = []byte(h), body
+	}
+	var arg struct {
+		Path       string `json:"path"`
+		FromPath   string `json:"from_path"`
+		ToPath     string `json:"to_path"`
+		Autorename bool   `json:"autorename"`
+		Recursive  bool   `json:"recursive"`
+		Cursor     string `json:"cursor"`
+	}
+	if err := json.Unmarshal(argJSON, &arg); err != nil {
+		writeError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("Invalid argument: %v", err)})
+		return
+	}
+
+	endpoint := strings.TrimPrefix(r.URL.Path, "/2")
+	if endpoint == "/files/download" {
+		s.download(w, r, arg.Path)
+		return
+	}
+
+	var result interface{}
+	if endpoint == "/files/list_folder" && arg.Recursive {
+		result, err = s.listRecursive(arg.Path)
+	} else if endpoint == "/files/list_folder/continue" && arg.Cursor != "" {
+		result, err = s.listChanges(arg.Cursor)
+	} else {
+		result, err = s.call(endpoint, arg.Path, arg.FromPath, arg.ToPath, arg.Autorename, data)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// download writes the file at p, or the part of it in the Range header of r.
+func (s *Server) download(w http.ResponseWriter, r *http.Request, p string) {
+	m, err := s.metadata(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	f, err := os.Open(s.path(p))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	result, _ := json.Marshal(m)
+	w.Header().Set("Dropbox-API-Result", string(result))
+	// Answers ranged requests with 206 like Dropbox
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (s *Server) call(endpoint, p, from, to string, autorename bool, data []byte) (interface{}, error) {
+	switch endpoint {
+	case "/users/get_current_account":
+		return map[string]string{"account_id": "dbid:fake", "email": "fake@example.com"}, nil
+
+	case "/users/get_space_usage":
+		used, err := s.used()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"used":       used,
+			"allocation": map[string]interface{}{".tag": "individual", "allocated": allocated},
+		}, nil
+
+	case "/files/create_folder_v2":
+		if info, err := os.Stat(s.path(p)); err == nil {
+			if !info.IsDir() {
+				return nil, conflict("path/conflict/file/")
+			}
+			return nil, conflict("path/conflict/folder/")
+		}
+		if err := os.MkdirAll(s.path(p), 0750); err != nil {
+			return nil, err
+		}
+		return s.metadata(p)
+
+	case "/files/delete_v2":
+		m, err := s.metadata(p)
+		if err != nil {
+			return nil, conflict("path_lookup/not_found/")
+		}
+		return m, os.RemoveAll(s.path(p))
+
+	case "/files/copy_v2", "/files/move_v2":
+		if _, err := os.Stat(s.path(from)); err != nil {
+			return nil, conflict("from_lookup/not_found/")
+		}
+		if info, err := os.Stat(s.path(to)); err == nil {
+			if !autorename {
+				if !info.IsDir() {
+					return nil, conflict("to/conflict/file/")
+				}
+				return nil, conflict("to/conflict/folder/")
+			}
+			to = s.freePath(to)
+		}
+		if err := os.MkdirAll(path.Dir(s.path(to)), 0750); err != nil {
+			return nil, err
+		}
+		var err error
+		if endpoint == "/files/move_v2" {
+			err = os.Rename(s.path(from), s.path(to))
+		} else {
+			err = copyTree(s.path(from), s.path(to))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.metadata(to)
+
+	case "/files/get_metadata":
+		return s.metadata(p)
+
+	case "/files/list_folder":
+		infos, err := ioutil.ReadDir(s.path(p))
+		if err != nil {
+			return nil, conflict("path/not_found/")
+		}
+		entries := []*metadata{}
+		for _, info := range infos {
+			entries = append(entries, newMetadata(path.Join("/", p, info.Name()), info))
+		}
+		return map[string]interface{}{"entries": entries, "cursor": "", "has_more": false}, nil
+
+	case "/files/list_folder/continue":
+		return map[string]interface{}{"entries": []*metadata{}, "cursor": "", "has_more": false}, nil
+
+	case "/files/upload":
+		if err := os.MkdirAll(path.Dir(s.path(p)), 0750); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(s.path(p), data, 0640); err != nil {
+			return nil, err
+		}
+		return s.metadata(p)
+
+	case "/sharing/create_shared_link_with_settings":
+		return map[string]string{"url": "https://www.dropbox.com/fake" + path.Join("/", p)}, nil
+	}
+	return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("Endpoint %s is not supported by the fake Dropbox", endpoint)}
+}
+
+// listRecursive lists the folder at p and all its subfolders, with a cursor
+// to list the changes since.
+func (s *Server) listRecursive(p string) (interface{}, error) {
+	entries, err := s.walk(p)
+	if err != nil {
+		return nil, err
+	}
+	list := []*metadata{}
+	for _, m := range entries {
+		list = append(list, m)
+	}
+	// Parents before their children, like Dropbox lists them
+	sort.Slice(list, func(i, j int) bool { return list[i].PathLower < list[j].PathLower })
+	cursor := s.saveListing(&listing{path: p, entries: entries})
+	return map[string]interface{}{"entries": list, "cursor": cursor, "has_more": false}, nil
+}
+
+// listChanges lists the entries added, changed or deleted since the listing
+// of cursor. Like the cursors of Dropbox, an unknown one has to be reset by
+// listing the folder again.
+func (s *Server) listChanges(cursor string) (interface{}, error) {
+	s.mu.Lock()
+	last, ok := s.listings[cursor]
+	delete(s.listings, cursor)
+	s.mu.Unlock()
+	if !ok {
+		return nil, conflict("reset/")
+	}
+
+	entries, err := s.walk(last.path)
+	if err != nil {
+		return nil, err
+	}
+	changes := []*metadata{}
+	for p, m := range last.entries {
+		if _, ok := entries[p]; !ok {
+			changes = append(changes, &metadata{Tag: "deleted", Name: m.Name, PathLower: m.PathLower, PathDisplay: m.PathDisplay})
+		}
+	}
+	for p, m := range entries {
+		if old, ok := last.entries[p]; !ok || old.Tag != m.Tag || old.Size != m.Size || !sameTime(old.ServerModified, m.ServerModified) {
+			changes = append(changes, m)
+		}
+	}
+	next := s.saveListing(&listing{path: last.path, entries: entries})
+	return map[string]interface{}{"entries": changes, "cursor": next, "has_more": false}, nil
+}
+
+// walk returns the entries of the folder at p and all its subfolders by
+// their lower case path.
+func (s *Server) walk(p string) (map[string]*metadata, error) {
+	root := s.path(p)
+	if _, err := os.Stat(root); err != nil {
+		return nil, conflict("path/not_found/")
+	}
+	entries := map[string]*metadata{}
+	err := filepath.Walk(root, func(local string, info os.FileInfo, err error) error {
+		if err != nil || local == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, local)
+		if err != nil {
+			return err
+		}
+		m := newMetadata(path.Join("/", p, filepath.ToSlash(rel)), info)
+		entries[m.PathLower] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *Server) saveListing(l *listing) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursors++
+	cursor := fmt.Sprintf("cursor-%d", s.cursors)
+	s.listings[cursor] = l
+	return cursor
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// used returns the size of the files in the fake Dropbox.
+func (s *Server) used() (uint64, error) {
+	var used uint64
+	err := filepath.Walk(s.dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			used += uint64(info.Size())
+		}
+		return err
+	})
+	return used, err
+}
+
+// path returns the local path of the Dropbox path p, which can't leave dir.
+func (s *Server) path(p string) string {
+	return filepath.Join(s.dir, path.Clean("/"+p))
+}
+
+func (s *Server) metadata(p string) (*metadata, error) {
+	info, err := os.Stat(s.path(p))
+	if err != nil {
+		return nil, conflict("path/not_found/")
+	}
+	return newMetadata(path.Join("/", p), info), nil
+}
+
+// freePath returns p renamed like Dropbox does to not conflict with an
+// existing entry.
+func (s *Server) freePath(p string) string {
+	for i := 1; ; i++ {
+		renamed := fmt.Sprintf("%s (%d)", p, i)
+		if _, err := os.Stat(s.path(renamed)); os.IsNotExist(err) {
+			return renamed
+		}
+	}
+}
+
+func newMetadata(p string, info os.FileInfo) *metadata {
+	if info.IsDir() {
+		return &metadata{Tag: "folder", Name: info.Name(), PathLower: strings.ToLower(p), PathDisplay: p}
+	}
+	modified := info.ModTime().UTC().Truncate(time.Second)
+	return &metadata{Tag: "file", Name: info.Name(), PathLower: strings.ToLower(p), PathDisplay: p, Size: uint64(info.Size()), ServerModified: &modified}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(map[string]string{"error_summary": apiErr.summary})
+}
+
+// copyTree copies the directory or file from to to.
+func copyTree(from, to string) error {
+	return filepath.Walk(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0750)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, info.Mode())
+	})
+}
@@ -0,0 +1,530 @@
+package dropbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Base URLs of the Dropbox API, unless set in the config
+const (
+	defaultDropboxAPIURL     = "https://api.dropboxapi.com/2"
+	defaultDropboxContentURL = "https://content.dropboxapi.com/2"
+)
+
+// Retries of rate limited and failed API requests
+const (
+	apiMaxRetries    = 5
+	apiRetryInterval = time.Second
+	apiMaxRetryWait  = time.Minute
+)
+
+// Endpoints which are sent again after a server or network error, as sending
+// them twice does what sending them once does. Others, like copies and moves,
+// are only sent again when rate limited, which Dropbox answers before doing
+// anything.
+var idempotentEndpoints = map[string]bool{
+	"/files/create_folder_v2":     true,
+	"/files/delete_v2":            true,
+	"/files/download":             true,
+	"/files/get_metadata":         true,
+	"/files/list_folder":          true,
+	"/files/list_folder/continue": true,
+	"/files/upload":               true,
+	"/sharing/list_shared_links":  true,
+	"/team/members/get_info_v2":   true,
+	"/users/get_current_account":  true,
+	"/users/get_space_usage":      true,
+}
+
+// apiClient is a minimal client for the Dropbox HTTP API.
+type apiClient struct {
+	token      string
+	baseURL    string
+	contentURL string
+	httpClient *http.Client
+
+	// Volume the API usage of the client is accounted to, empty for none
+	volumeID string
+
+	// Team space the client acts in, see inTeamSpace
+	namespaceID  string
+	teamMemberID string
+}
+
+func newAPIClient(cfg *Config, token string) *apiClient {
+	c := &apiClient{
+		token:      token,
+		baseURL:    cfg.DropboxAPIURL,
+		contentURL: cfg.DropboxContentURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.baseURL == "" {
+		c.baseURL = defaultDropboxAPIURL
+	}
+	if c.contentURL == "" {
+		c.contentURL = defaultDropboxContentURL
+	}
+	return c
+}
+
+type apiError struct {
+	StatusCode int
+	Summary    string
+	// Delay asked by a rate limited response
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Dropbox API error %d: %s", e.StatusCode, e.Summary)
+}
+
+// isRetryable tells whether the request may succeed when sent again.
+func (e *apiError) isRetryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+func isAPIRateLimited(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+func isAPIAuthError(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// call invokes a Dropbox RPC endpoint with arg as JSON body and decodes the
+// response into result. arg and result may be nil.
+func (c *apiClient) call(ctx context.Context, endpoint string, arg, result interface{}) error {
+	body := []byte("null")
+	if arg != nil {
+		var err error
+		body, err = json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	respBody, err := c.do(ctx, idempotentEndpoints[endpoint], func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.baseURL+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		// Team endpoints act on the whole team
+		if !strings.HasPrefix(endpoint, "/team/") {
+			c.setTeamHeaders(req)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// content invokes a Dropbox content endpoint with arg in the Dropbox-API-Arg
+// header and in as the request body, and returns the response body.
+func (c *apiClient) content(ctx context.Context, endpoint string, arg interface{}, in []byte) ([]byte, error) {
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(ctx, idempotentEndpoints[endpoint], func() (*http.Request, error) {
+		return c.newContentRequest(endpoint, argJSON, in)
+	})
+}
+
+func (c *apiClient) newContentRequest(endpoint string, argJSON, in []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, c.contentURL+endpoint, bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", string(argJSON))
+	c.setTeamHeaders(req)
+	return req, nil
+}
+
+// forVolume returns a copy of the client whose API usage is accounted to
+// volumeID.
+func (c *apiClient) forVolume(volumeID string) *apiClient {
+	client := *c
+	client.volumeID = volumeID
+	return &client
+}
+
+// do sends the request made by newRequest and returns the response body.
+// Rate limited requests, and if idempotent also requests failing with a
+// server or network error, are retried up to apiMaxRetries times, after the
+// Retry-After of the response or a jittered exponential backoff.
+func (c *apiClient) do(ctx context.Context, idempotent bool, newRequest func() (*http.Request, error)) ([]byte, error) {
+	backoff := apiRetryInterval
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		body, err := c.send(req)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var wait time.Duration
+		if apiErr, ok := err.(*apiError); ok {
+			if !isAPIRateLimited(err) && !(idempotent && apiErr.isRetryable()) {
+				return nil, err
+			}
+			wait = apiErr.RetryAfter
+		} else if !idempotent {
+			return nil, err
+		}
+		if attempt == apiMaxRetries {
+			return nil, err
+		}
+
+		if wait <= 0 {
+			wait = jitter(backoff)
+			backoff *= 2
+		}
+		if wait > apiMaxRetryWait {
+			wait = apiMaxRetryWait
+		}
+		glog.V(4).Infof("Dropbox API %s failed, retrying in %v: %v", req.URL.Path, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and 3d/2, so that retries of
+// many volumes don't hit Dropbox at the same time.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// isTransientError tells whether a failed Dropbox request may succeed on
+// retry: network errors, rate limits and server errors.
+func isTransientError(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return !ok || apiErr.isRetryable()
+}
+
+func (c *apiClient) send(req *http.Request) ([]byte, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	recordAPICall(c.volumeID, req.ContentLength, int64(len(respBody)), resp.StatusCode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ranged downloads answer with 206
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		apiErr := newAPIError(resp.StatusCode, respBody)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, apiErr
+	}
+	return respBody, nil
+}
+
+func newAPIError(statusCode int, body []byte) *apiError {
+	apiErr := &apiError{StatusCode: statusCode, Summary: string(body)}
+	var errBody struct {
+		ErrorSummary string `json:"error_summary"`
+	}
+	if json.Unmarshal(body, &errBody) == nil && errBody.ErrorSummary != "" {
+		apiErr.Summary = errBody.ErrorSummary
+	}
+	return apiErr
+}
+
+type account struct {
+	AccountID string `json:"account_id"`
+	Email     string `json:"email"`
+}
+
+func (c *apiClient) getCurrentAccount(ctx context.Context) (*account, error) {
+	var acc account
+	if err := c.call(ctx, "/users/get_current_account", nil, &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+type spaceUsage struct {
+	Used       uint64 `json:"used"`
+	Allocation struct {
+		Tag       string `json:".tag"`
+		Allocated uint64 `json:"allocated"`
+	} `json:"allocation"`
+}
+
+// usedRatio returns the used fraction of the allocated space, or 0 if the
+// allocation is unknown.
+func (u *spaceUsage) usedRatio() float64 {
+	if u.Allocation.Allocated == 0 {
+		return 0
+	}
+	return float64(u.Used) / float64(u.Allocation.Allocated)
+}
+
+// available returns the unused space of the allocation, or 0 if the
+// allocation is unknown.
+func (u *spaceUsage) available() uint64 {
+	if u.Used >= u.Allocation.Allocated {
+		return 0
+	}
+	return u.Allocation.Allocated - u.Used
+}
+
+func (c *apiClient) getSpaceUsage(ctx context.Context) (*spaceUsage, error) {
+	var usage spaceUsage
+	if err := c.call(ctx, "/users/get_space_usage", nil, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func isAPIConflict(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusConflict && strings.Contains(apiErr.Summary, "conflict")
+}
+
+// isAPIFolderConflict tells whether err is a conflict with an existing
+// folder, rather than with a file.
+func isAPIFolderConflict(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusConflict && strings.Contains(apiErr.Summary, "conflict/folder")
+}
+
+// isAPIReset tells whether err is the expired cursor of a folder listing,
+// which has to be listed again.
+func isAPIReset(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusConflict && strings.HasPrefix(apiErr.Summary, "reset")
+}
+
+func isAPINotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusConflict && strings.Contains(apiErr.Summary, "not_found")
+}
+
+type pathArg struct {
+	Path string `json:"path"`
+}
+
+// createFolder creates the folder at p. An existing folder is not an error,
+// but an existing file is.
+func (c *apiClient) createFolder(ctx context.Context, p string) error {
+	err := c.call(ctx, "/files/create_folder_v2", &pathArg{Path: p}, nil)
+	if isAPIFolderConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteFolder deletes the folder at p. A missing folder is not an error.
+func (c *apiClient) deleteFolder(ctx context.Context, p string) error {
+	err := c.call(ctx, "/files/delete_v2", &pathArg{Path: p}, nil)
+	if isAPINotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type relocationArg struct {
+	FromPath string `json:"from_path"`
+	ToPath   string `json:"to_path"`
+}
+
+// copyFolder copies the folder at from to to on the server.
+func (c *apiClient) copyFolder(ctx context.Context, from, to string) error {
+	return c.call(ctx, "/files/copy_v2", &relocationArg{FromPath: from, ToPath: to}, nil)
+}
+
+// createSharedLink returns a shared link to the folder at p, creating it if
+// the folder has none.
+func (c *apiClient) createSharedLink(ctx context.Context, p string) (string, error) {
+	var link struct {
+		URL string `json:"url"`
+	}
+	err := c.call(ctx, "/sharing/create_shared_link_with_settings", &pathArg{Path: p}, &link)
+	if err == nil {
+		return link.URL, nil
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok || !strings.Contains(apiErr.Summary, "shared_link_already_exists") {
+		return "", err
+	}
+
+	var result struct {
+		Links []struct {
+			URL string `json:"url"`
+		} `json:"links"`
+	}
+	arg := map[string]interface{}{
+		"path":        p,
+		"direct_only": true,
+	}
+	if err := c.call(ctx, "/sharing/list_shared_links", arg, &result); err != nil {
+		return "", err
+	}
+	if len(result.Links) == 0 {
+		return "", fmt.Errorf("No shared link of %s", p)
+	}
+	return result.Links[0].URL, nil
+}
+
+// moveFolder moves the folder at from to to on the server, renaming it if
+// to exists.
+func (c *apiClient) moveFolder(ctx context.Context, from, to string) error {
+	arg := map[string]interface{}{
+		"from_path":  from,
+		"to_path":    to,
+		"autorename": true,
+	}
+	return c.call(ctx, "/files/move_v2", arg, nil)
+}
+
+// move moves the file or folder at from to to on the server. It fails with a
+// conflict if to exists.
+func (c *apiClient) move(ctx context.Context, from, to string) error {
+	return c.call(ctx, "/files/move_v2", &relocationArg{FromPath: from, ToPath: to}, nil)
+}
+
+// remove deletes the file or folder at p.
+func (c *apiClient) remove(ctx context.Context, p string) error {
+	return c.call(ctx, "/files/delete_v2", &pathArg{Path: p}, nil)
+}
+
+type metadata struct {
+	Tag         string `json:".tag"`
+	Name        string `json:"name"`
+	PathLower   string `json:"path_lower"`
+	PathDisplay string `json:"path_display"`
+	Size        uint64 `json:"size"`
+	// Unset for folders
+	ServerModified time.Time `json:"server_modified"`
+}
+
+func (c *apiClient) getMetadata(ctx context.Context, p string) (*metadata, error) {
+	var m metadata
+	if err := c.call(ctx, "/files/get_metadata", &pathArg{Path: p}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// listFolder returns the entries directly in the folder at p.
+func (c *apiClient) listFolder(ctx context.Context, p string) ([]metadata, error) {
+	return c.listFolderArg(ctx, &pathArg{Path: p})
+}
+
+func (c *apiClient) listFolderArg(ctx context.Context, arg interface{}) ([]metadata, error) {
+	entries, _, err := c.listFolderCursor(ctx, arg)
+	return entries, err
+}
+
+// listFolderCursor lists a folder, and returns the cursor to list the
+// changes since with listFolderChanges.
+func (c *apiClient) listFolderCursor(ctx context.Context, arg interface{}) ([]metadata, string, error) {
+	var result listFolderResult
+	if err := c.call(ctx, "/files/list_folder", arg, &result); err != nil {
+		return nil, "", err
+	}
+	return c.listFolderContinue(ctx, &result)
+}
+
+// listFolderChanges returns the entries added, changed or deleted since the
+// listing of cursor, deleted ones with the deleted tag, and the cursor to
+// continue with. A cursor which expired fails with a reset error.
+func (c *apiClient) listFolderChanges(ctx context.Context, cursor string) ([]metadata, string, error) {
+	return c.listFolderContinue(ctx, &listFolderResult{Cursor: cursor, HasMore: true})
+}
+
+type listFolderResult struct {
+	Entries []metadata `json:"entries"`
+	Cursor  string     `json:"cursor"`
+	HasMore bool       `json:"has_more"`
+}
+
+// listFolderContinue returns the entries of result and the ones left after
+// its cursor.
+func (c *apiClient) listFolderContinue(ctx context.Context, result *listFolderResult) ([]metadata, string, error) {
+	entries := result.Entries
+	for result.HasMore {
+		cursor := result.Cursor
+		result.Entries = nil
+		if err := c.call(ctx, "/files/list_folder/continue", map[string]string{"cursor": cursor}, result); err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, result.Entries...)
+	}
+	return entries, result.Cursor, nil
+}
+
+// upload writes data to the file at p, overwriting an existing file.
+func (c *apiClient) upload(ctx context.Context, p string, data []byte) error {
+	arg := map[string]interface{}{
+		"path": p,
+		"mode": "overwrite",
+		"mute": true,
+	}
+	_, err := c.content(ctx, "/files/upload", arg, data)
+	return err
+}
+
+// download returns the contents of the file at p.
+func (c *apiClient) download(ctx context.Context, p string) ([]byte, error) {
+	return c.content(ctx, "/files/download", &pathArg{Path: p}, nil)
+}
+
+// downloadRange returns length bytes of the file at p from offset off. Less
+// bytes are returned at the end of the file.
+func (c *apiClient) downloadRange(ctx context.Context, p string, off, length int64) ([]byte, error) {
+	argJSON, err := json.Marshal(&pathArg{Path: p})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(ctx, true, func() (*http.Request, error) {
+		req, err := c.newContentRequest("/files/download", argJSON, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+		return req, nil
+	})
+}
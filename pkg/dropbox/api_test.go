@@ -0,0 +1,69 @@
+package dropbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestAPIRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		// Fails the first request, with the status or by closing the
+		// connection if 0
+		status int
+		want   int32
+	}{
+		{name: "idempotent server error", endpoint: "/files/get_metadata", status: http.StatusInternalServerError, want: 2},
+		{name: "idempotent network error", endpoint: "/files/get_metadata", want: 2},
+		{name: "copy server error", endpoint: "/files/copy_v2", status: http.StatusInternalServerError, want: 1},
+		{name: "copy network error", endpoint: "/files/copy_v2", want: 1},
+		{name: "copy rate limited", endpoint: "/files/copy_v2", status: http.StatusTooManyRequests, want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) > 1 {
+					w.Write([]byte("{}"))
+					return
+				}
+				if tc.status == 0 {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+			client := newAPIClient(&Config{DropboxAPIURL: server.URL}, "fake")
+
+			err := client.call(context.Background(), tc.endpoint, nil, nil)
+			if n := atomic.LoadInt32(&requests); n != tc.want {
+				t.Errorf("Expected %d requests, got %d", tc.want, n)
+			}
+			if (err == nil) != (tc.want == 2) {
+				t.Errorf("Unexpected result: %v", err)
+			}
+		})
+	}
+}
+
+func TestAPIRetryCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client := newAPIClient(&Config{DropboxAPIURL: server.URL}, "fake")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	if err := client.call(ctx, "/files/get_metadata", nil, nil); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
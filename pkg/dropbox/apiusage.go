@@ -0,0 +1,169 @@
+package dropbox
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Directions of apiBytesTotal
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// Hosts the usage proxy connects to
+var dropboxHostSuffixes = []string{".dropboxapi.com", ".dropbox.com"}
+
+// recordAPICall accounts an API call made by the driver to volumeID. Calls
+// made for no volume are not accounted.
+func recordAPICall(volumeID string, sent, received int64, statusCode int) {
+	if volumeID == "" {
+		return
+	}
+	apiCallsTotal.WithLabelValues(volumeID).Inc()
+	if statusCode == http.StatusTooManyRequests {
+		apiThrottledTotal.WithLabelValues(volumeID).Inc()
+	}
+	if sent > 0 {
+		apiBytesTotal.WithLabelValues(volumeID, directionUpload).Add(float64(sent))
+	}
+	apiBytesTotal.WithLabelValues(volumeID, directionDownload).Add(float64(received))
+}
+
+// mountEnv returns the environment of the mount process of volumeID, which
+// sends its Dropbox traffic through the usage proxy if there is one. The
+// volume is the user of the proxy URL, so the proxy can account the traffic
+// to it.
+func (n *nodeServer) mountEnv(volumeID string) []string {
+	if n.cfg.APIUsageProxyAddress == "" {
+		return nil
+	}
+	proxyURL := &url.URL{
+		Scheme: "http",
+		User:   url.User(volumeID),
+		Host:   n.cfg.APIUsageProxyAddress,
+	}
+	return []string{"HTTPS_PROXY=" + proxyURL.String()}
+}
+
+// usageProxy is an HTTP CONNECT proxy to Dropbox which accounts the bytes
+// tunneled through it to the volume named in the proxy credentials. The
+// tunneled traffic is TLS, so the calls of the backends and their rate
+// limits can't be seen.
+type usageProxy struct{}
+
+// startUsageProxy listens on addr and serves the usage proxy until the
+// process exits.
+func startUsageProxy(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Serving Dropbox usage proxy on %s", addr)
+	go func() {
+		if err := http.Serve(l, usageProxy{}); err != nil {
+			glog.Errorf("Usage proxy failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (usageProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isDropboxHost(r.Host) {
+		http.Error(w, "Only Dropbox hosts are allowed", http.StatusForbidden)
+		return
+	}
+	volumeID := proxyUser(r)
+	if volumeID == "" {
+		http.Error(w, "Volume missing in proxy credentials", http.StatusProxyAuthRequired)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't hijack connection", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		glog.Errorf("Can't hijack proxy connection of volume %s: %v", volumeID, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	apiConnectionsTotal.WithLabelValues(volumeID).Inc()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{w: upstream, volumeID: volumeID, direction: directionUpload}, buf)
+		// Let the server see the end of the request
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(&countingWriter{w: conn, volumeID: volumeID, direction: directionDownload}, upstream)
+	conn.Close()
+	wg.Wait()
+}
+
+// proxyUser returns the user in the basic Proxy-Authorization of r.
+func proxyUser(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(decoded), ":", 2)[0]
+}
+
+func isDropboxHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	for _, suffix := range dropboxHostSuffixes {
+		if strings.HasSuffix("."+host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter accounts the bytes written to w as they pass, so that long
+// lived connections show up in the metrics before they are closed.
+type countingWriter struct {
+	w         io.Writer
+	volumeID  string
+	direction string
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	apiBytesTotal.WithLabelValues(c.volumeID, c.direction).Add(float64(n))
+	return n, err
+}
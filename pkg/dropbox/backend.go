@@ -0,0 +1,168 @@
+package dropbox
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// Backend mounts a Dropbox account to a local directory.
+type Backend interface {
+	Name() string
+	// Command is the executable run to mount, empty if the backend mounts
+	// without one
+	Command() string
+	// Mount writes the config of the backend into ConfigDir and mounts
+	// Dropbox to MountPath. It returns the pid of the process serving the
+	// mount, or 0 if it's unknown.
+	Mount(ctx context.Context, req *mountRequest) (int, error)
+	Unmount(mountPath string) error
+	// WriteToken replaces the access token used by a mount
+	WriteToken(configDir, token string) error
+	// RemoveConfig removes the files written to configDir by Mount
+	RemoveConfig(configDir string) error
+	Stats(mountPath string) ([]*csi.VolumeUsage, error)
+}
+
+type mountRequest struct {
+	MountPath string
+	ConfigDir string
+	// Directory for the local cache of the backend
+	CacheDir string
+	Token    string
+	ReadOnly bool
+	Owner    mountOwner
+	// Keys of an encrypted volume, only set when staging it
+	Encryption *encryptionKeys
+	// Volume context, for the options of the backend
+	VolumeContext map[string]string
+	// Added to the environment of the mount process
+	Env []string
+	// Volume the Dropbox API usage of a mount served by the driver is
+	// accounted to
+	VolumeID string
+	// Called when the process serving the mount exits, if the backend runs
+	// it as a child of the driver
+	OnExit func(pid int, err error, stderr string)
+}
+
+// tokenPath is the file every backend keeps the access token of a volume in.
+func tokenPath(configDir string) string {
+	return path.Join(configDir, "dropbox_token")
+}
+
+// volumeConfigDir is the directory keeping the backend config and token of
+// a volume. It is only accessible by the driver.
+func (n *nodeServer) volumeConfigDir(volumeID string) string {
+	return path.Join(n.credentialsDir, url.PathEscape(volumeID))
+}
+
+func newBackends(cfg *Config, runner commandRunner, mounter mount.Interface) map[string]Backend {
+	return map[string]Backend{
+		backendDbxfs:  newDbxfsBackend(cfg, runner, mounter),
+		backendRclone: newRcloneBackend(cfg, runner, mounter),
+		backendNative: newNativeBackend(cfg, mounter),
+	}
+}
+
+// backend returns the backend named in the volume context, or the default
+// backend of the driver.
+func (n *nodeServer) backend(volCtx map[string]string) (Backend, error) {
+	name := n.cfg.Backend
+	if b, ok := volCtx["backend"]; ok {
+		name = b
+	}
+	if name == "" {
+		name = defaultBackend
+	}
+
+	b, ok := n.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend %q", name)
+	}
+	return b, nil
+}
+
+// unmountIfMounted unmounts target. A target which is already unmounted or
+// doesn't exist is not an error, as kubelet retries unmounts.
+func unmountIfMounted(mounter mount.Interface, target string) error {
+	notMnt, err := isNotMountPoint(mounter, target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		// A dead FUSE mount can't be stat'ed but still has to be unmounted
+		if !mount.IsCorruptedMnt(err) {
+			return err
+		}
+		notMnt = false
+	}
+	if notMnt {
+		return nil
+	}
+
+	return mounter.Unmount(target)
+}
+
+// isNotMountPoint tells whether p is not a mount point. A bind mount within
+// a filesystem, like a mirror, has the device of its parent and is looked up
+// in the mount table.
+func isNotMountPoint(mounter mount.Interface, p string) (bool, error) {
+	notMnt, err := mounter.IsLikelyNotMountPoint(p)
+	if err != nil || !notMnt {
+		return notMnt, err
+	}
+	return mount.IsNotMountPoint(mounter, p)
+}
+
+// shredFiles overwrites paths with zeros and removes them, ignoring the ones
+// which don't exist. They may hold credentials.
+func shredFiles(paths ...string) error {
+	for _, p := range paths {
+		if err := shredFile(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func shredFile(p string) error {
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		glog.Warningf("Can't overwrite %s before removing it: %v", p, err)
+	}
+	return os.Remove(p)
+}
+
+// shredDir shreds the files in dir and its subdirectories, and removes it.
+// The backends may leave files of their own, like caches of the token.
+func shredDir(dir string) error {
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return shredFile(p)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,143 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// statErrMounter fails to stat its mount points with err, like a dead FUSE
+// mount.
+type statErrMounter struct {
+	*mount.FakeMounter
+	err error
+}
+
+func (m *statErrMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	return true, &os.PathError{Op: "stat", Path: file, Err: m.err}
+}
+
+func TestUnmountIfMounted(t *testing.T) {
+	dir := t.TempDir()
+	mounted, unmounted := path.Join(dir, "mounted"), path.Join(dir, "unmounted")
+	for _, p := range []string{mounted, unmounted} {
+		if err := os.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		target    string
+		statErr   error
+		unmounted bool
+		fails     bool
+	}{
+		{name: "mounted", target: mounted, unmounted: true},
+		{name: "already unmounted", target: unmounted},
+		{name: "missing", target: path.Join(dir, "missing")},
+		{name: "dead mount", target: mounted, statErr: syscall.ENOTCONN, unmounted: true},
+		{name: "stat fails", target: mounted, statErr: syscall.ELOOP, fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fake := mount.NewFakeMounter([]mount.MountPoint{{Device: "dbxfs", Path: mounted, Type: "fuse.dbxfs"}})
+			var mounter mount.Interface = fake
+			if test.statErr != nil {
+				mounter = &statErrMounter{FakeMounter: fake, err: test.statErr}
+			}
+
+			err := unmountIfMounted(mounter, test.target)
+			if (err != nil) != test.fails {
+				t.Errorf("Expected failure %t, got %v", test.fails, err)
+			}
+			if unmounted := len(fake.GetLog()) > 0; unmounted != test.unmounted {
+				t.Errorf("Expected unmount %t, got %v", test.unmounted, fake.GetLog())
+			}
+		})
+	}
+}
+
+func TestBackendSelection(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		dflt    string
+		volCtx  map[string]string
+		backend string
+		fails   bool
+	}{
+		{name: "default", backend: backendDbxfs},
+		{name: "driver default", dflt: backendRclone, backend: backendRclone},
+		{name: "volume context", volCtx: map[string]string{"backend": backendRclone}, backend: backendRclone},
+		{name: "volume context over driver default", dflt: backendRclone, volCtx: map[string]string{"backend": backendDbxfs}, backend: backendDbxfs},
+		{name: "unknown", volCtx: map[string]string{"backend": "s3fs"}, fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := NewNodeServer(&Config{Backend: test.dflt})
+			b, err := n.backend(test.volCtx)
+			if (err != nil) != test.fails {
+				t.Fatalf("Expected failure %t, got %v", test.fails, err)
+			}
+			if err == nil && b.Name() != test.backend {
+				t.Errorf("Expected backend %s, got %s", test.backend, b.Name())
+			}
+		})
+	}
+}
+
+func TestRcloneMount(t *testing.T) {
+	for _, readonly := range []bool{false, true} {
+		n := NewNodeServer(&Config{})
+		runner := &stubRunner{}
+		mounter := mount.NewFakeMounter(nil)
+		runner.mount = func(args []string) error {
+			return mounter.Mount("dropbox:", args[2], "fuse.rclone", nil)
+		}
+		useRunner(n, runner)
+		useMounter(n, mounter)
+		mountPath, configDir := t.TempDir(), t.TempDir()
+
+		_, err := n.backends[backendRclone].Mount(context.Background(), &mountRequest{
+			MountPath: mountPath,
+			ConfigDir: configDir,
+			Token:     "token",
+			ReadOnly:  readonly,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands := runner.commands()
+		if len(commands) != 1 {
+			t.Fatalf("Expected one mount command, got %v", commands)
+		}
+		command := strings.Join(commands[0], " ")
+		if want := "rclone mount dropbox: " + mountPath + " --config " + rcloneConfigPath(configDir); !strings.HasPrefix(command, want) {
+			t.Errorf("Expected %q, got %q", want, command)
+		}
+		if strings.Contains(command, "--read-only") != readonly {
+			t.Errorf("Expected read-only %t, got %q", readonly, command)
+		}
+		config, err := ioutil.ReadFile(rcloneConfigPath(configDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(config), "type = dropbox") || !strings.Contains(string(config), `"access_token":"token"`) {
+			t.Errorf("rclone config has no Dropbox remote with the token: %s", config)
+		}
+
+		if err := n.backends[backendRclone].Unmount(mountPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.backends[backendRclone].RemoveConfig(configDir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(tokenPath(configDir)); !os.IsNotExist(err) {
+			t.Errorf("Token is left: %v", err)
+		}
+	}
+}
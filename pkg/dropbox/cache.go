@@ -0,0 +1,107 @@
+package dropbox
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Cache modes of rclone VFS, from no caching to caching whole files for reads
+// and writes
+var cacheModes = []string{"off", "minimal", "writes", "full"}
+
+// A size like 512M or 10G, also used for bandwidth limits
+var cacheSizeRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTP]?$`)
+
+// cacheArgs returns the rclone VFS cache flags for the cacheMode,
+// cacheMaxSize and cacheMaxAge attributes in volCtx, caching in cacheDir.
+func cacheArgs(volCtx map[string]string, cacheDir string) ([]string, error) {
+	mode, size, age := volCtx["cacheMode"], volCtx["cacheMaxSize"], volCtx["cacheMaxAge"]
+	if mode == "" {
+		if size != "" || age != "" {
+			return nil, fmt.Errorf("cacheMaxSize and cacheMaxAge require cacheMode")
+		}
+		return nil, nil
+	}
+	if !contains(cacheModes, mode) {
+		return nil, fmt.Errorf("Unknown cacheMode %q, must be one of %v", mode, cacheModes)
+	}
+
+	args := []string{"--vfs-cache-mode", mode, "--cache-dir", cacheDir}
+	if size != "" {
+		if !cacheSizeRegexp.MatchString(size) {
+			return nil, fmt.Errorf("Invalid cacheMaxSize %q, must be a size like 10G", size)
+		}
+		args = append(args, "--vfs-cache-max-size", size)
+	}
+	if age != "" {
+		if _, err := time.ParseDuration(age); err != nil {
+			return nil, fmt.Errorf("Invalid cacheMaxAge %q, must be a duration like 1h", age)
+		}
+		args = append(args, "--vfs-cache-max-age", age)
+	}
+	return args, nil
+}
+
+// bwLimitArgs returns the rclone bandwidth limit for the bwLimitUpload and
+// bwLimitDownload attributes in volCtx, in bytes per second like 10M.
+func bwLimitArgs(volCtx map[string]string) ([]string, error) {
+	up, down := volCtx["bwLimitUpload"], volCtx["bwLimitDownload"]
+	if up == "" && down == "" {
+		return nil, nil
+	}
+	for key, limit := range map[string]string{"bwLimitUpload": up, "bwLimitDownload": down} {
+		if limit != "" && !cacheSizeRegexp.MatchString(limit) {
+			return nil, fmt.Errorf("Invalid %s %q, must be bytes per second like 10M", key, limit)
+		}
+	}
+	if up == "" {
+		up = "off"
+	}
+	if down == "" {
+		down = "off"
+	}
+	return []string{"--bwlimit", up + ":" + down}, nil
+}
+
+// excludeArgs returns the rclone filters for the comma separated glob
+// patterns of the exclude attribute in volCtx. Matching paths are hidden
+// from the mount and never synced.
+func excludeArgs(volCtx map[string]string) ([]string, error) {
+	var args []string
+	for _, p := range strings.Split(volCtx["exclude"], ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, "-") || strings.HasPrefix(p, "+") {
+			return nil, fmt.Errorf("Invalid exclude pattern %q", p)
+		}
+		args = append(args, "--exclude", p)
+	}
+	return args, nil
+}
+
+// volumeCacheDir is the local cache of a staged volume. It's on the node
+// disk, unlike the config dir.
+func (n *nodeServer) volumeCacheDir(volumeID string) string {
+	return path.Join(n.rootDir, "cache", url.PathEscape(volumeID))
+}
+
+// removeVolumeCache removes the cache of an unstaged volume, unless
+// RetainCache keeps it for the next stage. Writes still in the cache were
+// uploaded by the backend before it unmounted.
+func (n *nodeServer) removeVolumeCache(volumeID string) {
+	if n.cfg.RetainCache {
+		return
+	}
+	if err := os.RemoveAll(n.volumeCacheDir(volumeID)); err != nil {
+		glog.Errorf("Can't remove cache of volume %s: %v", volumeID, err)
+	}
+}
@@ -0,0 +1,47 @@
+package dropbox
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Access modes of a Dropbox volume. Dropbox is a shared filesystem, so it can
+// be mounted by many nodes at once.
+var supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// validateVolumeCapability checks that vc is a mount volume with a supported
+// access mode.
+func validateVolumeCapability(vc *csi.VolumeCapability) error {
+	if vc.GetBlock() != nil {
+		return fmt.Errorf("Block volumes are not supported")
+	}
+	if vc.GetMount() == nil {
+		return fmt.Errorf("Volume capability has no access type")
+	}
+
+	mode := vc.GetAccessMode().GetMode()
+	for _, m := range supportedAccessModes {
+		if m == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("Access mode %s is not supported", mode)
+}
+
+func validateVolumeCapabilities(vcs []*csi.VolumeCapability) error {
+	for _, vc := range vcs {
+		if err := validateVolumeCapability(vc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
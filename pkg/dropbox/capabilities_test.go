@@ -0,0 +1,45 @@
+package dropbox
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	unknownMode := mountCapability()
+	unknownMode.AccessMode.Mode = csi.VolumeCapability_AccessMode_UNKNOWN
+
+	for _, test := range []struct {
+		name      string
+		caps      []*csi.VolumeCapability
+		confirmed bool
+	}{
+		{name: "mount", caps: []*csi.VolumeCapability{mountCapability()}, confirmed: true},
+		{name: "block", caps: []*csi.VolumeCapability{mountCapability(), block}},
+		{name: "no access type", caps: []*csi.VolumeCapability{{AccessMode: mountCapability().AccessMode}}},
+		{name: "unknown access mode", caps: []*csi.VolumeCapability{unknownMode}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cs := NewControllerServer(useTestDropbox(&Config{}))
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "volume",
+				VolumeCapabilities: test.caps,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if confirmed := resp.GetConfirmed() != nil; confirmed != test.confirmed {
+				t.Errorf("Expected confirmed %t, got %v", test.confirmed, resp)
+			}
+			if !test.confirmed && resp.GetMessage() == "" {
+				t.Error("Unconfirmed capabilities have no message")
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package dropbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Volume context key of volumes whose writes are stopped at their capacity
+const enforceCapacityKey = "enforceCapacity"
+
+// isCapacityEnforced tells whether the volume of volCtx has enforceCapacity.
+func isCapacityEnforced(volCtx map[string]string) (bool, error) {
+	v, ok := volCtx[enforceCapacityKey]
+	if !ok {
+		return false, nil
+	}
+	enforced, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %q", enforceCapacityKey, v)
+	}
+	return enforced, nil
+}
+
+// validateEnforceCapacity checks that a volume with enforceCapacity has a
+// size and a folder to measure.
+func validateEnforceCapacity(volCtx map[string]string, capacity int64) error {
+	if enforced, err := isCapacityEnforced(volCtx); err != nil || !enforced {
+		return err
+	}
+	if capacity <= 0 {
+		return fmt.Errorf("%s requires a provisioned volume with a capacity", enforceCapacityKey)
+	}
+	if isPathTemplate(volCtx["path"]) {
+		return fmt.Errorf("%s can't be used with a path template", enforceCapacityKey)
+	}
+	return nil
+}
+
+// checkCapacity measures the folder of vol if it has enforceCapacity, and
+// stops its writes once it reaches its capacity. A volume with an operation
+// in flight is checked on the next round.
+func (n *nodeServer) checkCapacity(ctx context.Context, client *apiClient, vol *volumeState) {
+	if enforced, _ := isCapacityEnforced(vol.VolumeContext); !enforced || vol.Capacity <= 0 {
+		return
+	}
+	used, err := n.measureFolder(ctx, client, vol)
+	n.recordAPIError(vol.VolumeID, err)
+	if err != nil {
+		glog.Errorf("Can't get the size of folder %s of volume %s: %v", vol.SubPath, vol.VolumeID, err)
+		return
+	}
+
+	if !n.volumeLocks.tryAcquire(vol.VolumeID) {
+		return
+	}
+	defer n.volumeLocks.release(vol.VolumeID)
+	n.updateVolume(vol.VolumeID, func(vol *volumeState) {
+		vol.UsedBytes = used
+	})
+	n.applyCapacity(vol.VolumeID)
+}
+
+// folderSize is the size of the folder of a volume, updated with the changes
+// listed since its cursor, so that the folder is only listed in full on the
+// first check and when the cursor expires.
+type folderSize struct {
+	path   string
+	cursor string
+	// Sizes of the files in the folder by lower case path
+	files map[string]int64
+	total int64
+}
+
+// apply updates the size with the entries listed since the cursor.
+func (s *folderSize) apply(entries []metadata) {
+	for _, e := range entries {
+		switch e.Tag {
+		case "file":
+			s.total += int64(e.Size) - s.files[e.PathLower]
+			s.files[e.PathLower] = int64(e.Size)
+		case "deleted":
+			// The entry of a deleted folder stands for its files too
+			prefix := e.PathLower + "/"
+			for p, size := range s.files {
+				if p == e.PathLower || strings.HasPrefix(p, prefix) {
+					s.total -= size
+					delete(s.files, p)
+				}
+			}
+		}
+	}
+}
+
+// folderSizeCache keeps the folder sizes of volumes with enforceCapacity.
+type folderSizeCache struct {
+	mu      sync.Mutex
+	volumes map[string]*folderSize
+}
+
+func newFolderSizeCache() *folderSizeCache {
+	return &folderSizeCache{
+		volumes: map[string]*folderSize{},
+	}
+}
+
+func (c *folderSizeCache) get(volumeID string) *folderSize {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.volumes[volumeID]
+}
+
+func (c *folderSizeCache) set(volumeID string, size *folderSize) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.volumes[volumeID] = size
+}
+
+func (c *folderSizeCache) remove(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.volumes, volumeID)
+}
+
+// measureFolder returns the size of the files in the folder of vol and its
+// subfolders. Only the changes since the last check are listed.
+func (n *nodeServer) measureFolder(ctx context.Context, client *apiClient, vol *volumeState) (int64, error) {
+	p := "/" + vol.SubPath
+	if size := n.folderSizes.get(vol.VolumeID); size != nil && size.path == p {
+		entries, cursor, err := client.listFolderChanges(ctx, size.cursor)
+		if err == nil {
+			size.apply(entries)
+			size.cursor = cursor
+			return size.total, nil
+		}
+		if !isAPIReset(err) {
+			return 0, err
+		}
+		glog.V(4).Infof("Listing of folder %s of volume %s expired, listing it again", vol.SubPath, vol.VolumeID)
+	}
+
+	entries, cursor, err := client.listFolderCursor(ctx, map[string]interface{}{"path": p, "recursive": true})
+	if err != nil {
+		return 0, err
+	}
+	size := &folderSize{path: p, cursor: cursor, files: map[string]int64{}}
+	size.apply(entries)
+	n.folderSizes.set(vol.VolumeID, size)
+	return size.total, nil
+}
+
+// Changes the read-only flag of a target, replaced in tests
+var setTargetReadOnly = setReadOnly
+
+// applyCapacity makes the writable targets of a volume read-only when its
+// folder is at or over its capacity, and writable again once it is below,
+// e.g. after files were deleted in Dropbox or the volume was expanded. The
+// FUSE processes of the backends can't fail writes with ENOSPC, so they fail
+// with EROFS. Only the targets which were changed are recorded, the others
+// are retried on the next check. The volume lock must be held.
+func (n *nodeServer) applyCapacity(volumeID string) {
+	vol, ok := n.stagedVolume(volumeID)
+	if !ok || vol.Capacity <= 0 {
+		return
+	}
+	if enforced, _ := isCapacityEnforced(vol.VolumeContext); !enforced {
+		return
+	}
+	over := vol.UsedBytes >= vol.Capacity
+
+	if !over {
+		if !vol.OverCapacity && len(vol.CapacityReadOnlyTargets) == 0 {
+			return
+		}
+		var failed []string
+		for _, t := range vol.CapacityReadOnlyTargets {
+			if !contains(vol.Targets, t) {
+				continue
+			}
+			if err := setTargetReadOnly(t, false); err != nil {
+				glog.Errorf("Can't make %s of volume %s writable again: %v", t, volumeID, err)
+				failed = append(failed, t)
+			}
+		}
+		n.updateVolume(volumeID, func(vol *volumeState) {
+			vol.OverCapacity = false
+			vol.CapacityReadOnlyTargets = failed
+		})
+		if vol.OverCapacity {
+			n.problems.set(volumeID, problemCapacity, "")
+			glog.Infof("Volume %s is below its capacity of %d bytes again, writes are allowed", volumeID, vol.Capacity)
+		}
+		return
+	}
+
+	readOnly := append([]string(nil), vol.CapacityReadOnlyTargets...)
+	for _, t := range n.publishedTargets(volumeID) {
+		if contains(readOnly, t) || n.isReadOnlyMount(t) {
+			continue
+		}
+		if err := setTargetReadOnly(t, true); err != nil {
+			glog.Errorf("Can't make %s of volume %s read-only: %v", t, volumeID, err)
+			continue
+		}
+		readOnly = append(readOnly, t)
+	}
+	n.updateVolume(volumeID, func(vol *volumeState) {
+		vol.OverCapacity = true
+		vol.CapacityReadOnlyTargets = readOnly
+	})
+	if vol.OverCapacity {
+		return
+	}
+	msg := fmt.Sprintf("Folder uses %d bytes of the capacity of %d bytes, the volume is read-only until files are deleted or it is expanded", vol.UsedBytes, vol.Capacity)
+	n.problems.set(volumeID, problemCapacity, msg)
+	glog.Warningf("Volume %s: %s", volumeID, msg)
+	n.events.warning(volumeID, eventCapacityExceeded, msg)
+}
+
+// limitTarget makes a target published while its volume is over capacity
+// read-only. The volume lock must be held.
+func (n *nodeServer) limitTarget(volumeID, targetPath string) error {
+	vol, ok := n.stagedVolume(volumeID)
+	if !ok || !vol.OverCapacity {
+		return nil
+	}
+	if err := setTargetReadOnly(targetPath, true); err != nil {
+		return err
+	}
+	n.updateVolume(volumeID, func(vol *volumeState) {
+		vol.CapacityReadOnlyTargets = append(vol.CapacityReadOnlyTargets, targetPath)
+	})
+	return nil
+}
+
+// isReadOnlyMount tells whether the topmost mount at p is read-only.
+func (n *nodeServer) isReadOnlyMount(p string) bool {
+	mps, err := n.mounter.List()
+	if err != nil {
+		return false
+	}
+	readOnly := false
+	for _, mp := range mps {
+		if mp.Path == p {
+			readOnly = contains(mp.Opts, "ro")
+		}
+	}
+	return readOnly
+}
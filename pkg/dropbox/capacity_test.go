@@ -0,0 +1,131 @@
+package dropbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestApplyCapacityRetriesFailedTargets(t *testing.T) {
+	n := newTestNodeServer(t, &Config{})
+	dir := t.TempDir()
+	targets := []string{path.Join(dir, "a"), path.Join(dir, "b")}
+	for _, target := range targets {
+		if err := n.mounter.Mount(testDropboxDir, target, "", []string{"bind"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n.addVolume(&volumeState{
+		VolumeID:      "capacity",
+		MountPath:     path.Join(dir, "staging"),
+		Capacity:      100,
+		UsedBytes:     100,
+		Targets:       targets,
+		VolumeContext: map[string]string{enforceCapacityKey: "true"},
+	})
+
+	var changed []string
+	failing := map[string]bool{}
+	defer func(f func(string, bool) error) { setTargetReadOnly = f }(setTargetReadOnly)
+	setTargetReadOnly = func(p string, readOnly bool) error {
+		if failing[p] {
+			return errors.New("busy")
+		}
+		changed = append(changed, p)
+		return nil
+	}
+
+	expect := func(over bool, readOnly []string) {
+		t.Helper()
+		vol, _ := n.stagedVolume("capacity")
+		if vol.OverCapacity != over || !reflect.DeepEqual(vol.CapacityReadOnlyTargets, readOnly) {
+			t.Fatalf("Expected over capacity %t with read-only targets %v, got %t with %v", over, readOnly, vol.OverCapacity, vol.CapacityReadOnlyTargets)
+		}
+	}
+
+	failing[targets[1]] = true
+	n.applyCapacity("capacity")
+	expect(true, targets[:1])
+	if n.problems.get("capacity", problemCapacity) == "" {
+		t.Error("Volume over capacity has no problem")
+	}
+
+	// Only the failed target is changed again
+	failing[targets[1]] = false
+	changed = nil
+	n.applyCapacity("capacity")
+	expect(true, targets)
+	if !reflect.DeepEqual(changed, targets[1:]) {
+		t.Errorf("Expected %v to be made read-only, got %v", targets[1:], changed)
+	}
+
+	n.updateVolume("capacity", func(vol *volumeState) { vol.UsedBytes = 50 })
+	failing[targets[0]] = true
+	n.applyCapacity("capacity")
+	expect(false, targets[:1])
+	if problem := n.problems.get("capacity", problemCapacity); problem != "" {
+		t.Errorf("Volume below capacity has problem %q", problem)
+	}
+
+	failing[targets[0]] = false
+	changed = nil
+	n.applyCapacity("capacity")
+	expect(false, nil)
+	if !reflect.DeepEqual(changed, targets[:1]) {
+		t.Errorf("Expected %v to be made writable, got %v", targets[:1], changed)
+	}
+}
+
+func TestMeasureFolderListsChanges(t *testing.T) {
+	cfg := useTestDropbox(&Config{})
+	n := newTestNodeServer(t, cfg)
+	folder := testFolder(t)
+	write := func(name string, size int) {
+		t.Helper()
+		p := path.Join(testDropboxDir, folder, name)
+		if err := os.MkdirAll(path.Dir(p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, make([]byte, size), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vol := &volumeState{VolumeID: "measured", SubPath: folder}
+	client := newAPIClient(cfg, "fake")
+	expect := func(expected int64) {
+		t.Helper()
+		size, err := n.measureFolder(context.Background(), client, vol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != expected {
+			t.Fatalf("Expected folder size %d, got %d", expected, size)
+		}
+	}
+
+	write("a", 10)
+	write("docs/b", 20)
+	write("docs/old/c", 30)
+	expect(60)
+	listed := n.folderSizes.get("measured")
+
+	write("a", 15)
+	write("docs/d", 5)
+	if err := os.RemoveAll(path.Join(testDropboxDir, folder, "docs/old")); err != nil {
+		t.Fatal(err)
+	}
+	expect(40)
+	if n.folderSizes.get("measured") != listed {
+		t.Error("Folder was listed in full again")
+	}
+
+	// An expired cursor lists the folder again
+	listed.cursor = "expired"
+	write("e", 1)
+	expect(41)
+}
@@ -0,0 +1,117 @@
+package dropbox
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// volumeProblems keeps the problems of staged volumes found by the checks
+// talking to Dropbox, reported in the volume condition.
+type volumeProblems struct {
+	mu sync.Mutex
+	// Volume ID to problem, by kind of check
+	problems map[string]map[string]string
+}
+
+// Kinds of checks
+const (
+	problemToken    = "token"
+	problemFolder   = "folder"
+	problemCapacity = "capacity"
+)
+
+func newVolumeProblems() *volumeProblems {
+	return &volumeProblems{
+		problems: map[string]map[string]string{},
+	}
+}
+
+// set records the result of a check, an empty problem clears it.
+func (p *volumeProblems) set(volumeID, check, problem string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if problem == "" {
+		delete(p.problems[volumeID], check)
+		return
+	}
+	if p.problems[volumeID] == nil {
+		p.problems[volumeID] = map[string]string{}
+	}
+	p.problems[volumeID][check] = problem
+}
+
+func (p *volumeProblems) get(volumeID, check string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.problems[volumeID][check]
+}
+
+func (p *volumeProblems) remove(volumeID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.problems, volumeID)
+}
+
+// recordAPIError records an expired or revoked token of a volume from the
+// error of an API call, or clears it if err is nil.
+func (n *nodeServer) recordAPIError(volumeID string, err error) {
+	switch {
+	case err == nil:
+		n.problems.set(volumeID, problemToken, "")
+	case isAPIAuthError(err):
+		n.problems.set(volumeID, problemToken, fmt.Sprintf("Dropbox token is expired or revoked: %v", err))
+	}
+}
+
+// checkFolder records whether the folder of the path attribute of vol still
+// exists in Dropbox. Folders of path templates are per pod and not checked.
+func (n *nodeServer) checkFolder(ctx context.Context, client *apiClient, vol *volumeState) {
+	if vol.SubPath == "" || isPathTemplate(vol.SubPath) {
+		return
+	}
+	_, err := client.getMetadata(ctx, "/"+vol.SubPath)
+	n.recordAPIError(vol.VolumeID, err)
+	if err == nil {
+		n.problems.set(vol.VolumeID, problemFolder, "")
+	} else if isAPINotFound(err) {
+		n.problems.set(vol.VolumeID, problemFolder, fmt.Sprintf("Folder %s is deleted in Dropbox", vol.SubPath))
+	}
+}
+
+// volumeCondition reports the worst known problem of a staged volume: a
+// crashing or dead mount, an expired token, a deleted folder or a full
+// account.
+func (n *nodeServer) volumeCondition(volumeID string) *csi.VolumeCondition {
+	if cond := n.crashCondition(volumeID); cond != nil {
+		return cond
+	}
+	if vol, ok := n.stagedVolume(volumeID); ok {
+		if healthy, reason := n.isMountHealthy(vol); !healthy {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  "Mount is dead: " + reason,
+			}
+		}
+	}
+	for _, check := range []string{problemToken, problemFolder, problemCapacity} {
+		if problem := n.problems.get(volumeID, check); problem != "" {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  problem,
+			}
+		}
+	}
+	if cond := n.quotaCondition(volumeID); cond != nil {
+		return cond
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "Volume is healthy",
+	}
+}
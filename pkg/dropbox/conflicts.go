@@ -0,0 +1,111 @@
+package dropbox
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Volume context key of the policy for conflicted copies in the folder of a
+// volume
+const conflictFilesKey = "conflictFiles"
+
+// Policies for conflicted copies: report them, or also move them to
+// conflictsDirName in the folder of the volume
+const (
+	conflictFilesReport     = "report"
+	conflictFilesQuarantine = "quarantine"
+)
+
+// Folder in the folder of a volume conflicted copies are quarantined to
+const conflictsDirName = ".conflicts"
+
+// Matches the files Dropbox creates when writes collide, like
+// "a (conflicted copy 2020-01-02).txt", "a (Bob's conflicted copy
+// 2020-01-02).txt" or "a (Case Conflict).txt"
+var conflictedCopyRegexp = regexp.MustCompile(`(?i)\([^()]*(conflicted copy|case conflict|selective sync conflict)[^()]*\)`)
+
+// conflictFilesPolicy returns the conflictFiles policy of volCtx, or "" if
+// conflicted copies aren't looked for.
+func conflictFilesPolicy(volCtx map[string]string) (string, error) {
+	policy := volCtx[conflictFilesKey]
+	switch policy {
+	case "", conflictFilesReport, conflictFilesQuarantine:
+	default:
+		return "", fmt.Errorf("Unknown %s %q, must be %s or %s", conflictFilesKey, policy, conflictFilesReport, conflictFilesQuarantine)
+	}
+	if policy != "" && isPathTemplate(volCtx["path"]) {
+		return "", fmt.Errorf("%s can't be used with a path template", conflictFilesKey)
+	}
+	return policy, nil
+}
+
+// checkConflicts looks for conflicted copies in the folder of vol if it has
+// conflictFiles, reports the new ones and quarantines them as set.
+func (n *nodeServer) checkConflicts(ctx context.Context, client *apiClient, vol *volumeState) {
+	policy, _ := conflictFilesPolicy(vol.VolumeContext)
+	if policy == "" {
+		return
+	}
+	root := "/" + strings.Trim(vol.SubPath, "/")
+	listPath := root
+	if listPath == "/" {
+		// The root is listed with an empty path
+		listPath = ""
+	}
+	entries, err := client.listFolderArg(ctx, map[string]interface{}{"path": listPath, "recursive": true})
+	n.recordAPIError(vol.VolumeID, err)
+	if err != nil {
+		glog.Errorf("Can't look for conflicted copies in folder %s of volume %s: %v", vol.SubPath, vol.VolumeID, err)
+		return
+	}
+
+	var conflicts, added []string
+	for _, e := range entries {
+		// Dropbox paths are case insensitive, so the prefix is cut by length
+		if len(e.PathDisplay) <= len(root) {
+			continue
+		}
+		rel := strings.TrimPrefix(e.PathDisplay[len(root):], "/")
+		if e.Tag != "file" || rel == conflictsDirName || strings.HasPrefix(rel, conflictsDirName+"/") {
+			continue
+		}
+		if !conflictedCopyRegexp.MatchString(e.Name) {
+			continue
+		}
+		conflicts = append(conflicts, rel)
+		if !contains(vol.ConflictedFiles, rel) {
+			added = append(added, rel)
+		}
+	}
+
+	if len(added) > 0 {
+		msg := fmt.Sprintf("Dropbox created conflicted copies of files written concurrently: %s", strings.Join(added, ", "))
+		glog.Warningf("Volume %s: %s", vol.VolumeID, msg)
+		n.events.warning(vol.VolumeID, eventConflictedCopy, msg)
+	}
+
+	if policy == conflictFilesQuarantine {
+		var left []string
+		for _, rel := range conflicts {
+			to := path.Join(root, conflictsDirName, rel)
+			if err := client.moveFolder(ctx, path.Join(root, rel), to); err != nil && !isAPINotFound(err) {
+				glog.Errorf("Can't quarantine conflicted copy %s of volume %s: %v", rel, vol.VolumeID, err)
+				left = append(left, rel)
+				continue
+			}
+			conflictedFilesQuarantinedTotal.WithLabelValues(vol.VolumeID).Inc()
+			glog.Infof("Conflicted copy %s of volume %s is moved to %s", rel, vol.VolumeID, to)
+		}
+		conflicts = left
+	}
+
+	conflictedFiles.WithLabelValues(vol.VolumeID).Set(float64(len(conflicts)))
+	n.updateVolume(vol.VolumeID, func(vol *volumeState) {
+		vol.ConflictedFiles = conflicts
+	})
+}
@@ -1,25 +1,81 @@
 package dropbox
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
 )
 
 type controllerServer struct {
 	nodeID string
+	cfg    *Config
+	// Client to read the onDelete policy of persistent volumes, nil when not
+	// running in a cluster
+	kube kubernetes.Interface
+	// Elector of the replica running the background work, nil if leader
+	// election is disabled
+	leader *leaderElector
 }
 
-func NewControllerServer(nodeID string) *controllerServer {
+func NewControllerServer(cfg *Config) *controllerServer {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		glog.V(4).Infof("dropbox-csi: onDelete policy of volumes can't be read: %v", err)
+	}
+	var leader *leaderElector
+	if cfg.LeaderElection {
+		if kube == nil {
+			glog.Fatalf("Leader election requires running in a cluster: %v", err)
+		}
+		if leader, err = newLeaderElector(kube, cfg.DriverName, cfg.LeaderElectionNamespace); err != nil {
+			glog.Fatalf("Can't set up leader election: %v", err)
+		}
+	}
 	return &controllerServer{
-		nodeID: nodeID,
+		nodeID: cfg.NodeID,
+		cfg:    cfg,
+		kube:   kube,
+		leader: leader,
 	}
 }
 
+const (
+	// Folder in Dropbox to create provisioned volumes in, unless the
+	// StorageClass sets the parentPath parameter
+	defaultParentPath = "csi-volumes"
+)
+
+// What DeleteVolume does with the folder of a volume
+const (
+	onDeleteDelete  = "delete"
+	onDeleteRetain  = "retain"
+	onDeleteArchive = "archive"
+)
+
 func (c controllerServer) ControllerGetCapabilities(context.Context, *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: getControllerServiceCapabilities(
-			[]csi.ControllerServiceCapability_RPC_Type{}),
+			[]csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			}),
 	}, nil
 }
 
@@ -40,12 +96,246 @@ func getControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_T
 	return csc
 }
 
-func (c controllerServer) CreateVolume(context.Context, *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	panic("implement me")
+// CreateVolume creates a folder in Dropbox for the volume. The volume ID is
+// the path of the folder relative to the Dropbox root, and is passed to the
+// node as the path volume attribute.
+func (c controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	parentPath := defaultParentPath
+	if p, ok := req.GetParameters()["parentPath"]; ok {
+		parentPath = strings.Trim(p, "/")
+	}
+	volumePath, err := resolveSubPath(parentPath, req.GetName())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := resolveSubPath("", volumePath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volCtx := map[string]string{
+		"path": volumePath,
+	}
+	for _, key := range storageClassVolumeContextKeys {
+		if v, ok := req.GetParameters()[key]; ok {
+			volCtx[key] = v
+		}
+	}
+	topology, err := accountTopology(req.GetParameters()["topologyAccount"], req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := req.GetParameters()["onDelete"]; ok {
+		if p != onDeleteDelete && p != onDeleteRetain && p != onDeleteArchive {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid onDelete %q, must be delete, retain or archive", p)
+		}
+		volCtx["onDelete"] = p
+	}
+	createLink := false
+	if v, ok := req.GetParameters()["createSharedLink"]; ok {
+		if createLink, err = strconv.ParseBool(v); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid createSharedLink %q", v)
+		}
+	}
+	if b, ok := req.GetParameters()["backend"]; ok {
+		if b != backendDbxfs && b != backendRclone && b != backendNative {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown backend %q", b)
+		}
+		volCtx["backend"] = b
+	}
+	encrypted, err := isEncrypted(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if encrypted {
+		// Only rclone encrypts
+		if volCtx["backend"] == backendDbxfs {
+			return nil, status.Errorf(codes.InvalidArgument, "%s requires the %s backend", encryptionKey, backendRclone)
+		}
+		volCtx["backend"] = backendRclone
+	}
+
+	team := teamSpaceFrom(req.GetParameters(), req.GetSecrets())
+	team.setVolumeContext(volCtx)
+	client, err := teamAPIClient(ctx, c.cfg, token, team)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if err := validateEnforceCapacity(volCtx, capacity); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := conflictFilesPolicy(volCtx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if capacity > 0 {
+		if err := checkFreeSpace(ctx, client, capacity); err != nil {
+			return nil, err
+		}
+		volCtx["capacity"] = strconv.FormatInt(capacity, 10)
+	}
+
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		if err := restoreSnapshot(ctx, client, team, snapshot.GetSnapshotId(), volumePath); err != nil {
+			return nil, err
+		}
+	} else if source := req.GetVolumeContentSource().GetVolume(); source != nil {
+		if err := cloneVolume(ctx, client, team, source.GetVolumeId(), volumePath); err != nil {
+			return nil, err
+		}
+	} else if err := client.createFolder(ctx, "/"+volumePath); err != nil {
+		return nil, apiStatusError(err, "Can't create folder %s", volumePath)
+	}
+	glog.V(4).Infof("dropbox-csi: folder %s is created for volume %s", volumePath, req.GetName())
+
+	if createLink {
+		link, err := client.createSharedLink(ctx, "/"+volumePath)
+		if err != nil {
+			return nil, apiStatusError(err, "Can't create shared link of folder %s", volumePath)
+		}
+		volCtx["sharedLink"] = link
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           team.id(volumePath),
+			CapacityBytes:      capacity,
+			VolumeContext:      volCtx,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topology,
+		},
+	}, nil
 }
 
-func (c controllerServer) DeleteVolume(context.Context, *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	panic("implement me")
+// checkFreeSpace rejects a volume of capacity bytes if the account can't
+// hold it.
+func checkFreeSpace(ctx context.Context, client *apiClient, capacity int64) error {
+	usage, err := client.getSpaceUsage(ctx)
+	if err != nil {
+		return apiStatusError(err, "Can't get Dropbox space usage")
+	}
+	if usage.Allocation.Allocated > 0 && uint64(capacity) > usage.available() {
+		return status.Errorf(codes.ResourceExhausted, "Requested %d bytes but the Dropbox account has %d bytes free", capacity, usage.available())
+	}
+	return nil
+}
+
+// cloneVolume copies the folder of sourceVolumeID to volumePath in team on
+// the server. An existing folder at volumePath is taken as cloned by an
+// earlier attempt.
+func cloneVolume(ctx context.Context, client *apiClient, team teamSpace, sourceVolumeID, volumePath string) error {
+	sourcePath, sourceTeam := splitID(sourceVolumeID)
+	if sourceTeam != team {
+		return status.Errorf(codes.InvalidArgument, "Source volume %s is in another team space", sourceVolumeID)
+	}
+	if err := client.copyFolder(ctx, "/"+sourcePath, "/"+volumePath); err != nil {
+		if isAPINotFound(err) {
+			return status.Errorf(codes.NotFound, "Source volume %s not found", sourceVolumeID)
+		}
+		if !isAPIFolderConflict(err) {
+			return apiStatusError(err, "Can't clone volume %s to %s", sourceVolumeID, volumePath)
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot copies the folder of snapshotID to volumePath in team. An
+// existing folder at volumePath is taken as restored by an earlier attempt.
+func restoreSnapshot(ctx context.Context, client *apiClient, team teamSpace, snapshotID, volumePath string) error {
+	snapshotPath, snapshotTeam := splitID(snapshotID)
+	if !isSnapshotID(snapshotPath) {
+		return status.Errorf(codes.NotFound, "Snapshot %s not found", snapshotID)
+	}
+	if snapshotTeam != team {
+		return status.Errorf(codes.InvalidArgument, "Snapshot %s is in another team space", snapshotID)
+	}
+	info, err := getSnapshotInfo(ctx, client, snapshotPath)
+	if err != nil {
+		return apiStatusError(err, "Can't get snapshot %s", snapshotID)
+	}
+	if info == nil {
+		return status.Errorf(codes.NotFound, "Snapshot %s not found", snapshotID)
+	}
+
+	if err := client.copyFolder(ctx, "/"+snapshotPath, "/"+volumePath); err != nil && !isAPIFolderConflict(err) {
+		return apiStatusError(err, "Can't restore snapshot %s to %s", snapshotID, volumePath)
+	}
+	return nil
+}
+
+// DeleteVolume deletes, retains or archives the folder of the volume in
+// Dropbox as set by the onDelete attribute of its persistent volume. Without
+// it, the folder is deleted if DeleteProvisionedFolders is set, otherwise
+// retained.
+func (c controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	policy, err := c.onDeletePolicy(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if policy == onDeleteRetain {
+		glog.V(4).Infof("dropbox-csi: folder %s of deleted volume is retained", req.GetVolumeId())
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	volumePath, team := splitID(req.GetVolumeId())
+	client, err := teamAPIClient(ctx, c.cfg, token, team.or(teamSpaceFrom(req.GetSecrets())))
+	if err != nil {
+		return nil, err
+	}
+	if policy == onDeleteArchive {
+		archivePath := path.Join(strings.Trim(c.cfg.ArchiveDir, "/"), volumePath)
+		// A missing folder was archived by an earlier attempt
+		if err := client.moveFolder(ctx, "/"+volumePath, "/"+archivePath); err != nil && !isAPINotFound(err) {
+			return nil, apiStatusError(err, "Can't archive folder %s to %s", volumePath, archivePath)
+		}
+		glog.V(4).Infof("dropbox-csi: folder %s is archived to %s", volumePath, archivePath)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err := client.deleteFolder(ctx, "/"+volumePath); err != nil {
+		return nil, apiStatusError(err, "Can't delete folder %s", volumePath)
+	}
+	glog.V(4).Infof("dropbox-csi: folder %s is deleted", volumePath)
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// onDeletePolicy returns the onDelete attribute of the persistent volume
+// with volumeID, which DeleteVolumeRequest doesn't carry.
+func (c controllerServer) onDeletePolicy(ctx context.Context, volumeID string) (string, error) {
+	if c.kube != nil {
+		attrs, err := volumeAttributes(ctx, c.kube, c.cfg.DriverName, volumeID)
+		if err != nil {
+			return "", status.Errorf(codes.Unavailable, "Can't get the persistent volume of %s: %v", volumeID, err)
+		}
+		if p, ok := attrs["onDelete"]; ok {
+			return p, nil
+		}
+	}
+	if c.cfg.DeleteProvisionedFolders {
+		return onDeleteDelete, nil
+	}
+	return onDeleteRetain, nil
 }
 
 func (c controllerServer) ControllerPublishVolume(context.Context, *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
@@ -56,30 +346,256 @@ func (c controllerServer) ControllerUnpublishVolume(context.Context, *csi.Contro
 	panic("implement me")
 }
 
-func (c controllerServer) ValidateVolumeCapabilities(context.Context, *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	panic("implement me")
+// ValidateVolumeCapabilities confirms the capabilities if they are all
+// supported. The folder of the volume is checked if the request has secrets.
+func (c controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+
+	if len(req.GetSecrets()) > 0 {
+		token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		volumePath, team := splitID(req.GetVolumeId())
+		client, err := teamAPIClient(ctx, c.cfg, token, team.or(teamSpaceFrom(req.GetVolumeContext(), req.GetSecrets())))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.getMetadata(ctx, "/"+volumePath); err != nil {
+			if isAPINotFound(err) {
+				return nil, status.Errorf(codes.NotFound, "Volume %s not found", req.GetVolumeId())
+			}
+			return nil, apiStatusError(err, "Can't get folder %s", req.GetVolumeId())
+		}
+	}
+
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
-func (c controllerServer) ListVolumes(context.Context, *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	panic("implement me")
+// ListVolumes lists the folders in the default parent folder of the account
+// of TokenFile, as the request carries no secrets. Volumes provisioned with
+// another parentPath are not listed. starting_token is the index of the first
+// entry.
+func (c controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if c.cfg.TokenFile == "" {
+		return nil, status.Error(codes.FailedPrecondition, "No token file configured to list volumes with")
+	}
+	token, err := c.tokenFromSecretsOrFile(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := newAPIClient(c.cfg, token).listFolder(ctx, "/"+defaultParentPath)
+	if err != nil && !isAPINotFound(err) {
+		return nil, apiStatusError(err, "Can't list folder %s", defaultParentPath)
+	}
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, f := range folders {
+		if f.Tag != "folder" {
+			continue
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      path.Join(defaultParentPath, f.Name),
+				VolumeContext: map[string]string{"path": path.Join(defaultParentPath, f.Name)},
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: folderCondition(nil),
+			},
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Volume.VolumeId < entries[j].Volume.VolumeId })
+
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
 }
 
-func (c controllerServer) GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	panic("implement me")
+// paginate returns the range of count entries for a list request, and the
+// token of the next page. A token is the index of the first entry of a page.
+func paginate(count int, startingToken string, maxEntries int32) (int, int, string, error) {
+	start := 0
+	if startingToken != "" {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > count {
+			return 0, 0, "", status.Errorf(codes.Aborted, "Invalid starting token %q", startingToken)
+		}
+	}
+	end := count
+	nextToken := ""
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
 }
 
-func (c controllerServer) CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	panic("implement me")
+// GetCapacity returns the free space of the Dropbox account of TokenFile, as
+// the request carries no secrets.
+func (c controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if c.cfg.TokenFile == "" {
+		return nil, status.Error(codes.FailedPrecondition, "No token file configured to get the capacity with")
+	}
+	token, err := c.tokenFromSecretsOrFile(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := newAPIClient(c.cfg, token).getSpaceUsage(ctx)
+	if err != nil {
+		return nil, apiStatusError(err, "Can't get Dropbox space usage")
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: int64(usage.available()),
+	}, nil
 }
 
-func (c controllerServer) DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	panic("implement me")
+// ControllerExpandVolume resizes a volume logically, as a Dropbox folder has
+// no size. The node updates the capacity it reports afterwards.
+func (c controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if capacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Required bytes missing in request")
+	}
+	token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	_, team := splitID(req.GetVolumeId())
+	client, err := teamAPIClient(ctx, c.cfg, token, team.or(teamSpaceFrom(req.GetSecrets())))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFreeSpace(ctx, client, capacity); err != nil {
+		return nil, err
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacity,
+		NodeExpansionRequired: true,
+	}, nil
 }
 
-func (c controllerServer) ListSnapshots(context.Context, *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	panic("implement me")
+// ControllerGetVolume checks the folder of a volume in the account of
+// TokenFile, in the team space kept in the volume ID. A folder deleted in Dropbox is reported as an abnormal volume
+// condition.
+func (c controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if c.cfg.TokenFile == "" {
+		return nil, status.Error(codes.FailedPrecondition, "No token file configured to get volumes with")
+	}
+	token, err := c.tokenFromSecretsOrFile(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	volumePath, team := splitID(req.GetVolumeId())
+	client, err := teamAPIClient(ctx, c.cfg, token, team)
+	if err != nil {
+		return nil, err
+	}
+	m, err := client.getMetadata(ctx, "/"+volumePath)
+	if err != nil && !isAPINotFound(err) {
+		return nil, apiStatusError(err, "Can't get folder %s", volumePath)
+	}
+	if err == nil && m.Tag != "folder" {
+		err = fmt.Errorf("%s is a %s", volumePath, m.Tag)
+	}
+
+	volCtx := map[string]string{"path": volumePath}
+	team.setVolumeContext(volCtx)
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      req.GetVolumeId(),
+			VolumeContext: volCtx,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: folderCondition(err),
+		},
+	}, nil
 }
 
-func (c controllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	panic("implement me")
+// folderCondition returns the condition of a volume whose folder was looked
+// up with err.
+func folderCondition(err error) *csi.VolumeCondition {
+	if isAPINotFound(err) {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "Folder of the volume is deleted in Dropbox",
+		}
+	}
+	if err != nil {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  err.Error(),
+		}
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "Folder exists in Dropbox",
+	}
+}
+
+// accessTokenFromSecrets returns an access token for the credentials in
+// secrets as a gRPC error.
+func accessTokenFromSecrets(ctx context.Context, secrets map[string]string) (string, error) {
+	creds, err := credentialsFromSecrets(secrets)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	token, _, err := creds.accessToken(ctx)
+	if err != nil {
+		return "", accessTokenError(err)
+	}
+	return token, nil
+}
+
+// teamAPIClient returns an API client for token acting in team.
+func teamAPIClient(ctx context.Context, cfg *Config, token string, team teamSpace) (*apiClient, error) {
+	client, err := newAPIClient(cfg, token).inTeamSpace(ctx, team)
+	if err != nil {
+		return nil, apiStatusError(err, "Can't select team member %s", team.teamMember)
+	}
+	return client, nil
+}
+
+// tokenFromSecretsOrFile returns an access token for the credentials in
+// secrets, or the token in TokenFile if secrets is empty.
+func (c controllerServer) tokenFromSecretsOrFile(ctx context.Context, secrets map[string]string) (string, error) {
+	if len(secrets) > 0 || c.cfg.TokenFile == "" {
+		return accessTokenFromSecrets(ctx, secrets)
+	}
+	token, err := ioutil.ReadFile(c.cfg.TokenFile)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Can't read token file: %v", err)
+	}
+	return strings.TrimSpace(string(token)), nil
 }
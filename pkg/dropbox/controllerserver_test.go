@@ -0,0 +1,74 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCreateVolumeOverExistingPath(t *testing.T) {
+	c := NewControllerServer(useTestDropbox(&Config{}))
+	parent := testFolder(t)
+	if err := ioutil.WriteFile(path.Join(testDropboxDir, parent, "file"), []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	createReq := func(name string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters:         map[string]string{"parentPath": parent},
+			Secrets:            tokenSecrets(),
+		}
+	}
+
+	// A folder left by an earlier attempt is the volume
+	for i := 0; i < 2; i++ {
+		if _, err := c.CreateVolume(context.Background(), createReq("folder")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file isn't
+	_, err := c.CreateVolume(context.Background(), createReq("file"))
+	expectCode(t, err, codes.AlreadyExists)
+}
+
+func TestTeamVolumeID(t *testing.T) {
+	c := NewControllerServer(useTestDropbox(&Config{DeleteProvisionedFolders: true}))
+	parent := testFolder(t)
+	resp, err := c.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "team",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"parentPath": parent, namespaceIDKey: "123", teamMemberIDKey: "dbmid:abc"},
+		Secrets:            tokenSecrets(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DeleteVolume has no volume context, the team space is in the ID
+	volumeID := resp.GetVolume().GetVolumeId()
+	volumePath, team := splitID(volumeID)
+	if volumePath != path.Join(parent, "team") || team != (teamSpace{namespaceID: "123", teamMember: "dbmid:abc"}) {
+		t.Fatalf("Volume ID %q has path %q and team space %+v", volumeID, volumePath, team)
+	}
+	if _, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: tokenSecrets()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(testDropboxDir, volumePath)); !os.IsNotExist(err) {
+		t.Errorf("Folder of volume %s isn't deleted: %v", volumeID, err)
+	}
+
+	// Volumes of the own space keep their path as ID
+	if id := (teamSpace{}).id("csi-volumes/pvc-1"); id != "csi-volumes/pvc-1" {
+		t.Errorf("Expected volume ID csi-volumes/pvc-1, got %q", id)
+	}
+	if p, team := splitID("csi-volumes/pvc-1"); p != "csi-volumes/pvc-1" || team != (teamSpace{}) {
+		t.Errorf("Volume ID csi-volumes/pvc-1 has path %q and team space %+v", p, team)
+	}
+}
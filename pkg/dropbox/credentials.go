@@ -0,0 +1,81 @@
+package dropbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// tokenUsage tracks which volumes on the node use the same token, so that
+// operators can spot accounts likely to hit the Dropbox rate limits.
+type tokenUsage struct {
+	mu        sync.Mutex
+	threshold int
+	volumes   map[string]map[string]bool
+}
+
+func newTokenUsage(threshold int) *tokenUsage {
+	return &tokenUsage{
+		threshold: threshold,
+		volumes:   map[string]map[string]bool{},
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// add records that volumeID uses token. It returns true if the number of
+// volumes sharing the token exceeds the threshold.
+func (t *tokenUsage) add(volumeID, token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Never log the token itself
+	hash := hashToken(token)
+	for h := range t.volumes {
+		if h != hash {
+			t.removeLocked(h, volumeID)
+		}
+	}
+	if t.volumes[hash] == nil {
+		t.volumes[hash] = map[string]bool{}
+	}
+	t.volumes[hash][volumeID] = true
+
+	count := len(t.volumes[hash])
+	tokenVolumes.WithLabelValues(hash[:8]).Set(float64(count))
+	if t.threshold > 0 && count > t.threshold {
+		glog.Warningf("Token %s is shared by %d volumes on this node (threshold %d), the account may be rate limited", hash[:8], count, t.threshold)
+		return true
+	}
+	return false
+}
+
+func (t *tokenUsage) remove(volumeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for hash := range t.volumes {
+		t.removeLocked(hash, volumeID)
+	}
+}
+
+// removeLocked drops volumeID from the volumes of hash, and hash once no
+// volume uses it.
+func (t *tokenUsage) removeLocked(hash, volumeID string) {
+	vols := t.volumes[hash]
+	if !vols[volumeID] {
+		return
+	}
+	delete(vols, volumeID)
+	if len(vols) == 0 {
+		delete(t.volumes, hash)
+		tokenVolumes.DeleteLabelValues(hash[:8])
+		return
+	}
+	tokenVolumes.WithLabelValues(hash[:8]).Set(float64(len(vols)))
+}
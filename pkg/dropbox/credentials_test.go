@@ -0,0 +1,59 @@
+package dropbox
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenUsage(t *testing.T) {
+	usage := newTokenUsage(2)
+	shared, other := hashToken("shared")[:8], hashToken("other")[:8]
+
+	for i, volumeID := range []string{"a", "b", "c"} {
+		if over := usage.add(volumeID, "shared"); over != (i == 2) {
+			t.Errorf("Volume %d of the token: expected over threshold %t, got %t", i+1, i == 2, over)
+		}
+	}
+	if n := testutil.ToFloat64(tokenVolumes.WithLabelValues(shared)); n != 3 {
+		t.Errorf("Expected 3 volumes of the token, got %v", n)
+	}
+	// Adding a volume again doesn't count it twice
+	if usage.add("c", "shared") != true || testutil.ToFloat64(tokenVolumes.WithLabelValues(shared)) != 3 {
+		t.Error("Volume is counted twice")
+	}
+
+	// A rotated volume moves to its new token
+	if usage.add("c", "other") {
+		t.Error("Single volume of a token is over the threshold")
+	}
+	if n := testutil.ToFloat64(tokenVolumes.WithLabelValues(shared)); n != 2 {
+		t.Errorf("Expected 2 volumes of the former token, got %v", n)
+	}
+	if n := testutil.ToFloat64(tokenVolumes.WithLabelValues(other)); n != 1 {
+		t.Errorf("Expected 1 volume of the new token, got %v", n)
+	}
+
+	usage.remove("a")
+	usage.remove("b")
+	usage.add("c", "shared")
+	if len(usage.volumes) != 1 {
+		t.Errorf("Tokens without volumes are kept: %v", usage.volumes)
+	}
+	if tokenVolumes.DeleteLabelValues(other) {
+		t.Error("Token without volumes is still reported")
+	}
+	usage.remove("c")
+	if len(usage.volumes) != 0 || tokenVolumes.DeleteLabelValues(shared) {
+		t.Errorf("Tokens without volumes are kept: %v", usage.volumes)
+	}
+}
+
+func TestTokenUsageWithoutThreshold(t *testing.T) {
+	usage := newTokenUsage(0)
+	for _, volumeID := range []string{"a", "b", "c"} {
+		if usage.add(volumeID, "shared") {
+			t.Errorf("Volume %s is over a disabled threshold", volumeID)
+		}
+	}
+}
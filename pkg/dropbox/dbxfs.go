@@ -0,0 +1,141 @@
+package dropbox
+
+import (
+	"path"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// dbxfsBackend mounts Dropbox with dbxfs.
+type dbxfsBackend struct {
+	cmd *fuseCommand
+}
+
+func newDbxfsBackend(cfg *Config, runner commandRunner, mounter mount.Interface) *dbxfsBackend {
+	return &dbxfsBackend{
+		cmd: &fuseCommand{
+			name:           "dbxfs",
+			path:           cfg.DbxfsPath,
+			extraArgs:      cfg.DbxfsExtraArgs,
+			runner:         runner,
+			mounter:        mounter,
+			cfg:            cfg,
+			foreground:     cfg.DbxfsForeground,
+			foregroundArgs: []string{"-f"},
+			authErrors: []string{
+				"AuthError",
+				"invalid_access_token",
+				"expired_access_token",
+				"missing_scope",
+				"401 Client Error",
+				"Unauthorized",
+			},
+			transientErrors: []string{
+				"ConnectionError",
+				"Connection reset",
+				"Connection refused",
+				"Temporary failure in name resolution",
+				"timed out",
+				"Timeout",
+				"InternalServerError",
+			},
+			rateLimitErrors: []string{
+				"RateLimitError",
+			},
+			unsupportedOptionErrors: []string{
+				"unrecognized arguments",
+				"unknown option",
+				"invalid option",
+			},
+		},
+	}
+}
+
+func (b *dbxfsBackend) Name() string {
+	return backendDbxfs
+}
+
+func (b *dbxfsBackend) Command() string {
+	return b.cmd.command()
+}
+
+func (b *dbxfsBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	configPath := dbxfsConfigPath(req.ConfigDir)
+	if err := writeDbxfsConfig(configPath, tokenPath(req.ConfigDir), req.Token); err != nil {
+		return 0, err
+	}
+
+	return b.cmd.mount(ctx, req, func(readonly bool) []string {
+		args := []string{req.MountPath, "-c", configPath}
+		var opts []string
+		if readonly {
+			opts = append(opts, "ro")
+		}
+		if req.Owner.UID != "" {
+			opts = append(opts, "uid="+req.Owner.UID)
+		}
+		if req.Owner.GID != "" {
+			opts = append(opts, "gid="+req.Owner.GID)
+		}
+		if req.Owner.AllowOther {
+			opts = append(opts, "allow_other")
+		}
+		if req.Owner.DefaultPermissions {
+			opts = append(opts, "default_permissions")
+		}
+		if req.Owner.Umask != "" {
+			opts = append(opts, "umask="+req.Owner.Umask)
+		}
+		if req.Owner.SELinuxContext != "" {
+			opts = append(opts, req.Owner.SELinuxContext)
+		}
+		if len(opts) > 0 {
+			args = append(args, "-o", strings.Join(opts, ","))
+		}
+		return args
+	})
+}
+
+func (b *dbxfsBackend) Unmount(mountPath string) error {
+	return unmountIfMounted(b.cmd.mounter, mountPath)
+}
+
+// WriteToken rewrites the token file, which dbxfs reads with its
+// access_token_command.
+func (b *dbxfsBackend) WriteToken(configDir, token string) error {
+	return writeFile(tokenPath(configDir), token)
+}
+
+func (b *dbxfsBackend) RemoveConfig(configDir string) error {
+	return shredFiles(dbxfsConfigPath(configDir), tokenPath(configDir))
+}
+
+func (b *dbxfsBackend) Stats(mountPath string) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(mountPath)
+}
+
+func dbxfsConfigPath(configDir string) string {
+	return path.Join(configDir, "dbxfs_config.json")
+}
+
+// writeDbxfsConfig writes the dbxfs config file which reads the access token
+// from tokenPath, and the token file itself.
+func writeDbxfsConfig(configPath, tokenPath, token string) error {
+	err := writeFile(configPath, "{\"access_token_command\": [\"cat\", \""+tokenPath+"\"], \"send_error_reports\": false, \"asked_send_error_reports\": true}")
+	if err != nil {
+		glog.Errorf("Can't create dbxfs config file: %v", err)
+		return err
+	}
+
+	err = writeFile(tokenPath, token)
+	if err != nil {
+		glog.Errorf("Can't create dbxfs token file: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -2,52 +2,332 @@ package dropbox
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
 )
 
+// Modes of the driver serving only the controller or only the node service
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+)
+
+type Config struct {
+	DriverName string
+	NodeID     string
+	Endpoint   string
+	Version    string
+	// Permissions of a unix socket endpoint, 0 to keep the umask default
+	EndpointMode os.FileMode
+	// Services the driver serves, ModeController, ModeNode or both if empty
+	Mode string
+
+	// File containing a Dropbox access token to check the API with in Probe
+	TokenFile string
+
+	// Maximum number of volumes the scheduler puts on the node, 0 for
+	// unlimited
+	MaxVolumesPerNode int64
+
+	// Value of the account topology key of the node, naming the Dropbox
+	// account whose credentials the node holds. Not reported if empty
+	TopologyAccount string
+
+	// Base URLs of the Dropbox API and content endpoints, the ones of
+	// Dropbox if empty. Set to test against a fake Dropbox
+	DropboxAPIURL     string
+	DropboxContentURL string
+
+	// Default mount backend, dbxfs, rclone or native. A volume can choose
+	// another one with the backend volume attribute
+	Backend string
+
+	// Directory for the driver state and ephemeral volumes
+	RootDir string
+	// Directory for the config and token of staged volumes, should be a tmpfs
+	CredentialsDir string
+	// Keep the caches of volumes in RootDir when they are unstaged, so that
+	// they are warm when staged again
+	RetainCache bool
+	// Path of the dbxfs executable, dbxfs is looked up on PATH if empty
+	DbxfsPath string
+	// Added to the arguments of every dbxfs mount
+	DbxfsExtraArgs []string
+
+	// FUSE options of the volumes which don't set them: let other users than
+	// the driver access the mounts, let the kernel check the permissions of
+	// the files, and mask their permissions with Umask if not empty
+	AllowOther         bool
+	DefaultPermissions bool
+	Umask              string
+
+	// Maximum duration of a mount including retries, 0 for unlimited
+	MountTimeout time.Duration
+	// Number of retries for transient mount failures
+	MountRetries int
+	// Initial interval between mount retries, doubled on every retry
+	MountRetryInterval time.Duration
+	// Number of restarts of a crashing mount process before giving up
+	MountRestarts int
+
+	// Maximum number of concurrent mount and unmount operations, 0 for unlimited
+	MaxConcurrentMounts   int
+	MaxConcurrentUnmounts int
+
+	// Warn when more volumes than this share the same token, 0 to disable
+	TokenShareWarnThreshold int
+
+	// Address to expose prometheus metrics on, empty to disable
+	MetricsAddress string
+	// Address of the proxy the mount processes reach Dropbox through, to
+	// account their traffic to the volumes, empty to disable
+	APIUsageProxyAddress string
+
+	// Maximum bytes of mount command stdout and stderr kept for logs and errors, 0 for unlimited
+	MaxCommandOutput int
+
+	// Run dbxfs in foreground as a child of the driver instead of letting it daemonize
+	DbxfsForeground bool
+
+	// Interval to check the Dropbox space usage of staged volumes, 0 to disable
+	UsageCheckInterval time.Duration
+	// Used fraction of the account space to warn at, 0 to disable
+	QuotaWarningThreshold float64
+
+	// Interval to collect the stats of staged volumes served by
+	// NodeGetVolumeStats, 0 to collect them on every request
+	StatsInterval time.Duration
+
+	// Interval to sync the local copies of mirrored volumes with Dropbox, 0
+	// to only sync them when they are mounted and unmounted
+	MirrorSyncInterval time.Duration
+
+	// Mount the volumes of the same credentials and mount options once, and
+	// bind mount it to their staging paths
+	ShareMounts bool
+
+	// Interval to check the mounts of staged volumes and remount dead ones, 0 to disable
+	HealthCheckInterval time.Duration
+	// Time the mounts of staged volumes are given to respond to statfs in
+	// Probe, 0 to not check them
+	LivenessMountTimeout time.Duration
+	// Fail Probe too while the Dropbox API doesn't answer with the token in
+	// TokenFile, not only the readiness of the driver
+	ProbeDropboxAPI bool
+
+	// Delete the Dropbox folder of a provisioned volume when it is deleted
+	DeleteProvisionedFolders bool
+	// Folder in Dropbox that volumes with the archive onDelete policy are
+	// moved to
+	ArchiveDir string
+	// Interval to look for provisioned folders without a persistent volume,
+	// 0 to disable
+	ReconcileInterval time.Duration
+	// What is done with such folders: report, archive or delete
+	OrphanedFolders string
+
+	// Elect one of several controller replicas with a lease to run the
+	// background work of the controller
+	LeaderElection bool
+	// Namespace of the lease, the one of the driver pod if empty
+	LeaderElectionNamespace string
+
+	// Post Kubernetes events on the claims of volumes failing to mount
+	Events bool
+
+	// Resync interval of the watch on the secrets of staged volumes for new
+	// credentials, 0 to disable
+	SecretWatchInterval time.Duration
+
+	// Time given to in-flight RPCs to finish on shutdown
+	ShutdownTimeout time.Duration
+	// Unmount ephemeral inline volumes on shutdown, so that their writes are
+	// flushed to Dropbox
+	UnmountEphemeralOnShutdown bool
+}
+
 type dropbox struct {
-	name     string
-	nodeID   string
-	version  string
-	endpoint string
+	cfg *Config
 
 	ids *identityServer
 	ns  *nodeServer
 	cs  *controllerServer
+
+	ready *readiness
 }
 
-func NewDropboxDriver(driverName, nodeID, endpoint, version string) (*dropbox, error) {
-	if driverName == "" {
+func NewDropboxDriver(cfg *Config) (*dropbox, error) {
+	if cfg.DriverName == "" {
 		return nil, fmt.Errorf("No driver name provided")
 	}
 
-	if nodeID == "" {
+	if cfg.NodeID == "" {
 		return nil, fmt.Errorf("No node id provided")
 	}
 
-	if endpoint == "" {
+	if cfg.Endpoint == "" {
 		return nil, fmt.Errorf("No driver endpoint provided")
 	}
 
-	glog.Infof("Driver: %v ", driverName)
-	glog.Infof("Version: %s", version)
+	switch cfg.Mode {
+	case "", ModeController, ModeNode:
+	default:
+		return nil, fmt.Errorf("Unknown mode %q, must be controller or node", cfg.Mode)
+	}
+
+	switch cfg.Backend {
+	case "", backendDbxfs, backendRclone, backendNative:
+	default:
+		return nil, fmt.Errorf("Unknown backend %q", cfg.Backend)
+	}
+
+	if cfg.MountRetries < 0 {
+		return nil, fmt.Errorf("Mount retries must not be negative")
+	}
+
+	if cfg.MaxVolumesPerNode < 0 {
+		return nil, fmt.Errorf("Max volumes per node must not be negative")
+	}
+
+	if cfg.MountRestarts < 0 {
+		return nil, fmt.Errorf("Mount restarts must not be negative")
+	}
+
+	if err := validateUmask(cfg.Umask); err != nil {
+		return nil, err
+	}
+
+	switch cfg.OrphanedFolders {
+	case "", orphanedFoldersReport, orphanedFoldersArchive, orphanedFoldersDelete:
+	default:
+		return nil, fmt.Errorf("Unknown orphaned folders action %q, must be report, archive or delete", cfg.OrphanedFolders)
+	}
+
+	glog.Infof("Driver: %v ", cfg.DriverName)
+	glog.Infof("Version: %s", cfg.Version)
 
 	return &dropbox{
-		name:     driverName,
-		version:  version,
-		nodeID:   nodeID,
-		endpoint: endpoint,
+		cfg:   cfg,
+		ready: newReadiness(),
 	}, nil
 }
 
 func (d *dropbox) Run() {
-	// Create GRPC servers
-	d.ids = NewIdentityServer(d.name, d.version)
-	d.ns = NewNodeServer(d.nodeID)
-	d.cs = NewControllerServer(d.nodeID)
+	if d.cfg.MetricsAddress != "" {
+		go serveMetrics(d.cfg.MetricsAddress, d.ready)
+	}
+	// Before any mount, the mount processes can't reach Dropbox without it
+	if d.cfg.APIUsageProxyAddress != "" {
+		if err := startUsageProxy(d.cfg.APIUsageProxyAddress); err != nil {
+			glog.Fatalf("Can't start usage proxy: %v", err)
+		}
+	}
+
+	// Create GRPC servers. The controller doesn't mount, so it runs without
+	// the node service, its checks and its loops
+	if d.cfg.Mode != ModeController {
+		d.ns = NewNodeServer(d.cfg)
+	}
+	d.ids = NewIdentityServer(d.cfg.DriverName, d.cfg.Version, d.ns)
+	if d.cfg.Mode != ModeNode {
+		d.cs = NewControllerServer(d.cfg)
+	}
+
+	if d.ns != nil {
+		// Before serving, so that no volume is staged while looking for
+		// orphans
+		d.ns.reconcileVolumes()
+		d.ns.cleanupOrphans()
+
+		// Reports missing prerequisites before the first NodeStageVolume
+		// runs into them
+		go d.ns.runPreflight(d.ready)
+		go d.ns.checkUsage()
+		go d.ns.collectStats()
+		go d.ns.monitorMounts()
+		go d.ns.watchSecrets()
+	}
+	if d.cs != nil {
+		if d.cs.leader != nil {
+			go d.cs.leader.run()
+		}
+		go d.cs.reconcileFolders()
+	}
 
-	s := NewNonBlockingGRPCServer()
-	s.Start(d.endpoint, d.ids, d.cs, d.ns)
+	s := NewNonBlockingGRPCServer(d.ready, d.cfg.EndpointMode)
+	s.Start(d.cfg.Endpoint, d.ids, d.controllerService(), d.nodeService())
+	go d.waitForShutdown(s)
 	s.Wait()
 }
+
+func (d *dropbox) waitForShutdown(s *nonBlockingGRPCServer) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+
+	glog.Infof("Received %v, shutting down", sig)
+	d.shutdown(s)
+}
+
+// shutdown stops serving s once its in-flight RPCs are done, and stops the
+// work of the driver.
+func (d *dropbox) shutdown(s *nonBlockingGRPCServer) {
+	d.ready.set(false)
+
+	// In-flight RPCs are given ShutdownTimeout to finish, then the stages
+	// still running are canceled
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(d.cfg.ShutdownTimeout):
+		glog.Warningf("RPCs are still running after %v, canceling them", d.cfg.ShutdownTimeout)
+		if d.ns != nil {
+			d.ns.Shutdown()
+		}
+		s.ForceStop()
+		<-stopped
+	}
+
+	if d.cs != nil && d.cs.leader != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), leaseRetryPeriod)
+		d.cs.leader.release(ctx)
+		cancel()
+	}
+	if d.ns == nil {
+		glog.Infof("Shutdown complete")
+		return
+	}
+	d.ns.Shutdown()
+	if d.cfg.UnmountEphemeralOnShutdown {
+		d.ns.unmountEphemeralVolumes()
+	}
+	glog.Infof("Shutdown complete, the state of %d staged volumes is kept in %s", d.ns.stagedCount(), stateDir(d.ns.rootDir))
+}
+
+// controllerService returns the controller server, or nil in node mode, so
+// that it isn't registered.
+func (d *dropbox) controllerService() csi.ControllerServer {
+	if d.cs == nil {
+		return nil
+	}
+	return d.cs
+}
+
+// nodeService returns the node server, or nil in controller mode, so that it
+// isn't registered.
+func (d *dropbox) nodeService() csi.NodeServer {
+	if d.ns == nil {
+		return nil
+	}
+	return d.ns
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package dropbox
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDriverRejectsUnknownMode(t *testing.T) {
+	_, err := NewDropboxDriver(&Config{DriverName: "dropbox.csi.k8s.io", NodeID: "test", Endpoint: "unix:///tmp/csi.sock", Mode: "both"})
+	if err == nil {
+		t.Fatal("Driver accepted an unknown mode")
+	}
+}
+
+func TestControllerModeServesNoNode(t *testing.T) {
+	// Probe must not run the node checks, which aren't stubbed here
+	d := newTestDriver(t, &Config{Mode: ModeController})
+	_, endpoint := serveTestDriver(t, d)
+	conn := dialTestDriver(t, endpoint)
+
+	if _, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe failed in controller mode: %v", err)
+	}
+	_, err := csi.NewNodeClient(conn).NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	expectCode(t, err, codes.Unimplemented)
+	if _, err := csi.NewControllerClient(conn).ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{}); err != nil {
+		t.Errorf("Controller isn't served in controller mode: %v", err)
+	}
+}
+
+func TestNodeModeServesNoController(t *testing.T) {
+	d := newTestDriver(t, &Config{Mode: ModeNode})
+	_, endpoint := serveTestDriver(t, d)
+
+	_, err := csi.NewControllerClient(dialTestDriver(t, endpoint)).ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	expectCode(t, err, codes.Unimplemented)
+}
@@ -0,0 +1,115 @@
+package dropbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Volume context key of volumes encrypted on the node
+const encryptionKey = "encryption"
+
+// Keys of the nodeStageSecretRef secret holding the password of an encrypted
+// volume, and optionally a salt
+const (
+	secretEncryptionPassword = "encryptionPassword"
+	secretEncryptionSalt     = "encryptionSalt"
+)
+
+// Name of the rclone crypt remote wrapping the Dropbox remote
+const rcloneCryptRemote = "crypt"
+
+// Key rclone obscures the passwords in its config with, which only keeps
+// them from being read at a glance
+var rcloneObscureKey = []byte{
+	0x9c, 0x93, 0x5b, 0x48, 0x73, 0x0a, 0x55, 0x4d,
+	0x6b, 0xfd, 0x7c, 0x63, 0xc8, 0x86, 0xa9, 0x2b,
+	0xd3, 0x90, 0x19, 0x8e, 0xb8, 0x12, 0x8a, 0xfb,
+	0xf4, 0xde, 0x16, 0x2b, 0x8b, 0x95, 0xf6, 0x38,
+}
+
+type encryptionKeys struct {
+	password string
+	salt     string
+}
+
+// isEncrypted tells whether the volume of volCtx is encrypted.
+func isEncrypted(volCtx map[string]string) (bool, error) {
+	v, ok := volCtx[encryptionKey]
+	if !ok {
+		return false, nil
+	}
+	encrypted, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %q", encryptionKey, v)
+	}
+	return encrypted, nil
+}
+
+func encryptionKeysFromSecrets(secrets map[string]string) (*encryptionKeys, error) {
+	keys := &encryptionKeys{
+		password: secrets[secretEncryptionPassword],
+		salt:     secrets[secretEncryptionSalt],
+	}
+	if keys.password == "" {
+		return nil, fmt.Errorf("%s is required in the secret of an encrypted volume", secretEncryptionPassword)
+	}
+	return keys, nil
+}
+
+// writeRcloneCryptConfig writes the crypt remote of keys to configDir, which
+// WriteToken adds to the rclone config. File names are left as they are,
+// so that the folders of volumes are found by their path.
+func writeRcloneCryptConfig(configDir string, keys *encryptionKeys) error {
+	password, err := rcloneObscure(keys.password)
+	if err != nil {
+		return err
+	}
+	config := fmt.Sprintf("[%s]\ntype = crypt\nremote = %s:\nfilename_encryption = off\ndirectory_name_encryption = false\npassword = %s\n", rcloneCryptRemote, rcloneRemote, password)
+	if keys.salt != "" {
+		salt, err := rcloneObscure(keys.salt)
+		if err != nil {
+			return err
+		}
+		config += fmt.Sprintf("password2 = %s\n", salt)
+	}
+	return writeFile(rcloneCryptConfigPath(configDir), config)
+}
+
+// readRcloneCryptConfig returns the crypt remote written to configDir, or
+// an empty string if the volume isn't encrypted.
+func readRcloneCryptConfig(configDir string) (string, error) {
+	b, err := ioutil.ReadFile(rcloneCryptConfigPath(configDir))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+func rcloneCryptConfigPath(configDir string) string {
+	return path.Join(configDir, "rclone-crypt.conf")
+}
+
+// rcloneObscure obscures a password for the rclone config like rclone
+// obscure.
+func rcloneObscure(s string) (string, error) {
+	plaintext := []byte(s)
+	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	iv := ciphertext[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(rcloneObscureKey)
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
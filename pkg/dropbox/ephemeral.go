@@ -0,0 +1,88 @@
+package dropbox
+
+import (
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Volume context key set by kubelet for ephemeral inline volumes
+const ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+func isEphemeralVolume(volCtx map[string]string) bool {
+	return volCtx[ephemeralContextKey] == "true"
+}
+
+// ephemeralStagingPath is where an ephemeral inline volume is mounted before
+// it is bind mounted to the pod. Its parent keeps the backend config.
+func (n *nodeServer) ephemeralStagingPath(volumeID string) string {
+	return path.Join(n.rootDir, "ephemeral", url.PathEscape(volumeID), "data")
+}
+
+// isStagedAt tells whether volumeID is staged at stagingPath.
+func (n *nodeServer) isStagedAt(volumeID, stagingPath string) bool {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	vol, ok := n.volumes[volumeID]
+	return ok && vol.MountPath == stagingPath
+}
+
+// unmountEphemeralVolumes unmounts every ephemeral inline volume from its
+// pods and unstages it, flushing its writes to Dropbox. The pods lose the
+// volume until they are restarted.
+func (n *nodeServer) unmountEphemeralVolumes() {
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		if vol.MountPath == n.ephemeralStagingPath(vol.VolumeID) {
+			volumes = append(volumes, vol)
+		}
+	}
+	n.volumesMu.Unlock()
+
+	for _, vol := range volumes {
+		// Operations are not canceled here, so the volume lock is free
+		if !n.volumeLocks.tryAcquire(vol.VolumeID) {
+			glog.Warningf("Volume %s is busy, not unmounting it", vol.VolumeID)
+			continue
+		}
+		for _, target := range vol.Targets {
+			if err := unmountIfMounted(n.mounter, target); err != nil {
+				glog.Errorf("Can't unmount %s: %v", target, err)
+				continue
+			}
+			n.removeTarget(vol.VolumeID, target)
+		}
+		if err := n.unstageEphemeralVolume(context.Background(), vol.VolumeID); err != nil {
+			glog.Errorf("Can't unstage ephemeral volume %s: %v", vol.VolumeID, err)
+		} else {
+			glog.Infof("Ephemeral volume %s is unmounted", vol.VolumeID)
+		}
+		n.volumeLocks.release(vol.VolumeID)
+	}
+}
+
+// unstageEphemeralVolume unmounts an ephemeral inline volume staged by
+// NodePublishVolume and removes its directories.
+func (n *nodeServer) unstageEphemeralVolume(ctx context.Context, volumeID string) error {
+	stagingPath := n.ephemeralStagingPath(volumeID)
+	_, err := n.unstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{stagingPath, path.Dir(stagingPath)} {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Can't remove %s: %v", dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package dropbox
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apiStatusError converts an error of the Dropbox API to a gRPC error, so
+// that the sidecars and kubelet retry only what may succeed on retry.
+func apiStatusError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return status.Errorf(apiErrorCode(err), "%s: %v", msg, err)
+}
+
+func apiErrorCode(err error) codes.Code {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case context.Canceled:
+		return codes.Canceled
+	}
+
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		// The request didn't reach Dropbox
+		return codes.Unavailable
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case apiErr.StatusCode == http.StatusForbidden:
+		return codes.PermissionDenied
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case apiErr.StatusCode >= http.StatusInternalServerError:
+		return codes.Unavailable
+	case strings.Contains(apiErr.Summary, "insufficient_space"):
+		return codes.ResourceExhausted
+	case isAPINotFound(err):
+		return codes.NotFound
+	case isAPIConflict(err):
+		return codes.AlreadyExists
+	case strings.Contains(apiErr.Summary, "no_write_permission"):
+		return codes.PermissionDenied
+	}
+	return codes.Internal
+}
+
+// fsStatusError converts an error of a file operation on a mount to a gRPC
+// error.
+func fsStatusError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return status.Errorf(fsErrorCode(err), "%s: %v", msg, err)
+}
+
+func fsErrorCode(err error) codes.Code {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	switch {
+	case os.IsNotExist(err):
+		return codes.NotFound
+	case os.IsPermission(err), err == syscall.EROFS:
+		return codes.PermissionDenied
+	case err == syscall.ENOSPC, err == syscall.EDQUOT:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
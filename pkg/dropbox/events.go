@@ -0,0 +1,138 @@
+package dropbox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events of volumes
+const (
+	eventTokenInvalid  = "DropboxTokenInvalid"
+	eventMountFailed   = "DropboxMountFailed"
+	eventMountCrashing = "DropboxMountCrashing"
+	eventQuotaLow      = "DropboxQuotaLow"
+	eventQuotaExceeded = "DropboxQuotaExceeded"
+
+	eventCapacityExceeded = "DropboxCapacityExceeded"
+	eventConflictedCopy   = "DropboxConflictedCopy"
+)
+
+// The same event of a volume is not repeated within this period
+const eventDedupPeriod = 10 * time.Minute
+
+// eventRecorder posts Kubernetes events on the claims of volumes, so that
+// users see failures in kubectl describe.
+type eventRecorder struct {
+	kube       kubernetes.Interface
+	recorder   record.EventRecorder
+	driverName string
+	nodeID     string
+
+	mu     sync.Mutex
+	recent map[string]time.Time
+}
+
+// newEventRecorder returns nil if Events is not set or the driver doesn't
+// run in a cluster. A nil recorder posts no events.
+func newEventRecorder(cfg *Config) *eventRecorder {
+	if !cfg.Events {
+		return nil
+	}
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		glog.Errorf("Can't post events of volumes: %v", err)
+		return nil
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kube.CoreV1().Events("")})
+	return &eventRecorder{
+		kube:       kube,
+		recorder:   broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: cfg.DriverName, Host: cfg.NodeID}),
+		driverName: cfg.DriverName,
+		nodeID:     cfg.NodeID,
+		recent:     map[string]time.Time{},
+	}
+}
+
+// stageFailed posts a warning event for a failed stage of volumeID.
+func (r *eventRecorder) stageFailed(volumeID string, err error) {
+	if r == nil {
+		return
+	}
+	reason := eventMountFailed
+	message := fmt.Sprintf("Can't mount Dropbox on node %s: %s", r.nodeID, status.Convert(err).Message())
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		reason = eventTokenInvalid
+		message = fmt.Sprintf("Dropbox token invalid: %s", status.Convert(err).Message())
+	case codes.InvalidArgument, codes.Aborted, codes.Unavailable:
+		// Errors of the request or the driver, not of Dropbox
+		return
+	}
+	r.warning(volumeID, reason, message)
+}
+
+// warning posts a warning event on the claim of the persistent volume of
+// volumeID, or on the persistent volume if it's not bound. It doesn't wait
+// for the event to be posted.
+func (r *eventRecorder) warning(volumeID, reason, message string) {
+	if r == nil || !r.shouldPost(volumeID+"/"+reason+"/"+message) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := r.post(ctx, volumeID, reason, message); err != nil {
+			glog.Errorf("Can't post event %s of volume %s: %v", reason, volumeID, err)
+		}
+	}()
+}
+
+func (r *eventRecorder) shouldPost(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range r.recent {
+		if now.Sub(t) > eventDedupPeriod {
+			delete(r.recent, k)
+		}
+	}
+	if _, ok := r.recent[key]; ok {
+		return false
+	}
+	r.recent[key] = now
+	return true
+}
+
+func (r *eventRecorder) post(ctx context.Context, volumeID, reason, message string) error {
+	pv, err := persistentVolume(ctx, r.kube, r.driverName, volumeID)
+	if err != nil {
+		return err
+	}
+	if pv == nil {
+		// Ephemeral volumes have no persistent volume
+		return nil
+	}
+
+	// Events of cluster scoped objects go to the default namespace
+	object := &v1.ObjectReference{Kind: "PersistentVolume", Name: pv.Name, UID: pv.UID}
+	if pv.Spec.ClaimRef != nil {
+		object = pv.Spec.ClaimRef.DeepCopy()
+		object.Kind = "PersistentVolumeClaim"
+	}
+	r.recorder.Event(object, v1.EventTypeWarning, reason, message)
+	return nil
+}
@@ -0,0 +1,78 @@
+package dropbox
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const testDriverName = "dropbox.csi.k8s.io"
+
+func newTestEventRecorder(objects ...*v1.PersistentVolume) (*eventRecorder, *record.FakeRecorder) {
+	kube := fake.NewSimpleClientset()
+	for _, pv := range objects {
+		kube.Tracker().Add(pv)
+	}
+	recorder := record.NewFakeRecorder(10)
+	return &eventRecorder{
+		kube:       kube,
+		recorder:   recorder,
+		driverName: testDriverName,
+		nodeID:     "node",
+		recent:     map[string]time.Time{},
+	}, recorder
+}
+
+func testPersistentVolume(name, volumeID string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: testDriverName, VolumeHandle: volumeID},
+			},
+		},
+	}
+}
+
+func TestEventIsPostedOnClaim(t *testing.T) {
+	pv := testPersistentVolume("pv-1", "csi-volumes/pv-1")
+	pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "ns", Name: "claim"}
+	r, recorder := newTestEventRecorder(pv)
+
+	if err := r.post(context.Background(), "csi-volumes/pv-1", eventMountFailed, "Can't mount"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, recorder, "Warning DropboxMountFailed Can't mount")
+}
+
+func TestEventOfUnknownVolumeIsDropped(t *testing.T) {
+	r, recorder := newTestEventRecorder(testPersistentVolume("pv-1", "csi-volumes/pv-1"))
+
+	if err := r.post(context.Background(), "csi-volumes/pv-2", eventMountFailed, "Can't mount"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("Expected no event, got %q", event)
+	default:
+	}
+}
+
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, prefix string) {
+	t.Helper()
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, prefix) {
+			t.Errorf("Expected event %q, got %q", prefix, event)
+		}
+	default:
+		t.Errorf("Expected event %q, got none", prefix)
+	}
+}
@@ -0,0 +1,161 @@
+package dropbox
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// commandRunner runs external commands with env added to the environment of
+// the driver. Run waits for the command and returns its stdout and stderr,
+// killing it when ctx is done. Start returns as soon as the command is
+// started.
+type commandRunner interface {
+	Run(ctx context.Context, env []string, name string, args ...string) (string, string, error)
+	Start(env []string, name string, args ...string) (process, error)
+}
+
+// process is a started command which is reaped in the background.
+type process interface {
+	Pid() int
+	// Done is closed when the process exits
+	Done() <-chan struct{}
+	// Err is the exit error, valid after Done is closed
+	Err() error
+	Output() (string, string)
+	Kill() error
+}
+
+// execCommandRunner keeps only the last maxOutput bytes of stdout and stderr,
+// or everything if maxOutput is 0.
+type execCommandRunner struct {
+	maxOutput int
+}
+
+func (r execCommandRunner) Run(ctx context.Context, env []string, name string, args ...string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = commandEnv(env)
+	stdout := &tailBuffer{max: r.maxOutput}
+	stderr := &tailBuffer{max: r.maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+func (r execCommandRunner) Start(env []string, name string, args ...string) (process, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = commandEnv(env)
+	p := &execProcess{
+		cmd:    cmd,
+		stdout: &tailBuffer{max: r.maxOutput},
+		stderr: &tailBuffer{max: r.maxOutput},
+		done:   make(chan struct{}),
+	}
+	cmd.Stdout = &lockedWriter{mu: &p.mu, w: p.stdout}
+	cmd.Stderr = &lockedWriter{mu: &p.mu, w: p.stderr}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+// commandEnv returns the environment of the driver with env added, or nil for
+// the environment of the driver as is.
+func commandEnv(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+
+	mu     sync.Mutex
+	stdout *tailBuffer
+	stderr *tailBuffer
+
+	done chan struct{}
+	err  error
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *execProcess) Err() error {
+	return p.err
+}
+
+func (p *execProcess) Output() (string, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stdout.String(), p.stderr.String()
+}
+
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+// lockedWriter serializes writes with reads of a running process output.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
+
+// tailBuffer is a bytes.Buffer which drops the head of the data when it grows
+// over max bytes.
+type tailBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.max <= 0 {
+		return b.buf.Write(p)
+	}
+
+	if len(p) >= b.max {
+		b.buf.Reset()
+		p = p[len(p)-b.max:]
+		b.truncated = true
+	} else if over := b.buf.Len() + len(p) - b.max; over > 0 {
+		b.buf.Next(over)
+		b.truncated = true
+	}
+	b.buf.Write(p)
+
+	return n, nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "...(truncated) " + b.buf.String()
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,65 @@
+package dropbox
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestTailBuffer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		max    int
+		writes []string
+		output string
+	}{
+		{name: "unlimited", max: 0, writes: []string{"abc", "def"}, output: "abcdef"},
+		{name: "under the limit", max: 8, writes: []string{"abc", "def"}, output: "abcdef"},
+		{name: "at the limit", max: 6, writes: []string{"abc", "def"}, output: "abcdef"},
+		{name: "over the limit", max: 4, writes: []string{"abc", "def"}, output: "...(truncated) cdef"},
+		{name: "write over the limit", max: 4, writes: []string{"ab", "cdefgh"}, output: "...(truncated) efgh"},
+		{name: "many writes", max: 3, writes: strings.Split("abcdefghij", ""), output: "...(truncated) hij"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := &tailBuffer{max: test.max}
+			for _, w := range test.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write of %q returned %d, %v", w, n, err)
+				}
+			}
+			if b.String() != test.output {
+				t.Errorf("Expected %q, got %q", test.output, b.String())
+			}
+			if test.max > 0 && b.buf.Len() > test.max {
+				t.Errorf("Buffer keeps %d bytes over its limit of %d", b.buf.Len(), test.max)
+			}
+		})
+	}
+}
+
+func TestCommandOutputIsCapped(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No shell to run a chatty command")
+	}
+	runner := execCommandRunner{maxOutput: 4096}
+
+	// 1MB on both outputs, ending with the relevant lines
+	stdout, stderr, err := runner.Run(context.Background(), nil, "sh", "-c",
+		"i=0; while [ $i -lt 16384 ]; do echo 'chatty dbxfs output line of 64 bytes.........................'; echo 'chatty dbxfs output line of 64 bytes.........................' >&2; i=$((i+1)); done; echo last; echo failed >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, output := range map[string]string{"stdout": stdout, "stderr": stderr} {
+		if len(output) > 4096+len("...(truncated) ") {
+			t.Errorf("%s keeps %d bytes over its limit", name, len(output))
+		}
+		if !strings.HasPrefix(output, "...(truncated) ") {
+			t.Errorf("%s isn't marked as truncated", name)
+		}
+	}
+	if !strings.HasSuffix(stdout, "last\n") || !strings.HasSuffix(stderr, "failed\n") {
+		t.Errorf("Tail of the output is lost: %q, %q", stdout[len(stdout)-10:], stderr[len(stderr)-10:])
+	}
+}
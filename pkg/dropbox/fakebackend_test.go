@@ -0,0 +1,73 @@
+package dropbox
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// Backend bind mounting the directory of the fake Dropbox, for testing the
+// driver without a Dropbox account
+const backendFake = "fake"
+
+func init() {
+	for _, key := range []string{"backend", "path", "createPath", "mountOptions", "capacity", enforceCapacityKey, conflictFilesKey, "sharedLink", "onDelete"} {
+		volumeContextKeys[key] = append(volumeContextKeys[key], backendFake)
+	}
+}
+
+// newTestBackends returns the backends of the driver and the fake backend.
+func newTestBackends(cfg *Config, runner commandRunner, mounter mount.Interface) map[string]Backend {
+	backends := newBackends(cfg, runner, mounter)
+	backends[backendFake] = newFakeBackend(testDropboxDir, mounter)
+	return backends
+}
+
+// fakeBackend bind mounts the directory of the fake Dropbox.
+type fakeBackend struct {
+	dir     string
+	mounter mount.Interface
+}
+
+func newFakeBackend(dir string, mounter mount.Interface) *fakeBackend {
+	return &fakeBackend{
+		dir:     dir,
+		mounter: mounter,
+	}
+}
+
+func (b *fakeBackend) Name() string {
+	return backendFake
+}
+
+// Command is empty, the bind mounts are done by the mounter.
+func (b *fakeBackend) Command() string {
+	return ""
+}
+
+func (b *fakeBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	if err := b.WriteToken(req.ConfigDir, req.Token); err != nil {
+		return 0, err
+	}
+	options := []string{"bind"}
+	if req.ReadOnly {
+		options = append(options, "ro")
+	}
+	return 0, b.mounter.Mount(b.dir, req.MountPath, "", options)
+}
+
+func (b *fakeBackend) Unmount(mountPath string) error {
+	return unmountIfMounted(b.mounter, mountPath)
+}
+
+func (b *fakeBackend) WriteToken(configDir, token string) error {
+	return writeFile(tokenPath(configDir), token)
+}
+
+func (b *fakeBackend) RemoveConfig(configDir string) error {
+	return shredFiles(tokenPath(configDir))
+}
+
+func (b *fakeBackend) Stats(mountPath string) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(mountPath)
+}
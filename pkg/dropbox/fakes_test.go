@@ -0,0 +1,405 @@
+package dropbox
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/woohhan/dropbox-csi/internal/fakedropbox"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// Directory served as the fake Dropbox to every test, and the base URL of
+// its API
+var (
+	testDropboxDir string
+	testDropboxURL string
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := ioutil.TempDir("", "dropbox-csi-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	flag.Set("log_dir", dir)
+
+	testDropboxDir = path.Join(dir, "dropbox")
+	if testDropboxURL, err = fakedropbox.Start(testDropboxDir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestNodeServer returns a node server of cfg with the fake backend and
+// a symlinkMounter, in temporary directories. The preflight checks of the node
+// pass, as the fake backend doesn't need FUSE.
+func newTestNodeServer(t *testing.T, cfg *Config) *nodeServer {
+	dir := t.TempDir()
+	if cfg.RootDir == "" {
+		cfg.RootDir = path.Join(dir, "root")
+	}
+	if cfg.CredentialsDir == "" {
+		cfg.CredentialsDir = path.Join(dir, "credentials")
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = backendFake
+	}
+	useTestDropbox(cfg)
+
+	n := NewNodeServer(cfg)
+	n.mounter = newSymlinkMounter()
+	n.backends = newTestBackends(cfg, n.runner, n.mounter)
+	n.env = &stubEnv{}
+	t.Cleanup(n.Shutdown)
+	return n
+}
+
+// useTestDropbox makes the API clients of cfg call the fake Dropbox.
+func useTestDropbox(cfg *Config) *Config {
+	cfg.DropboxAPIURL = testDropboxURL
+	cfg.DropboxContentURL = testDropboxURL
+	return cfg
+}
+
+// useRunner makes the backends of n run their commands with runner.
+func useRunner(n *nodeServer, runner commandRunner) {
+	n.runner = runner
+	n.backends = newTestBackends(n.cfg, runner, n.mounter)
+}
+
+// useMounter makes n and its backends mount with mounter.
+func useMounter(n *nodeServer, mounter mount.Interface) {
+	n.mounter = mounter
+	n.backends = newTestBackends(n.cfg, n.runner, mounter)
+}
+
+// markStaged records volumeID as staged at stagingPath without mounting it.
+func markStaged(n *nodeServer, volumeID, stagingPath string) {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+	n.volumes[volumeID] = &volumeState{VolumeID: volumeID, MountPath: stagingPath}
+}
+
+// stubEnv is the environment of the node, with the checks answered by the
+// functions which are set. Nothing is written to the node.
+type stubEnv struct {
+	lookPath   func(file string) (string, error)
+	access     func(path string) error
+	writeFile  func(name string) error
+	stat       func(name string) (os.FileInfo, error)
+	euid       int
+	lookupHost func(host string) ([]string, error)
+	dial       func(addr string) error
+}
+
+func (e *stubEnv) LookPath(file string) (string, error) {
+	if e.lookPath != nil {
+		return e.lookPath(file)
+	}
+	return "/usr/bin/" + file, nil
+}
+
+func (e *stubEnv) Access(path string, mode uint32) error {
+	if e.access != nil {
+		return e.access(path)
+	}
+	return nil
+}
+
+func (e *stubEnv) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (e *stubEnv) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if e.writeFile != nil {
+		return e.writeFile(name)
+	}
+	return nil
+}
+
+func (e *stubEnv) Remove(name string) error {
+	return nil
+}
+
+func (e *stubEnv) Stat(name string) (os.FileInfo, error) {
+	if e.stat != nil {
+		return e.stat(name)
+	}
+	return os.Stat(name)
+}
+
+func (e *stubEnv) Geteuid() int {
+	return e.euid
+}
+
+func (e *stubEnv) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if e.lookupHost != nil {
+		return e.lookupHost(host)
+	}
+	return []string{"127.0.0.1"}, nil
+}
+
+func (e *stubEnv) Dial(ctx context.Context, addr string) error {
+	if e.dial != nil {
+		return e.dial(addr)
+	}
+	return nil
+}
+
+// testFolder creates a folder with the name of the test in the fake Dropbox
+// and returns its Dropbox path, without a leading slash.
+func testFolder(t *testing.T) string {
+	p := path.Join("tests", t.Name())
+	if err := os.MkdirAll(path.Join(testDropboxDir, p), 0750); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path.Join(testDropboxDir, p)) })
+	return p
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+}
+
+// tokenSecrets are the stage secrets of a volume, any token is valid for
+// the fake Dropbox.
+func tokenSecrets() map[string]string {
+	return map[string]string{secretToken: "fake"}
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("Expected %v, got %v", code, err)
+	}
+}
+
+// symlinkMounter emulates bind mounts with symlinks, so that the files of the
+// source are found at the target without the privileges to mount.
+type symlinkMounter struct {
+	mu  sync.Mutex
+	mps []mount.MountPoint
+	log []string
+}
+
+func newSymlinkMounter() *symlinkMounter {
+	return &symlinkMounter{}
+}
+
+func (m *symlinkMounter) Mount(source, target, fstype string, options []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(source, target); err != nil {
+		return err
+	}
+	m.mps = append(m.mps, mount.MountPoint{Device: source, Path: target, Type: fstype, Opts: options})
+	m.log = append(m.log, "mount "+target)
+	return nil
+}
+
+func (m *symlinkMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	return m.Mount(source, target, fstype, append(options, sensitiveOptions...))
+}
+
+func (m *symlinkMounter) Unmount(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.mps) - 1; i >= 0; i-- {
+		if m.mps[i].Path != target {
+			continue
+		}
+		m.mps = append(m.mps[:i], m.mps[i+1:]...)
+		m.log = append(m.log, "unmount "+target)
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+		return os.Mkdir(target, 0750)
+	}
+	return fmt.Errorf("%s is not mounted", target)
+}
+
+func (m *symlinkMounter) List() ([]mount.MountPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]mount.MountPoint(nil), m.mps...), nil
+}
+
+func (m *symlinkMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	if _, err := os.Lstat(file); err != nil {
+		return true, err
+	}
+	return !m.isMounted(file), nil
+}
+
+func (m *symlinkMounter) GetMountRefs(pathname string) ([]string, error) {
+	return nil, nil
+}
+
+func (m *symlinkMounter) isMounted(p string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, mp := range m.mps {
+		if mp.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// stubRunner records the commands run and answers them with run. A started
+// process fails like run, or else calls mount and runs until it is killed.
+type stubRunner struct {
+	mu    sync.Mutex
+	calls [][]string
+	run   func(call int, name string, args []string) (string, string, error)
+	mount func(args []string) error
+}
+
+func (r *stubRunner) Run(ctx context.Context, env []string, name string, args ...string) (string, string, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string{name}, args...))
+	call := len(r.calls)
+	r.mu.Unlock()
+
+	if r.run == nil {
+		return "", "", nil
+	}
+	return r.run(call, name, args)
+}
+
+func (r *stubRunner) Start(env []string, name string, args ...string) (process, error) {
+	proc := &stubProcess{done: make(chan struct{})}
+	stdout, stderr, err := r.Run(context.Background(), env, name, args...)
+	if err == nil && r.mount != nil {
+		err = r.mount(args)
+	}
+	if err != nil {
+		proc.exit(stdout, stderr, err)
+	}
+	return proc, nil
+}
+
+func (r *stubRunner) commands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([][]string(nil), r.calls...)
+}
+
+// stubProcess is a process of stubRunner.
+type stubProcess struct {
+	mu             sync.Mutex
+	done           chan struct{}
+	err            error
+	stdout, stderr string
+}
+
+func (p *stubProcess) exit(stdout, stderr string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.stdout, p.stderr, p.err = stdout, stderr, err
+	close(p.done)
+}
+
+func (p *stubProcess) Pid() int {
+	return 0
+}
+
+func (p *stubProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *stubProcess) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+func (p *stubProcess) Output() (string, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stdout, p.stderr
+}
+
+func (p *stubProcess) Kill() error {
+	p.exit("", "", fmt.Errorf("signal: killed"))
+	return nil
+}
+
+// blockingBackend is a backend whose mounts of the paths in block wait until
+// the channel of the path is closed.
+type blockingBackend struct {
+	Backend
+	mu      sync.Mutex
+	block   map[string]chan struct{}
+	mounted []string
+}
+
+func newBlockingBackend(backend Backend) *blockingBackend {
+	return &blockingBackend{Backend: backend, block: map[string]chan struct{}{}}
+}
+
+// blockMount makes the mounts of mountPath wait until the returned channel
+// is closed.
+func (b *blockingBackend) blockMount(mountPath string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan struct{})
+	b.block[mountPath] = ch
+	return ch
+}
+
+func (b *blockingBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	b.mu.Lock()
+	ch := b.block[req.MountPath]
+	b.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+
+	pid, err := b.Backend.Mount(ctx, req)
+	b.mu.Lock()
+	b.mounted = append(b.mounted, req.MountPath)
+	b.mu.Unlock()
+	return pid, err
+}
+
+func (b *blockingBackend) mounts() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.mounted...)
+}
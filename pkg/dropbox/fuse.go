@@ -0,0 +1,238 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// Interval to check whether a foreground FUSE command has mounted
+const fusePollInterval = 100 * time.Millisecond
+
+// fuseCommand runs the external command of a FUSE backend. The messages of the
+// command tell how a failure is handled.
+type fuseCommand struct {
+	name string
+	// Path of the executable, name is looked up on PATH if empty
+	path    string
+	runner  commandRunner
+	mounter mount.Interface
+	cfg     *Config
+
+	// Run the command as a child of the driver with foregroundArgs,
+	// otherwise the command is expected to daemonize once mounted
+	foreground     bool
+	foregroundArgs []string
+	// Added to the arguments of every mount
+	extraArgs []string
+
+	// Messages for failures which never succeed on retry
+	authErrors []string
+	// Messages for failures which may succeed on retry
+	transientErrors []string
+	// Messages for rate limited requests, which are retried too
+	rateLimitErrors []string
+	// Messages for options the command doesn't know
+	unsupportedOptionErrors []string
+}
+
+// mount runs the command to mount mountPath and returns the pid of the process
+// serving the mount, or 0 if it's unknown. Transient failures are retried with
+// a jittered exponential backoff up to MountRetries times, authentication
+// failures fail fast. A read-only request mounts
+// the FUSE filesystem itself read-only, and fails if the command can't.
+//
+// The whole mount is bounded by MountTimeout, after which the command is
+// killed and DeadlineExceeded is returned.
+func (c *fuseCommand) mount(ctx context.Context, req *mountRequest, args func(readonly bool) []string) (int, error) {
+	if c.cfg.MountTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.MountTimeout)
+		defer cancel()
+	}
+
+	mountPath := req.MountPath
+	attempts := c.cfg.MountRetries + 1
+	interval := c.cfg.MountRetryInterval
+
+	var pid int
+	var stdout, stderr string
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		start := time.Now()
+		pid, stdout, stderr, err = c.run(ctx, mountPath, req.Env, append(args(req.ReadOnly), c.extraArgs...), req.OnExit)
+		mountDuration.WithLabelValues(c.name).Observe(time.Since(start).Seconds())
+		if ctx.Err() != nil {
+			return 0, c.canceledError(ctx)
+		}
+		if err == nil {
+			glog.V(4).Infof("dropbox-csi: volume %s is mounted by %s pid %d %s", mountPath, c.name, pid, stdout)
+			return pid, nil
+		}
+		if containsAny(stderr, c.authErrors) {
+			glog.Errorf("Dropbox authentication failed: %s", stderr)
+			mountFailuresTotal.WithLabelValues(c.name, codes.Unauthenticated.String()).Inc()
+			return 0, status.Errorf(codes.Unauthenticated, "Dropbox authentication failed, check the token: %s", stderr)
+		}
+		// Never fall back to a writable mount, writes would reach Dropbox
+		// through the staging path
+		if req.ReadOnly && containsAny(stderr, c.unsupportedOptionErrors) {
+			glog.Errorf("%s doesn't support read-only mount of %s: %s", c.name, mountPath, stderr)
+			mountFailuresTotal.WithLabelValues(c.name, codes.FailedPrecondition.String()).Inc()
+			return 0, status.Errorf(codes.FailedPrecondition, "%s can't mount read-only: %s", c.name, stderr)
+		}
+		if !c.isTransient(stderr) || attempt == attempts {
+			break
+		}
+
+		wait := jitter(interval)
+		glog.Warningf("%s mount attempt %d/%d failed, retrying in %v: %s", c.name, attempt, attempts, wait, stderr)
+		select {
+		case <-ctx.Done():
+			return 0, c.canceledError(ctx)
+		case <-time.After(wait):
+		}
+		if interval *= 2; interval > maxRemountBackoff {
+			interval = maxRemountBackoff
+		}
+	}
+
+	glog.Errorf("Cant mount %s %s: %s %s", c.name, formatKV("requestID", requestID(ctx), "mountPath", mountPath), stdout, stderr)
+	code := c.failureCode(stderr)
+	mountFailuresTotal.WithLabelValues(c.name, code.String()).Inc()
+	return 0, status.Errorf(code, "Can't mount %s: %v: %s", c.name, err, stderr)
+}
+
+func (c *fuseCommand) isTransient(stderr string) bool {
+	return containsAny(stderr, c.transientErrors) || containsAny(stderr, c.rateLimitErrors)
+}
+
+// failureCode returns the gRPC code of a mount which failed with stderr after
+// all retries.
+func (c *fuseCommand) failureCode(stderr string) codes.Code {
+	switch {
+	case containsAny(stderr, c.rateLimitErrors):
+		return codes.ResourceExhausted
+	case containsAny(stderr, c.transientErrors):
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// canceledError returns the error of a mount stopped by ctx.
+func (c *fuseCommand) canceledError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		glog.Errorf("%s mount timed out", c.name)
+		mountFailuresTotal.WithLabelValues(c.name, codes.DeadlineExceeded.String()).Inc()
+		return status.Errorf(codes.DeadlineExceeded, "%s mount timed out", c.name)
+	}
+	return status.Errorf(codes.Aborted, "%s mount is canceled: %v", c.name, ctx.Err())
+}
+
+// run runs a single mount attempt and returns the pid of the process serving
+// the mount.
+//
+// In foreground mode the command stays a child of the driver, and the mount
+// is ready when mountPath becomes a mount point. Otherwise the command
+// daemonizes once the mount is ready, and the daemon is looked up in /proc.
+//
+// onExit, if set, is called when a foreground command exits after mounting.
+func (c *fuseCommand) run(ctx context.Context, mountPath string, env, args []string, onExit func(pid int, err error, stderr string)) (int, string, string, error) {
+	if !c.foreground {
+		stdout, stderr, err := c.runner.Run(ctx, env, c.command(), args...)
+		if err != nil {
+			return 0, stdout, stderr, err
+		}
+		return findMountProcess(c.command(), mountPath), stdout, stderr, nil
+	}
+
+	proc, err := c.runner.Start(env, c.command(), append(args, c.foregroundArgs...)...)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	ticker := time.NewTicker(fusePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-proc.Done():
+			stdout, stderr := proc.Output()
+			err := proc.Err()
+			if err == nil {
+				err = fmt.Errorf("%s exited before mounting %s", c.name, mountPath)
+			}
+			return 0, stdout, stderr, err
+		case <-ctx.Done():
+			proc.Kill()
+			<-proc.Done()
+			stdout, stderr := proc.Output()
+			return 0, stdout, stderr, ctx.Err()
+		case <-ticker.C:
+			notMnt, err := c.mounter.IsLikelyNotMountPoint(mountPath)
+			if err == nil && !notMnt {
+				stdout, stderr := proc.Output()
+				if onExit != nil {
+					go func() {
+						<-proc.Done()
+						_, stderr := proc.Output()
+						onExit(proc.Pid(), proc.Err(), stderr)
+					}()
+				}
+				return proc.Pid(), stdout, stderr, nil
+			}
+		}
+	}
+}
+
+func (c *fuseCommand) command() string {
+	if c.path != "" {
+		return c.path
+	}
+	return c.name
+}
+
+// findMountProcess returns the pid of the name process serving mountPath, or
+// 0 if there is none.
+func findMountProcess(name, mountPath string) int {
+	cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0
+	}
+
+	for _, cmdlinePath := range cmdlines {
+		data, err := ioutil.ReadFile(cmdlinePath)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if !strings.Contains(strings.Join(args, " "), name) || !contains(args, mountPath) {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(cmdlinePath)))
+		if err == nil && pid != os.Getpid() {
+			return pid
+		}
+	}
+
+	glog.Warningf("Can't find %s process of %s", name, mountPath)
+	return 0
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
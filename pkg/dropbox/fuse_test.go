@@ -0,0 +1,270 @@
+package dropbox
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"k8s.io/utils/mount"
+)
+
+// newDbxfsTestNodeServer returns a node server whose dbxfs commands are
+// answered by run.
+func newDbxfsTestNodeServer(cfg *Config, run func(call int, name string, args []string) (string, string, error)) (*nodeServer, *stubRunner) {
+	n := NewNodeServer(cfg)
+	runner := &stubRunner{run: run}
+	useRunner(n, runner)
+	return n, runner
+}
+
+func stageRequest(t *testing.T, volumeID string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: path.Join(t.TempDir(), "staging"),
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     map[string]string{"path": testFolder(t)},
+		Secrets:           tokenSecrets(),
+	}
+}
+
+// mountDbxfs mounts a new directory with the dbxfs backend of n.
+func mountDbxfs(ctx context.Context, t *testing.T, n *nodeServer, readonly bool) (int, error) {
+	return n.backends[backendDbxfs].Mount(ctx, &mountRequest{
+		MountPath: t.TempDir(),
+		ConfigDir: t.TempDir(),
+		Token:     "token",
+		ReadOnly:  readonly,
+	})
+}
+
+func TestMountRetriesTransientFailures(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{
+		MountRetries:       3,
+		MountRetryInterval: time.Millisecond,
+	}, func(call int, name string, args []string) (string, string, error) {
+		if call <= 2 {
+			return "", "requests.exceptions.ConnectionError: Connection reset by peer", errors.New("exit status 1")
+		}
+		return "", "", nil
+	})
+
+	if _, err := mountDbxfs(context.Background(), t, n, false); err != nil {
+		t.Fatalf("Mount failed after transient failures: %v", err)
+	}
+	if calls := len(runner.commands()); calls != 3 {
+		t.Errorf("Expected 3 mount attempts, got %d", calls)
+	}
+}
+
+func TestMountGivesUpAfterRetries(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{
+		MountRetries:       2,
+		MountRetryInterval: time.Millisecond,
+	}, func(call int, name string, args []string) (string, string, error) {
+		return "", "requests.exceptions.ConnectionError: Connection refused", errors.New("exit status 1")
+	})
+
+	if _, err := mountDbxfs(context.Background(), t, n, false); err == nil {
+		t.Fatal("Mount succeeded")
+	}
+	if calls := len(runner.commands()); calls != 3 {
+		t.Errorf("Expected 3 mount attempts, got %d", calls)
+	}
+}
+
+func TestAuthErrorsAreUnauthenticated(t *testing.T) {
+	for _, stderr := range []string{
+		"dropboxapi.exceptions.AuthError: AuthError('1', AuthError('invalid_access_token', None))",
+		"requests.exceptions.HTTPError: 401 Client Error: Unauthorized for url: https://api.dropboxapi.com/2/users/get_current_account",
+		"dropbox.exceptions.AuthError: AuthError('2', AuthError('missing_scope', None))",
+	} {
+		n, runner := newDbxfsTestNodeServer(&Config{
+			MountRetries:       3,
+			MountRetryInterval: time.Millisecond,
+		}, func(call int, name string, args []string) (string, string, error) {
+			return "", stderr, errors.New("exit status 1")
+		})
+
+		_, err := mountDbxfs(context.Background(), t, n, false)
+		expectCode(t, err, codes.Unauthenticated)
+		// The stderr of dbxfs is kept for debugging
+		if !strings.Contains(err.Error(), stderr) {
+			t.Errorf("Expected the stderr of dbxfs in %v", err)
+		}
+		// An invalid token isn't retried
+		if calls := len(runner.commands()); calls != 1 {
+			t.Errorf("Expected a single mount attempt, got %d", calls)
+		}
+	}
+}
+
+func TestReadOnlyReachesMountCommand(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		readOnly bool
+	}{
+		{name: "writable", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{name: "single node writer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{name: "reader only", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, readOnly: true},
+		{name: "single node reader only", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, readOnly: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n, runner := newDbxfsTestNodeServer(&Config{}, nil)
+			capability := &csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.mode},
+			}
+
+			if _, err := mountDbxfs(context.Background(), t, n, isReadOnlyCapability(capability)); err != nil {
+				t.Fatal(err)
+			}
+			commands := runner.commands()
+			if len(commands) != 1 {
+				t.Fatalf("Expected one mount command, got %v", commands)
+			}
+			command := strings.Join(commands[0], " ")
+			if strings.Contains(command, "-o ro") != test.readOnly {
+				t.Errorf("Expected read-only %t, got %s", test.readOnly, command)
+			}
+		})
+	}
+}
+
+func TestReadOnlyMountNeverFallsBackToWritable(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{MountRetries: 3}, func(call int, name string, args []string) (string, string, error) {
+		return "", "dbxfs: error: unrecognized arguments: -o ro", errors.New("exit status 2")
+	})
+
+	_, err := mountDbxfs(context.Background(), t, n, true)
+	expectCode(t, err, codes.FailedPrecondition)
+	if calls := len(runner.commands()); calls != 1 {
+		t.Errorf("Expected a single mount attempt, got %d", calls)
+	}
+}
+
+func TestPublishCapability(t *testing.T) {
+	for _, test := range []struct {
+		mode     csi.VolumeCapability_AccessMode_Mode
+		readonly bool
+		expected csi.VolumeCapability_AccessMode_Mode
+	}{
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, expected: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, readonly: true, expected: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, readonly: true, expected: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, readonly: true, expected: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+	} {
+		capability := mountCapability()
+		capability.AccessMode.Mode = test.mode
+		vc := publishCapability(&csi.NodePublishVolumeRequest{VolumeCapability: capability, Readonly: test.readonly})
+		if mode := vc.GetAccessMode().GetMode(); mode != test.expected {
+			t.Errorf("%v published with readonly %t: expected %v, got %v", test.mode, test.readonly, test.expected, mode)
+		}
+		if isReadOnlyCapability(vc) != test.readonly {
+			t.Errorf("%v published with readonly %t isn't mounted read-only", test.mode, test.readonly)
+		}
+	}
+}
+
+func TestDbxfsForeground(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		foreground bool
+		mounts     bool
+		stderr     string
+		code       codes.Code
+	}{
+		{name: "daemonized", mounts: true},
+		{name: "foreground", foreground: true, mounts: true},
+		{name: "foreground exits before mounting", foreground: true, stderr: "fuse: device not found", code: codes.Internal},
+		{name: "foreground never mounts", foreground: true, code: codes.DeadlineExceeded},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n, runner := newDbxfsTestNodeServer(&Config{
+				DbxfsForeground: test.foreground,
+				MountTimeout:    time.Second,
+			}, func(call int, name string, args []string) (string, string, error) {
+				if test.stderr != "" {
+					return "", test.stderr, errors.New("exit status 1")
+				}
+				return "", "", nil
+			})
+			fakeMounter := mount.NewFakeMounter(nil)
+			useMounter(n, fakeMounter)
+			if test.mounts {
+				runner.mount = func(args []string) error {
+					return fakeMounter.Mount("dbxfs", args[0], "fuse", nil)
+				}
+			}
+
+			_, err := mountDbxfs(context.Background(), t, n, false)
+			expectCode(t, err, test.code)
+			if err != nil && !strings.Contains(err.Error(), test.stderr) {
+				t.Errorf("Error doesn't tell the output of dbxfs: %v", err)
+			}
+			commands := runner.commands()
+			if len(commands) != 1 {
+				t.Fatalf("Expected one mount command, got %v", commands)
+			}
+			command := commands[0]
+			if foreground := command[len(command)-1] == "-f"; foreground != test.foreground {
+				t.Errorf("Expected foreground %t, got %v", test.foreground, command)
+			}
+		})
+	}
+}
+
+func TestDbxfsPathAndExtraArgs(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{
+		DbxfsPath:      "/opt/dbxfs/bin/dbxfs",
+		DbxfsExtraArgs: []string{"--verbose"},
+	}, nil)
+
+	if _, err := mountDbxfs(context.Background(), t, n, true); err != nil {
+		t.Fatal(err)
+	}
+	commands := runner.commands()
+	if len(commands) != 1 {
+		t.Fatalf("Expected one mount command, got %v", commands)
+	}
+	command := commands[0]
+	if command[0] != "/opt/dbxfs/bin/dbxfs" {
+		t.Errorf("Expected the configured dbxfs, got %v", command)
+	}
+	if command[len(command)-1] != "--verbose" {
+		t.Errorf("Expected the extra arguments last, got %v", command)
+	}
+
+	var lookedUp []string
+	n.env = &stubEnv{lookPath: func(file string) (string, error) {
+		lookedUp = append(lookedUp, file)
+		return file, nil
+	}}
+	if err := n.Preflight(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(lookedUp, "/opt/dbxfs/bin/dbxfs") {
+		t.Errorf("Preflight doesn't check the configured dbxfs, looked up %v", lookedUp)
+	}
+}
+
+func TestMountTimeoutBoundsRetries(t *testing.T) {
+	n, _ := newDbxfsTestNodeServer(&Config{
+		MountTimeout:       100 * time.Millisecond,
+		MountRetries:       5,
+		MountRetryInterval: time.Minute,
+	}, func(call int, name string, args []string) (string, string, error) {
+		return "", "requests.exceptions.ConnectionError: Connection refused", errors.New("exit status 1")
+	})
+
+	start := time.Now()
+	_, err := mountDbxfs(context.Background(), t, n, false)
+	expectCode(t, err, codes.DeadlineExceeded)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Mount retried beyond the timeout for %v", elapsed)
+	}
+}
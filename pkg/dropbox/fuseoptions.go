@@ -0,0 +1,51 @@
+package dropbox
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Volume context keys of the FUSE options of a mount
+const (
+	allowOtherKey   = "allowOther"
+	defaultPermsKey = "defaultPermissions"
+	umaskKey        = "umask"
+)
+
+// Config of fusermount, which only lets users other than root mount with
+// allow_other if it has user_allow_other
+var fuseConfPath = "/etc/fuse.conf"
+
+func validateUmask(umask string) error {
+	if umask == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(umask, 8, 12); err != nil {
+		return fmt.Errorf("Invalid %s %q, must be an octal mask like 0022", umaskKey, umask)
+	}
+	return nil
+}
+
+// checkAllowOther checks that the driver can mount with allow_other, which
+// pods running as another user than the driver need to access the mount.
+func checkAllowOther() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	f, err := os.Open(fuseConfPath)
+	if err != nil {
+		return fmt.Errorf("allow_other requires user_allow_other in %s when the driver doesn't run as root: %v", fuseConfPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "user_allow_other" {
+			return nil
+		}
+	}
+	return fmt.Errorf("allow_other requires user_allow_other in %s when the driver doesn't run as root", fuseConfPath)
+}
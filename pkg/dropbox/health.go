@@ -0,0 +1,74 @@
+package dropbox
+
+import (
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// readiness is the readiness state of the driver, served by both the gRPC
+// health service and the /readyz endpoint.
+type readiness struct {
+	mu    sync.Mutex
+	ready bool
+	// The driver isn't ready while the preflight checks fail
+	preflightErr error
+	health       *health.Server
+}
+
+func newReadiness() *readiness {
+	r := &readiness{
+		health: health.NewServer(),
+	}
+	r.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return r
+}
+
+func (r *readiness) set(ready bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ready = ready
+	r.updateHealth()
+}
+
+func (r *readiness) setPreflightError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.preflightErr = err
+	r.updateHealth()
+}
+
+func (r *readiness) updateHealth() {
+	if r.ready && r.preflightErr == nil {
+		r.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	} else {
+		r.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+func (r *readiness) isReady() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ready && r.preflightErr == nil
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	ready, preflightErr := r.ready, r.preflightErr
+	r.mu.Unlock()
+
+	if preflightErr != nil {
+		http.Error(w, preflightErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,81 @@
+package dropbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestReadinessTransitions(t *testing.T) {
+	r := newReadiness()
+	expectReadiness(t, r, healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+
+	r.set(true)
+	expectReadiness(t, r, healthpb.HealthCheckResponse_SERVING, http.StatusOK)
+
+	r.set(false)
+	expectReadiness(t, r, healthpb.HealthCheckResponse_NOT_SERVING, http.StatusServiceUnavailable)
+}
+
+func expectReadiness(t *testing.T, r *readiness, serving healthpb.HealthCheckResponse_ServingStatus, code int) {
+	t.Helper()
+
+	resp, err := r.health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != serving {
+		t.Errorf("Expected health %v, got %v", serving, resp.Status)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != code {
+		t.Errorf("Expected /readyz %d, got %d", code, rec.Code)
+	}
+}
+
+func TestServerReportsHealth(t *testing.T) {
+	r := newReadiness()
+	s := NewNonBlockingGRPCServer(r, 0)
+	endpoint := "unix://" + path.Join(t.TempDir(), "csi.sock")
+	s.Start(endpoint, nil, nil, nil)
+	for i := 0; !r.isReady(); i++ {
+		if i == 100 {
+			t.Fatal("Server isn't serving")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer s.ForceStop()
+
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got %v", resp.Status)
+	}
+
+	r.set(false)
+	resp, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING, got %v", resp.Status)
+	}
+}
@@ -10,12 +10,14 @@ import (
 type identityServer struct {
 	name    string
 	version string
+	ns      *nodeServer
 }
 
-func NewIdentityServer(name, version string) *identityServer {
+func NewIdentityServer(name, version string, ns *nodeServer) *identityServer {
 	return &identityServer{
 		name:    name,
 		version: version,
+		ns:      ns,
 	}
 }
 
@@ -51,10 +53,34 @@ func (i *identityServer) GetPluginCapabilities(context.Context, *csi.GetPluginCa
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-func (i *identityServer) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+// Probe fails with the checks of the node. The Dropbox API is checked by
+// runPreflight for the readiness of the driver, and by Probe only with
+// ProbeDropboxAPI, so that the livenessprobe sidecar doesn't restart the
+// driver and its mounts while Dropbox is unreachable.
+func (i *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if i.ns != nil {
+		if err := i.ns.checkPreflight(ctx); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if err := i.ns.checkLiveness(); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if i.ns.cfg.ProbeDropboxAPI {
+			if err := i.ns.checkDropboxAPI(ctx); err != nil {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+		}
+	}
 	return &csi.ProbeResponse{}, nil
 }
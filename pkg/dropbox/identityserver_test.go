@@ -0,0 +1,33 @@
+package dropbox
+
+import (
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestProbeIgnoresDropboxAPI(t *testing.T) {
+	// The token file can't be read, so the Dropbox API check fails
+	n := newTestNodeServer(t, &Config{TokenFile: path.Join(t.TempDir(), "missing")})
+	n.env = &stubEnv{}
+	if err := n.checkDropboxAPI(context.Background()); err == nil {
+		t.Fatal("Dropbox API check passed without a token")
+	}
+
+	ids := NewIdentityServer("dropbox.csi.k8s.io", "test", n)
+	if _, err := ids.Probe(context.Background(), &csi.ProbeRequest{}); err != nil {
+		t.Errorf("Probe failed with the Dropbox API: %v", err)
+	}
+}
+
+func TestProbeChecksDropboxAPIIfSet(t *testing.T) {
+	n := newTestNodeServer(t, &Config{TokenFile: path.Join(t.TempDir(), "missing"), ProbeDropboxAPI: true})
+	n.env = &stubEnv{}
+
+	ids := NewIdentityServer("dropbox.csi.k8s.io", "test", n)
+	_, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	expectCode(t, err, codes.Unavailable)
+}
@@ -0,0 +1,105 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Namespace of the driver pod, in the service account mounted in every pod
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Annotation of the external-provisioner on the persistent volumes it creates
+const provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+// newInClusterKubeClient returns a client of the Kubernetes API authenticated
+// with the service account of the driver pod.
+func newInClusterKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return kube, nil
+}
+
+// podNamespace returns the namespace of the driver pod.
+func podNamespace() (string, error) {
+	ns, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// isDriverVolume tells whether pv is a persistent volume of driverName.
+func isDriverVolume(pv *v1.PersistentVolume, driverName string) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName
+}
+
+// persistentVolumes returns the persistent volumes of driverName.
+func persistentVolumes(ctx context.Context, kube kubernetes.Interface, driverName string) ([]*v1.PersistentVolume, error) {
+	list, err := kube.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pvs []*v1.PersistentVolume
+	for i := range list.Items {
+		if isDriverVolume(&list.Items[i], driverName) {
+			pvs = append(pvs, &list.Items[i])
+		}
+	}
+	return pvs, nil
+}
+
+// persistentVolume returns the persistent volume of driverName with
+// volumeHandle, or nil if there is none.
+func persistentVolume(ctx context.Context, kube kubernetes.Interface, driverName, volumeHandle string) (*v1.PersistentVolume, error) {
+	pvs, err := persistentVolumes(ctx, kube, driverName)
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI.VolumeHandle == volumeHandle {
+			return pv, nil
+		}
+	}
+	return nil, nil
+}
+
+// volumeAttributes returns the volume attributes of the persistent volume
+// of driverName with volumeHandle, or nil if there is none.
+func volumeAttributes(ctx context.Context, kube kubernetes.Interface, driverName, volumeHandle string) (map[string]string, error) {
+	pv, err := persistentVolume(ctx, kube, driverName, volumeHandle)
+	if err != nil || pv == nil {
+		return nil, err
+	}
+	return pv.Spec.CSI.VolumeAttributes, nil
+}
+
+// nodeStageSecretRef returns the nodeStageSecretRef of a persistent volume of
+// the driver, or its nodePublishSecretRef if it has none.
+func nodeStageSecretRef(pv *v1.PersistentVolume) *v1.SecretReference {
+	if pv.Spec.CSI.NodeStageSecretRef != nil {
+		return pv.Spec.CSI.NodeStageSecretRef
+	}
+	// Volumes staged on publish, see NodeStageVolume
+	return pv.Spec.CSI.NodePublishSecretRef
+}
+
+// secretData returns the data of a secret as strings.
+func secretData(secret *v1.Secret) map[string]string {
+	data := map[string]string{}
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data
+}
@@ -0,0 +1,110 @@
+package dropbox
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Timing of the lease, the defaults of the CSI sidecars
+const (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 5 * time.Second
+)
+
+// leaderElector elects one of the controller replicas of the driver with a
+// coordination.k8s.io lease, to run the background work of the controller
+// once. CSI RPCs are not affected, the sidecars elect their own leader.
+type leaderElector struct {
+	elector *leaderelection.LeaderElector
+	lease   string
+
+	// Canceling ctx releases the lease, done is closed when run returns
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newLeaderElector returns an elector of a lease named after the driver in
+// the namespace of the driver pod, or namespace if set.
+func newLeaderElector(kube kubernetes.Interface, driverName, namespace string) (*leaderElector, error) {
+	if namespace == "" {
+		var err error
+		if namespace, err = podNamespace(); err != nil {
+			return nil, fmt.Errorf("Can't get the namespace of the lease: %v", err)
+		}
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &leaderElector{
+		lease: namespace + "/" + strings.Replace(driverName, ".", "-", -1),
+		done:  make(chan struct{}),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      strings.Replace(driverName, ".", "-", -1),
+			},
+			Client:     kube.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration: leaseDuration,
+		RenewDeadline: leaseRenewDeadline,
+		RetryPeriod:   leaseRetryPeriod,
+		// Another replica takes the lease without waiting for it to expire
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				glog.Infof("Became the leader of lease %s", l.lease)
+			},
+			OnStoppedLeading: func() {
+				glog.Warningf("Lost the leadership of lease %s", l.lease)
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// isLeader tells whether this replica holds the lease.
+func (l *leaderElector) isLeader() bool {
+	if l == nil {
+		return true
+	}
+	return l.elector.IsLeader()
+}
+
+// run takes and renews the lease until it is released.
+func (l *leaderElector) run() {
+	defer close(l.done)
+	glog.Infof("Electing the leader with lease %s", l.lease)
+	// Run returns when the leadership is lost, the lease is taken again
+	for l.ctx.Err() == nil {
+		l.elector.Run(l.ctx)
+	}
+}
+
+// release gives up the lease and waits until it is released or ctx is done.
+func (l *leaderElector) release(ctx context.Context) {
+	l.cancel()
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,64 @@
+package dropbox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// checkLiveness checks that the mounts of staged volumes respond to statfs
+// within LivenessMountTimeout, and that no mount process exited without the
+// supervisor noticing. It is skipped if LivenessMountTimeout is 0.
+//
+// Dead mounts are remounted by the health monitor and crashed processes are
+// restarted by the supervisor, so only a wedged mount or driver fails it.
+func (n *nodeServer) checkLiveness() error {
+	if n.cfg.LivenessMountTimeout <= 0 {
+		return nil
+	}
+
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	n.volumesMu.Unlock()
+
+	var failures []string
+	for _, vol := range volumes {
+		if n.gaveUp(vol.VolumeID) {
+			continue
+		}
+		// Exits of shared mounts are left to the health monitor
+		if count, _ := n.crashes.get(vol.VolumeID); count == 0 && vol.SharedMount == "" && vol.Pid != 0 && processExited(vol.Pid) {
+			failures = append(failures, fmt.Sprintf("mount process %d of volume %s exited unnoticed", vol.Pid, vol.VolumeID))
+			continue
+		}
+		if !statfsResponds(vol.MountPath, n.cfg.LivenessMountTimeout) {
+			failures = append(failures, fmt.Sprintf("mount of volume %s at %s doesn't respond in %v", vol.VolumeID, vol.MountPath, n.cfg.LivenessMountTimeout))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Liveness check failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// statfsResponds tells whether statfs of mountPath returns within timeout,
+// whatever the result. A hung statfs leaves its goroutine behind until the
+// mount is torn down.
+func statfsResponds(mountPath string, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		statfsUsage(mountPath)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
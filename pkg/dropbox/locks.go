@@ -0,0 +1,37 @@
+package dropbox
+
+import (
+	"sync"
+)
+
+// volumeLocks keeps the volume IDs with an operation in flight, so that
+// operations on the same volume never run concurrently.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// tryAcquire locks volumeID and returns false if it is already locked.
+func (l *volumeLocks) tryAcquire(volumeID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locks[volumeID]; ok {
+		return false
+	}
+	l.locks[volumeID] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) release(volumeID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locks, volumeID)
+}
@@ -0,0 +1,159 @@
+package dropbox
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "csi_dropbox"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	nodeOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_operations_total",
+		Help:      "Number of node operations by result code.",
+	}, []string{"operation", "code"})
+
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Duration of mount backend startup.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+	}, []string{"backend"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of CSI RPCs by method and result code.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"method", "code"})
+
+	mountFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "Number of failed mounts by backend and result code.",
+	}, []string{"backend", "code"})
+
+	tokenRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of access token refreshes by result.",
+	}, []string{"result"})
+
+	stagedVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "staged_volumes",
+		Help:      "Number of volumes staged on the node.",
+	})
+
+	tokenVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_volumes",
+		Help:      "Number of volumes staged on the node with a token, by the truncated hash of the token.",
+	}, []string{"token"})
+
+	quotaUsageRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_usage_ratio",
+		Help:      "Used fraction of the Dropbox account space of a volume.",
+	}, []string{"volume"})
+
+	quotaWarningsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_warnings_total",
+		Help:      "Number of times a volume was over the quota warning threshold.",
+	}, []string{"volume"})
+
+	apiCallsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_calls_total",
+		Help:      "Number of Dropbox API calls made by the driver for a volume.",
+	}, []string{"volume"})
+
+	apiThrottledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_throttled_total",
+		Help:      "Number of Dropbox API calls made by the driver for a volume which were rate limited.",
+	}, []string{"volume"})
+
+	apiBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_bytes_total",
+		Help:      "Bytes transferred with Dropbox for a volume by direction.",
+	}, []string{"volume", "direction"})
+
+	apiConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_connections_total",
+		Help:      "Number of connections to Dropbox opened by the mount process of a volume.",
+	}, []string{"volume"})
+
+	conflictedFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "conflicted_files",
+		Help:      "Number of conflicted copies in the folder of a volume.",
+	}, []string{"volume"})
+
+	conflictedFilesQuarantinedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conflicted_files_quarantined_total",
+		Help:      "Number of conflicted copies of a volume moved to its .conflicts folder.",
+	}, []string{"volume"})
+
+	orphanedFolderCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_folders",
+		Help:      "Number of provisioned Dropbox folders no persistent volume uses.",
+	})
+
+	orphanedFoldersCleanedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_folders_cleaned_total",
+		Help:      "Number of orphaned folders archived or deleted by action and result.",
+	}, []string{"action", "result"})
+)
+
+// Node RPCs recorded in nodeOperationsTotal
+var nodeOperations = map[string]string{
+	"/csi.v1.Node/NodeStageVolume":     "stage",
+	"/csi.v1.Node/NodeUnstageVolume":   "unstage",
+	"/csi.v1.Node/NodePublishVolume":   "publish",
+	"/csi.v1.Node/NodeUnpublishVolume": "unpublish",
+}
+
+func init() {
+	metricsRegistry.MustRegister(nodeOperationsTotal, mountDuration, rpcDuration, mountFailuresTotal,
+		tokenRefreshesTotal, stagedVolumes, tokenVolumes, quotaUsageRatio, quotaWarningsTotal,
+		apiCallsTotal, apiThrottledTotal, apiBytesTotal, apiConnectionsTotal,
+		conflictedFiles, conflictedFilesQuarantinedTotal, orphanedFolderCount, orphanedFoldersCleanedTotal)
+}
+
+func recordOperation(method string, err error, duration time.Duration) {
+	rpcDuration.WithLabelValues(method, status.Code(err).String()).Observe(duration.Seconds())
+
+	operation, ok := nodeOperations[method]
+	if !ok {
+		return
+	}
+	nodeOperationsTotal.WithLabelValues(operation, status.Code(err).String()).Inc()
+}
+
+// serveMetrics exposes the metrics and the readiness on addr until the
+// process exits.
+func serveMetrics(addr string, ready *readiness) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/readyz", ready)
+
+	glog.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("Metrics server failed: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package dropbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// stageThroughInterceptor mounts dbxfs with n as a stage RPC passing through
+// the interceptor of the gRPC server.
+func stageThroughInterceptor(t *testing.T, n *nodeServer) error {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	_, err := logGRPC(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "metrics"}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, err := mountDbxfs(ctx, t, n, false); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	})
+	return err
+}
+
+func TestStagesAreCounted(t *testing.T) {
+	stageOK := nodeOperationsTotal.WithLabelValues("stage", codes.OK.String())
+	stageUnauthenticated := nodeOperationsTotal.WithLabelValues("stage", codes.Unauthenticated.String())
+	okBefore, unauthenticatedBefore := testutil.ToFloat64(stageOK), testutil.ToFloat64(stageUnauthenticated)
+	authFailures := mountFailuresTotal.WithLabelValues("dbxfs", codes.Unauthenticated.String())
+	authFailuresBefore := testutil.ToFloat64(authFailures)
+	rpcsBefore := rpcCount(t, "/csi.v1.Node/NodeStageVolume", codes.Unauthenticated)
+
+	n, _ := newDbxfsTestNodeServer(&Config{}, nil)
+	if err := stageThroughInterceptor(t, n); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = newDbxfsTestNodeServer(&Config{}, func(call int, name string, args []string) (string, string, error) {
+		return "", "AuthError: invalid_access_token", errors.New("exit status 1")
+	})
+	expectCode(t, stageThroughInterceptor(t, n), codes.Unauthenticated)
+
+	if n := testutil.ToFloat64(stageOK) - okBefore; n != 1 {
+		t.Errorf("Expected 1 successful stage, got %v", n)
+	}
+	if n := testutil.ToFloat64(stageUnauthenticated) - unauthenticatedBefore; n != 1 {
+		t.Errorf("Expected 1 unauthenticated stage, got %v", n)
+	}
+	if n := testutil.ToFloat64(authFailures) - authFailuresBefore; n != 1 {
+		t.Errorf("Expected 1 mount failure, got %v", n)
+	}
+	if n := rpcCount(t, "/csi.v1.Node/NodeStageVolume", codes.Unauthenticated) - rpcsBefore; n != 1 {
+		t.Errorf("Expected the duration of 1 unauthenticated stage, got %d", n)
+	}
+}
+
+// rpcCount returns the number of RPC durations observed for method and code.
+func rpcCount(t *testing.T, method string, code codes.Code) uint64 {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != metricsNamespace+"_rpc_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["method"] == method && labels["code"] == code.String() {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestOnlyNodeOperationsAreCounted(t *testing.T) {
+	operations := testutil.CollectAndCount(nodeOperationsTotal)
+	recordOperation("/csi.v1.Controller/CreateVolume", nil, time.Millisecond)
+	recordOperation("/csi.v1.Node/NodeGetCapabilities", nil, time.Millisecond)
+	if n := testutil.CollectAndCount(nodeOperationsTotal); n != operations {
+		t.Errorf("Other RPCs are counted as node operations: %d series, expected %d", n, operations)
+	}
+}
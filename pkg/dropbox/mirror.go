@@ -0,0 +1,214 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Values of the syncMode attribute
+const (
+	syncModeKey = "syncMode"
+	// The backend serves the volume from Dropbox, with its cache
+	syncModeMount = "mount"
+	// The volume is a full local copy of its folder, synced with Dropbox
+	// in the background
+	syncModeMirror = "mirror"
+)
+
+// Time given to the last sync of a mirror when it is unmounted
+const mirrorFinalSyncTimeout = 5 * time.Minute
+
+// mirror keeps a local copy of a Dropbox folder in sync with rclone bisync,
+// or rclone sync for read-only volumes. The copy is bind mounted to the
+// staging path, so the volume keeps working while Dropbox is unreachable,
+// and its writes reach Dropbox on the next successful sync.
+type mirror struct {
+	cmd        *fuseCommand
+	configPath string
+	// Folder in Dropbox and its copy
+	remotePath string
+	localPath  string
+	// Directory of the listings bisync compares the copies with
+	workDir  string
+	readOnly bool
+	args     []string
+	env      []string
+
+	// Serializes syncs of the loop and of the unmount
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// mirrors are the mirrors of an rclone backend by staging path.
+type mirrors struct {
+	mu      sync.Mutex
+	mirrors map[string]*mirror
+}
+
+func isMirror(volCtx map[string]string) bool {
+	return volCtx[syncModeKey] == syncModeMirror
+}
+
+func validateSyncMode(volCtx map[string]string) error {
+	switch volCtx[syncModeKey] {
+	case "", syncModeMount:
+	case syncModeMirror:
+		if isPathTemplate(volCtx["path"]) {
+			return fmt.Errorf("A mirrored volume can't have a path template")
+		}
+	default:
+		return fmt.Errorf("Unknown syncMode %q, must be %s or %s", volCtx[syncModeKey], syncModeMount, syncModeMirror)
+	}
+	return nil
+}
+
+// mountMirror syncs the copy of the path of the volume in req.CacheDir with
+// Dropbox and bind mounts it to req.MountPath. A copy synced before, e.g.
+// before a restart of the driver, is mounted even if Dropbox is unreachable.
+// The copy is then synced every MirrorSyncInterval until it is unmounted.
+func (b *rcloneBackend) mountMirror(ctx context.Context, req *mountRequest, remote string, args []string) error {
+	subPath := path.Clean("/" + req.VolumeContext["path"])
+	localRoot := path.Join(req.CacheDir, "mirror")
+	m := &mirror{
+		cmd:        b.cmd,
+		configPath: rcloneConfigPath(req.ConfigDir),
+		remotePath: remote + ":" + subPath,
+		localPath:  path.Join(localRoot, subPath),
+		workDir:    path.Join(req.CacheDir, "bisync"),
+		readOnly:   req.ReadOnly,
+		args:       args,
+		env:        req.Env,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, dir := range []string{m.localPath, m.workDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	synced := m.hasSynced()
+	if err := m.sync(ctx); err != nil {
+		if !synced {
+			return err
+		}
+		glog.Warningf("Can't sync mirror of %s, mounting the copy of the last sync: %v", m.remotePath, err)
+	}
+
+	options := []string{"bind"}
+	if req.ReadOnly {
+		options = append(options, "ro")
+	}
+	if err := b.cmd.mounter.Mount(localRoot, req.MountPath, "", options); err != nil {
+		return status.Errorf(codes.Internal, "Can't mount mirror %s to %s: %v", localRoot, req.MountPath, err)
+	}
+
+	b.mirrors.mu.Lock()
+	b.mirrors.mirrors[req.MountPath] = m
+	b.mirrors.mu.Unlock()
+	go m.run(b.cmd.cfg.MirrorSyncInterval)
+	return nil
+}
+
+// unmountMirror stops syncing the mirror at mountPath, syncs it a last time
+// so that no write is lost, and unmounts it. If the last sync fails, the
+// mirror is kept mounted and syncing.
+func (b *rcloneBackend) unmountMirror(mountPath string) error {
+	b.mirrors.mu.Lock()
+	m, ok := b.mirrors.mirrors[mountPath]
+	b.mirrors.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorFinalSyncTimeout)
+	defer cancel()
+	if err := m.sync(ctx); err != nil {
+		st := status.Convert(err)
+		return status.Errorf(st.Code(), "Can't sync writes of mirror to Dropbox before unmounting: %s", st.Message())
+	}
+
+	close(m.stop)
+	<-m.done
+	b.mirrors.mu.Lock()
+	delete(b.mirrors.mirrors, mountPath)
+	b.mirrors.mu.Unlock()
+	return nil
+}
+
+// run syncs the mirror every interval until it is stopped. Failed syncs,
+// e.g. while Dropbox is unreachable, are retried on the next interval.
+func (m *mirror) run(interval time.Duration) {
+	defer close(m.done)
+	if interval <= 0 {
+		<-m.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := m.sync(context.Background()); err != nil {
+			glog.Warningf("Can't sync mirror of %s: %v", m.remotePath, err)
+		}
+	}
+}
+
+// sync runs a sync of the mirror. The first bisync of a copy resyncs, which
+// merges the copies.
+func (m *mirror) sync(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var args []string
+	if m.readOnly {
+		args = []string{"sync", m.remotePath, m.localPath}
+	} else {
+		args = []string{"bisync", m.remotePath, m.localPath, "--workdir", m.workDir}
+		if !m.hasSynced() {
+			args = append(args, "--resync")
+		}
+	}
+	args = append(args, "--config", m.configPath)
+	args = append(args, m.args...)
+
+	start := time.Now()
+	_, stderr, err := m.cmd.runner.Run(ctx, m.env, m.cmd.command(), args...)
+	if err != nil {
+		switch {
+		case containsAny(stderr, m.cmd.authErrors):
+			return status.Errorf(codes.Unauthenticated, "Dropbox authentication failed, check the token: %s", stderr)
+		case ctx.Err() != nil:
+			return status.Errorf(codes.DeadlineExceeded, "Sync of %s timed out", m.remotePath)
+		}
+		return status.Errorf(m.cmd.failureCode(stderr), "Can't sync %s: %v: %s", m.remotePath, err, stderr)
+	}
+	glog.V(4).Infof("Mirror of %s is synced in %v", m.remotePath, time.Since(start))
+	return nil
+}
+
+// hasSynced tells whether the copy was synced before. bisync keeps the
+// listings of the last sync in its work dir.
+func (m *mirror) hasSynced() bool {
+	if m.readOnly {
+		entries, err := ioutil.ReadDir(m.localPath)
+		return err == nil && len(entries) > 0
+	}
+	entries, err := ioutil.ReadDir(m.workDir)
+	return err == nil && len(entries) > 0
+}
@@ -0,0 +1,272 @@
+package dropbox
+
+import (
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// Upper bound of the backoff between remounts of a dead volume
+const maxRemountBackoff = 5 * time.Minute
+
+// remountBackoff delays the next remount of a volume after failed ones.
+type remountBackoff struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// monitorMounts checks the mounts of staged volumes every HealthCheckInterval
+// and remounts the dead ones until the node server shuts down.
+func (n *nodeServer) monitorMounts() {
+	if n.cfg.HealthCheckInterval <= 0 {
+		return
+	}
+
+	// Only used by this goroutine
+	backoffs := map[string]*remountBackoff{}
+
+	ticker := time.NewTicker(n.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+			n.checkMounts(backoffs)
+		}
+	}
+}
+
+func (n *nodeServer) checkMounts(backoffs map[string]*remountBackoff) {
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	n.volumesMu.Unlock()
+
+	staged := map[string]bool{}
+	for _, vol := range volumes {
+		staged[vol.VolumeID] = true
+
+		healthy, reason := n.isMountHealthy(vol)
+		if healthy {
+			delete(backoffs, vol.VolumeID)
+			continue
+		}
+		// Left to the operator, it's reported in the volume condition
+		if n.gaveUp(vol.VolumeID) {
+			continue
+		}
+
+		b, ok := backoffs[vol.VolumeID]
+		if !ok {
+			b = &remountBackoff{interval: n.cfg.MountRetryInterval}
+			backoffs[vol.VolumeID] = b
+		}
+		if time.Now().Before(b.next) {
+			continue
+		}
+
+		// A volume with an operation in flight is checked on the next round
+		if !n.volumeLocks.tryAcquire(vol.VolumeID) {
+			continue
+		}
+		glog.Warningf("Mount of volume %s at %s is dead (%s), remounting", vol.VolumeID, vol.MountPath, reason)
+		err := n.remount(vol)
+		n.volumeLocks.release(vol.VolumeID)
+		if err != nil {
+			glog.Errorf("Can't remount volume %s, retrying in %v: %v", vol.VolumeID, b.interval, err)
+			b.next = time.Now().Add(b.interval)
+			b.interval *= 2
+			if b.interval > maxRemountBackoff {
+				b.interval = maxRemountBackoff
+			}
+			continue
+		}
+		glog.Infof("Volume %s is remounted at %s", vol.VolumeID, vol.MountPath)
+		delete(backoffs, vol.VolumeID)
+	}
+
+	for volumeID := range backoffs {
+		if !staged[volumeID] {
+			delete(backoffs, volumeID)
+		}
+	}
+}
+
+// reconcileVolumes checks the volumes recovered from the state dir against
+// the actual mounts after a restart of the driver. The state of a volume whose
+// staging path is gone is dropped, the refresh of the tokens of volumes with a
+// refresh token is resumed, and dead mounts are mounted again with the token
+// left in the config dir. Volumes which can't be remounted are left to
+// the monitor.
+func (n *nodeServer) reconcileVolumes() {
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	n.volumesMu.Unlock()
+
+	for _, vol := range volumes {
+		if !n.lockVolume(vol.VolumeID) {
+			return
+		}
+		n.reconcileVolume(vol)
+		n.volumeLocks.release(vol.VolumeID)
+	}
+}
+
+func (n *nodeServer) reconcileVolume(vol *volumeState) {
+	if _, err := os.Lstat(vol.MountPath); os.IsNotExist(err) {
+		glog.Warningf("Staging path %s of volume %s is gone, forgetting the volume", vol.MountPath, vol.VolumeID)
+		n.removeVolume(vol.VolumeID)
+		return
+	}
+
+	if err := n.resumeTokenRefresh(context.Background(), vol); err != nil {
+		glog.Errorf("Can't refresh token of recovered volume %s: %v", vol.VolumeID, err)
+	}
+
+	healthy, reason := n.isMountHealthy(vol)
+	if healthy && !isMirror(vol.VolumeContext) {
+		glog.Infof("Volume %s is still mounted at %s", vol.VolumeID, vol.MountPath)
+		return
+	}
+
+	if healthy {
+		// Mounting the mirror again resumes its syncs, its targets are
+		// bind mounts of the local copy and are not affected
+		glog.Infof("Resuming syncs of mirrored volume %s at %s", vol.VolumeID, vol.MountPath)
+	} else {
+		glog.Warningf("Mount of recovered volume %s at %s is dead (%s), remounting", vol.VolumeID, vol.MountPath, reason)
+	}
+	if err := n.remount(vol); err != nil {
+		glog.Errorf("Can't remount recovered volume %s: %v", vol.VolumeID, err)
+		return
+	}
+	glog.Infof("Recovered volume %s is remounted at %s", vol.VolumeID, vol.MountPath)
+}
+
+// isMountHealthy checks that the mount of vol is alive, and returns the reason
+// if it is not.
+func (n *nodeServer) isMountHealthy(vol *volumeState) (bool, string) {
+	if vol.Pid != 0 && processExited(vol.Pid) {
+		return false, "mount process exited"
+	}
+
+	notMnt, err := isNotMountPoint(n.mounter, vol.MountPath)
+	if err != nil {
+		if mount.IsCorruptedMnt(err) {
+			return false, err.Error()
+		}
+		return false, "can't check mount point: " + err.Error()
+	}
+	if notMnt {
+		return false, "not mounted"
+	}
+	return true, ""
+}
+
+// remount tears down the dead mount of vol and mounts it again with the
+// current token of the volume. The volume lock must be held.
+//
+// The targets the volume is published to are still bind mounts of the dead
+// mount, so they are bound again to the new one.
+func (n *nodeServer) remount(vol *volumeState) error {
+	// The volume may have been unstaged since it was checked
+	n.volumesMu.Lock()
+	_, staged := n.volumes[vol.VolumeID]
+	n.volumesMu.Unlock()
+	if !staged {
+		return nil
+	}
+
+	ctx := context.Background()
+	if err := n.mountSem.acquire(ctx); err != nil {
+		return err
+	}
+	defer n.mountSem.release()
+
+	backend := n.volumeBackend(vol.VolumeID)
+	if err := backend.Unmount(vol.MountPath); err != nil {
+		return err
+	}
+
+	token, err := readVolumeToken(vol)
+	if err != nil {
+		return err
+	}
+
+	configDir := vol.ConfigDir
+	if configDir == "" {
+		configDir = n.volumeConfigDir(vol.VolumeID)
+	}
+	owner, err := mountOwnerFromVolumeContext(vol.VolumeContext, vol.MountGroup, n.cfg)
+	if err != nil {
+		return err
+	}
+	owner.SELinuxContext = vol.SELinuxContext
+	req := &mountRequest{
+		MountPath:     vol.MountPath,
+		ConfigDir:     configDir,
+		CacheDir:      n.volumeCacheDir(vol.VolumeID),
+		Token:         token,
+		ReadOnly:      vol.ReadOnly,
+		Owner:         owner,
+		VolumeContext: vol.VolumeContext,
+		Env:           n.mountEnv(vol.VolumeID),
+		VolumeID:      vol.VolumeID,
+		OnExit:        n.mountExitHandler(vol.VolumeID),
+	}
+	var pid int
+	if vol.SharedMount != "" {
+		// Mounts the shared mount again if it's dead too
+		pid, err = n.mountShared(ctx, backend, vol.SharedMount, vol.VolumeID, req)
+	} else {
+		pid, err = backend.Mount(ctx, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.updateVolume(vol.VolumeID, func(vol *volumeState) {
+		vol.Pid = pid
+	})
+	if vol, ok := n.stagedVolume(vol.VolumeID); ok {
+		n.rebindTargets(vol)
+	}
+	return nil
+}
+
+// rebindTargets unmounts the stale bind mounts of the targets of vol and binds
+// them again with their recorded options. Targets made read-only at the
+// capacity of the volume stay read-only. Failures are logged, the pods of the
+// target have to be restarted then.
+func (n *nodeServer) rebindTargets(vol *volumeState) {
+	for _, target := range vol.Targets {
+		m, ok := vol.TargetMounts[target]
+		if !ok {
+			glog.Warningf("Can't bind %s of volume %s again, its bind mount isn't recorded", target, vol.VolumeID)
+			continue
+		}
+		options := append([]string(nil), m.Options...)
+		if contains(vol.CapacityReadOnlyTargets, target) && !contains(options, "ro") {
+			options = append(options, "ro")
+		}
+
+		if err := n.mounter.Unmount(target); err != nil {
+			glog.Errorf("Can't unmount stale %s of volume %s: %v", target, vol.VolumeID, err)
+			continue
+		}
+		if err := n.mounter.Mount(m.Source, target, "", options); err != nil {
+			glog.Errorf("Can't bind %s of volume %s again: %v", target, vol.VolumeID, err)
+			continue
+		}
+		glog.Infof("Bound %s of volume %s again", target, vol.VolumeID)
+	}
+}
@@ -0,0 +1,87 @@
+package dropbox
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"k8s.io/utils/mount"
+)
+
+func TestRemountBindsTargetsAgain(t *testing.T) {
+	n := newTestNodeServer(t, &Config{})
+	mounter := &optionsMounter{FakeMounter: mount.NewFakeMounter(nil), options: map[string][]string{}}
+	useMounter(n, mounter)
+
+	dir := t.TempDir()
+	stagingPath := path.Join(dir, "staging")
+	configDir := path.Join(dir, "config")
+	if err := os.Mkdir(configDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := path.Join(dir, "token")
+	if err := writeFile(tokenFile, "token"); err != nil {
+		t.Fatal(err)
+	}
+	targets := map[string]targetMount{
+		path.Join(dir, "rw"):       {Source: stagingPath, Options: []string{"bind"}},
+		path.Join(dir, "ro"):       {Source: stagingPath, Options: []string{"bind", "ro"}},
+		path.Join(dir, "capacity"): {Source: path.Join(stagingPath, "sub"), Options: []string{"bind"}},
+	}
+	markStaged(n, "vol", stagingPath)
+	n.updateVolume("vol", func(vol *volumeState) {
+		vol.TokenPath = tokenFile
+		vol.ConfigDir = configDir
+		for target, m := range targets {
+			vol.Targets = append(vol.Targets, target)
+			vol.TargetMounts[target] = m
+		}
+		vol.CapacityReadOnlyTargets = []string{path.Join(dir, "capacity")}
+	})
+	for target, m := range targets {
+		mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: m.Source, Path: target, Opts: m.Options})
+	}
+
+	vol, _ := n.stagedVolume("vol")
+	if err := n.remount(vol); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		stagingPath:                {"bind"},
+		path.Join(dir, "rw"):       {"bind"},
+		path.Join(dir, "ro"):       {"bind", "ro"},
+		path.Join(dir, "capacity"): {"bind", "ro"},
+	}
+	if !reflect.DeepEqual(mounter.options, want) {
+		t.Errorf("Expected mounts %v, got %v", want, mounter.options)
+	}
+	if len(mounter.MountPoints) != len(want) {
+		t.Errorf("Expected %d mounts, got %v", len(want), mounter.MountPoints)
+	}
+
+	unmounted := map[string]bool{}
+	for _, action := range mounter.GetLog() {
+		if action.Action == mount.FakeActionUnmount {
+			unmounted[action.Target] = true
+		}
+	}
+	for target := range targets {
+		if !unmounted[target] {
+			t.Errorf("Stale bind mount of %s isn't unmounted", target)
+		}
+	}
+}
+
+// optionsMounter records the options of the mounts, which FakeMounter
+// forgets on unmounts.
+type optionsMounter struct {
+	*mount.FakeMounter
+	options map[string][]string
+}
+
+func (m *optionsMounter) Mount(source, target, fstype string, options []string) error {
+	m.options[target] = options
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
@@ -0,0 +1,207 @@
+package dropbox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Options allowed on the bind mount of a published volume
+var allowedMountOptions = []string{
+	"bind", "ro", "rw",
+	"exec", "noexec", "suid", "nosuid", "dev", "nodev",
+	"sync", "async", "atime", "noatime", "relatime", "nodiratime",
+	"shared", "rshared", "slave", "rslave", "private", "rprivate", "unbindable", "runbindable",
+}
+
+// Prefix of the SELinux context option kubelet adds to the mount flags when
+// the CSIDriver has seLinuxMount set, e.g. context="system_u:object_r:..."
+const seLinuxContextPrefix = "context="
+
+// Mount options of a persistent volume passed to its backend mount, and the
+// volume context key each one sets. Options without a value set "true".
+var backendMountOptions = map[string]string{
+	"uid":                 "uid",
+	"gid":                 "gid",
+	"file_mode":           "fileMode",
+	"dir_mode":            "dirMode",
+	"umask":               umaskKey,
+	"allow_other":         allowOtherKey,
+	"default_permissions": defaultPermsKey,
+	"cache_mode":          "cacheMode",
+	"cache_max_size":      "cacheMaxSize",
+	"cache_max_age":       "cacheMaxAge",
+	"bwlimit_upload":      "bwLimitUpload",
+	"bwlimit_download":    "bwLimitDownload",
+}
+
+// Backend mount option setting both bandwidth limits, like rclone --bwlimit
+const bwLimitMountOption = "bwlimit"
+
+// Options that can't be set together on the same mount
+var conflictingMountOptions = [][]string{
+	{"ro", "rw"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+	{"dev", "nodev"},
+	{"sync", "async"},
+	{"atime", "noatime"},
+	{"shared", "rshared", "slave", "rslave", "private", "rprivate", "unbindable", "runbindable"},
+}
+
+// normalizeMountOptions removes duplicated options while keeping the order and
+// returns an error if the options conflict with each other.
+func normalizeMountOptions(options []string) ([]string, error) {
+	var normalized []string
+	seen := map[string]bool{}
+
+	for _, opt := range options {
+		if opt == "" || seen[opt] {
+			continue
+		}
+		if conflict := findConflict(normalized, opt); conflict != "" {
+			return nil, fmt.Errorf("Mount option %q conflicts with %q", opt, conflict)
+		}
+		seen[opt] = true
+		normalized = append(normalized, opt)
+	}
+
+	return normalized, nil
+}
+
+// mergeMountOptions merges mount options from several sources, earlier
+// sources taking precedence: an option conflicting with one from an earlier
+// source is dropped, while conflicts inside a single source are errors. The
+// merged options must be in allowedMountOptions.
+func mergeMountOptions(sources ...[]string) ([]string, error) {
+	var merged []string
+
+	for _, source := range sources {
+		options, err := normalizeMountOptions(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, opt := range options {
+			if !contains(allowedMountOptions, opt) && !strings.HasPrefix(opt, seLinuxContextPrefix) {
+				return nil, fmt.Errorf("Mount option %q is not allowed", opt)
+			}
+			if conflict := findConflict(merged, opt); conflict != "" {
+				glog.Warningf("Mount option %q is overridden by %q", opt, conflict)
+				continue
+			}
+			if !contains(merged, opt) {
+				merged = append(merged, opt)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// volumeContextFromMountFlags returns a copy of volCtx with the backend
+// options in flags, which take precedence over the volume attributes.
+func volumeContextFromMountFlags(volCtx map[string]string, flags []string) (map[string]string, error) {
+	merged := map[string]string{}
+	for k, v := range volCtx {
+		merged[k] = v
+	}
+	for _, flag := range flags {
+		opt, value, hasValue := splitMountOption(flag)
+		if opt == bwLimitMountOption {
+			// UP:DOWN, or one limit for both
+			if !hasValue {
+				return nil, fmt.Errorf("Mount option %s requires a value", opt)
+			}
+			limits := strings.SplitN(value, ":", 2)
+			merged["bwLimitUpload"] = limits[0]
+			merged["bwLimitDownload"] = limits[len(limits)-1]
+			continue
+		}
+		key, ok := backendMountOptions[opt]
+		if !ok {
+			continue
+		}
+		if !hasValue {
+			if key != allowOtherKey && key != defaultPermsKey {
+				return nil, fmt.Errorf("Mount option %s requires a value", opt)
+			}
+			value = "true"
+		}
+		merged[key] = value
+	}
+	return merged, nil
+}
+
+// bindMountFlags returns the mount flags which are not passed to the backend.
+func bindMountFlags(flags []string) []string {
+	var options []string
+	for _, flag := range flags {
+		opt, _, _ := splitMountOption(flag)
+		if _, ok := backendMountOptions[opt]; ok || opt == bwLimitMountOption {
+			continue
+		}
+		options = append(options, flag)
+	}
+	return options
+}
+
+// splitMountOption splits an option like uid=1000 into its name and value.
+func splitMountOption(opt string) (string, string, bool) {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// splitMountOptions splits comma separated mount options like "ro,noexec".
+func splitMountOptions(s string) []string {
+	var options []string
+	for _, opt := range strings.Split(s, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			options = append(options, opt)
+		}
+	}
+	return options
+}
+
+// seLinuxContextOption returns the context= option in options, or "" if
+// there is none.
+func seLinuxContextOption(options []string) string {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, seLinuxContextPrefix) {
+			return opt
+		}
+	}
+	return ""
+}
+
+func findConflict(options []string, opt string) string {
+	// A mount has a single SELinux context
+	if strings.HasPrefix(opt, seLinuxContextPrefix) {
+		if other := seLinuxContextOption(options); other != "" && other != opt {
+			return other
+		}
+	}
+	for _, group := range conflictingMountOptions {
+		if !contains(group, opt) {
+			continue
+		}
+		for _, other := range group {
+			if other != opt && contains(options, other) {
+				return other
+			}
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package dropbox
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"k8s.io/utils/mount"
+)
+
+func TestNormalizeMountOptions(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		options    []string
+		normalized []string
+		fails      bool
+	}{
+		{
+			name:       "no duplicates",
+			options:    []string{"bind", "ro"},
+			normalized: []string{"bind", "ro"},
+		},
+		{
+			name:       "duplicates keep the first occurrence",
+			options:    []string{"bind", "ro", "bind", "", "noexec", "ro"},
+			normalized: []string{"bind", "ro", "noexec"},
+		},
+		{
+			name:    "read-only and read-write",
+			options: []string{"bind", "ro", "rw"},
+			fails:   true,
+		},
+		{
+			name:    "exec and noexec",
+			options: []string{"bind", "exec", "noexec"},
+			fails:   true,
+		},
+		{
+			name:    "two propagations",
+			options: []string{"bind", "rshared", "private"},
+			fails:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			normalized, err := normalizeMountOptions(test.options)
+			if (err != nil) != test.fails {
+				t.Fatalf("Expected failure %t, got %v", test.fails, err)
+			}
+			if !reflect.DeepEqual(normalized, test.normalized) {
+				t.Errorf("Expected %q, got %q", test.normalized, normalized)
+			}
+		})
+	}
+}
+
+func TestMergeMountOptions(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		sources [][]string
+		merged  []string
+		fails   bool
+	}{
+		{
+			name:    "disjoint sources",
+			sources: [][]string{{"ro"}, {"noexec", "nosuid"}},
+			merged:  []string{"ro", "noexec", "nosuid"},
+		},
+		{
+			name:    "duplicates across and inside sources",
+			sources: [][]string{{"ro", "ro", ""}, {"ro", "noatime"}, {"noatime"}},
+			merged:  []string{"ro", "noatime"},
+		},
+		{
+			name:    "earlier source takes precedence",
+			sources: [][]string{{"ro", "noexec"}, {"rw", "exec", "nodev"}},
+			merged:  []string{"ro", "noexec", "nodev"},
+		},
+		{
+			name:    "propagation of earlier source takes precedence",
+			sources: [][]string{{"rslave"}, {"shared", "nosuid"}},
+			merged:  []string{"rslave", "nosuid"},
+		},
+		{
+			name:    "conflict inside a source",
+			sources: [][]string{{"ro"}, {"exec", "noexec"}},
+			fails:   true,
+		},
+		{
+			name:    "conflict inside the first source",
+			sources: [][]string{{"ro", "rw"}, {"noexec"}},
+			fails:   true,
+		},
+		{
+			name:    "option not allowed",
+			sources: [][]string{{"ro"}, {"remount"}},
+			fails:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			merged, err := mergeMountOptions(test.sources...)
+			if (err != nil) != test.fails {
+				t.Fatalf("Expected failure %t, got %v", test.fails, err)
+			}
+			if !reflect.DeepEqual(merged, test.merged) {
+				t.Errorf("Expected %q, got %q", test.merged, merged)
+			}
+		})
+	}
+}
+
+func TestPublishMountOptions(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		readonly     bool
+		flags        []string
+		mountOptions string
+		options      []string
+		fails        bool
+	}{
+		{
+			name:    "duplicated flags",
+			flags:   []string{"noexec", "noexec", "nosuid", "bind"},
+			options: []string{"bind", "noexec", "nosuid"},
+		},
+		{
+			name:         "flags duplicated in mountOptions",
+			flags:        []string{"noatime"},
+			mountOptions: "noatime,nodev",
+			options:      []string{"bind", "noatime", "nodev"},
+		},
+		{
+			name:         "readonly request overrides flags and mountOptions",
+			readonly:     true,
+			flags:        []string{"rw", "noexec"},
+			mountOptions: "rw,exec",
+			options:      []string{"bind", "ro", "noexec"},
+		},
+		{
+			name:  "conflicting flags",
+			flags: []string{"exec", "noexec"},
+			fails: true,
+		},
+		{
+			name:         "conflicting mountOptions",
+			mountOptions: "ro,rw",
+			fails:        true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := NewNodeServer(&Config{})
+			mounter := mount.NewFakeMounter(nil)
+			n.mounter = mounter
+			dir := t.TempDir()
+			stagingPath, targetPath := path.Join(dir, "staging"), path.Join(dir, "target")
+			if err := os.Mkdir(stagingPath, 0750); err != nil {
+				t.Fatal(err)
+			}
+			markStaged(n, "options", stagingPath)
+			volCtx := map[string]string{}
+			if test.mountOptions != "" {
+				volCtx["mountOptions"] = test.mountOptions
+			}
+
+			capability := mountCapability()
+			capability.GetMount().MountFlags = test.flags
+
+			_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "options",
+				StagingTargetPath: stagingPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  capability,
+				VolumeContext:     volCtx,
+				Readonly:          test.readonly,
+			})
+			if test.fails {
+				expectCode(t, err, codes.InvalidArgument)
+				if log := mounter.GetLog(); len(log) != 0 {
+					t.Errorf("%s is mounted with conflicting options: %v", targetPath, log)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			mps, _ := mounter.List()
+			if len(mps) != 1 || mps[0].Path != targetPath {
+				t.Fatalf("%s is not mounted: %v", targetPath, mps)
+			}
+			if !reflect.DeepEqual(mps[0].Opts, test.options) {
+				t.Errorf("Expected options %q, got %q", test.options, mps[0].Opts)
+			}
+		})
+	}
+}
@@ -0,0 +1,735 @@
+package dropbox
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// How long the kernel caches the entries and attributes of a native mount
+const nativeCacheTimeout = time.Second
+
+// Block size reported by native mounts
+const nativeBlockSize = 4096
+
+// nativeBackend serves Dropbox mounts from the driver process with go-fuse and
+// the Dropbox API, so no mount command has to be installed. The mounts go
+// away when the driver restarts, and are mounted again by the monitor.
+type nativeBackend struct {
+	cfg     *Config
+	mounter mount.Interface
+
+	mu sync.Mutex
+	// Mounts served by the driver by mount path
+	mounts map[string]*nativeMount
+}
+
+type nativeMount struct {
+	server    *fuse.Server
+	fsys      *nativeFS
+	configDir string
+	// Set when the driver unmounts, the exit of the server is expected then
+	unmounting bool
+}
+
+func newNativeBackend(cfg *Config, mounter mount.Interface) *nativeBackend {
+	return &nativeBackend{
+		cfg:     cfg,
+		mounter: mounter,
+		mounts:  map[string]*nativeMount{},
+	}
+}
+
+func (b *nativeBackend) Name() string {
+	return backendNative
+}
+
+// Command is empty, the mounts are served by the driver itself.
+func (b *nativeBackend) Command() string {
+	return ""
+}
+
+// Mount checks the token with the Dropbox API and serves the mount from the
+// driver. The returned pid is always 0, req.OnExit is called if the mount
+// goes away without Unmount.
+func (b *nativeBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	if b.cfg.MountTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.MountTimeout)
+		defer cancel()
+	}
+	if err := b.WriteToken(req.ConfigDir, req.Token); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	fsys, err := newNativeFS(ctx, newAPIClient(b.cfg, req.Token).forVolume(req.VolumeID), req)
+	if err != nil {
+		return 0, b.mountError(req.MountPath, err)
+	}
+
+	timeout := nativeCacheTimeout
+	opts := &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther:  req.Owner.AllowOther,
+			FsName:      "dropbox",
+			Name:        "dropbox-" + backendNative,
+			DirectMount: true,
+		},
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+		UID:             fsys.uid,
+		GID:             fsys.gid,
+	}
+	if req.ReadOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	if req.Owner.DefaultPermissions {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "default_permissions")
+	}
+	server, err := fs.Mount(req.MountPath, &nativeNode{fsys: fsys}, opts)
+	mountDuration.WithLabelValues(backendNative).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return 0, b.mountError(req.MountPath, status.Errorf(codes.Internal, "Can't mount %s: %v", backendNative, err))
+	}
+
+	m := &nativeMount{server: server, fsys: fsys, configDir: req.ConfigDir}
+	b.mu.Lock()
+	b.mounts[req.MountPath] = m
+	b.mu.Unlock()
+	glog.V(4).Infof("dropbox-csi: volume %s is mounted by %s", req.MountPath, backendNative)
+
+	go func() {
+		server.Wait()
+		b.mu.Lock()
+		if b.mounts[req.MountPath] == m {
+			delete(b.mounts, req.MountPath)
+		}
+		unmounting := m.unmounting
+		b.mu.Unlock()
+		if !unmounting && req.OnExit != nil {
+			req.OnExit(0, fmt.Errorf("%s was unmounted", req.MountPath), "")
+		}
+	}()
+	return 0, nil
+}
+
+// mountError records the failed mount of mountPath with the gRPC error err.
+func (b *nativeBackend) mountError(mountPath string, err error) error {
+	glog.Errorf("Can't mount %s %s: %v", backendNative, mountPath, err)
+	mountFailuresTotal.WithLabelValues(backendNative, status.Code(err).String()).Inc()
+	return err
+}
+
+// Unmount stops serving mountPath. Mounts left by a previous run of the
+// driver are unmounted with the mounter.
+func (b *nativeBackend) Unmount(mountPath string) error {
+	b.mu.Lock()
+	m := b.mounts[mountPath]
+	if m != nil {
+		m.unmounting = true
+	}
+	b.mu.Unlock()
+	if m == nil {
+		return unmountIfMounted(b.mounter, mountPath)
+	}
+
+	if err := m.server.Unmount(); err != nil {
+		b.mu.Lock()
+		m.unmounting = false
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Lock()
+	if b.mounts[mountPath] == m {
+		delete(b.mounts, mountPath)
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// WriteToken writes the token file and switches the mounts using configDir
+// to the token.
+func (b *nativeBackend) WriteToken(configDir, token string) error {
+	if err := writeFile(tokenPath(configDir), token); err != nil {
+		glog.Errorf("Can't create %s token file: %v", backendNative, err)
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.mounts {
+		if m.configDir == configDir {
+			m.fsys.setToken(token)
+		}
+	}
+	return nil
+}
+
+func (b *nativeBackend) RemoveConfig(configDir string) error {
+	return shredFiles(tokenPath(configDir))
+}
+
+func (b *nativeBackend) Stats(mountPath string) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(mountPath)
+}
+
+// nativeFS is the state shared by the nodes of a native mount.
+type nativeFS struct {
+	mu     sync.RWMutex
+	client *apiClient
+
+	// Directory for the write buffers of open files
+	cacheDir          string
+	uid, gid          uint32
+	fileMode, dirMode uint32
+}
+
+// newNativeFS returns the filesystem of req, after checking that its token
+// is accepted by Dropbox. It fails with a gRPC error.
+func newNativeFS(ctx context.Context, client *apiClient, req *mountRequest) (*nativeFS, error) {
+	fsys := &nativeFS{
+		cacheDir: req.CacheDir,
+		fileMode: 0644,
+		dirMode:  0755,
+	}
+	var umask uint32
+	for _, id := range []struct {
+		value string
+		field *uint32
+		base  int
+	}{
+		{req.Owner.UID, &fsys.uid, 10},
+		{req.Owner.GID, &fsys.gid, 10},
+		{req.Owner.FileMode, &fsys.fileMode, 8},
+		{req.Owner.DirMode, &fsys.dirMode, 8},
+		{req.Owner.Umask, &umask, 8},
+	} {
+		if id.value == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(id.value, id.base, 32)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		*id.field = uint32(v)
+	}
+	fsys.fileMode &^= umask
+	fsys.dirMode &^= umask
+	if err := os.MkdirAll(fsys.cacheDir, 0700); err != nil {
+		return nil, fsStatusError(err, "Can't create the cache dir")
+	}
+
+	client, err := client.inTeamSpace(ctx, teamSpaceFrom(req.VolumeContext))
+	if err != nil {
+		return nil, apiStatusError(err, "Can't look up the team member")
+	}
+	if _, err := client.getCurrentAccount(ctx); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, apiStatusError(err, "Can't check the token")
+	}
+	fsys.client = client
+	return fsys, nil
+}
+
+func (f *nativeFS) api() *apiClient {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.client
+}
+
+func (f *nativeFS) setToken(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	client := *f.client
+	client.token = token
+	f.client = &client
+}
+
+// nativeNode is a file or folder of a native mount. Its Dropbox path follows
+// from its place in the tree.
+type nativeNode struct {
+	fs.Inode
+	fsys *nativeFS
+
+	mu    sync.Mutex
+	size  uint64
+	mtime time.Time
+}
+
+var (
+	_ fs.NodeGetattrer = (*nativeNode)(nil)
+	_ fs.NodeSetattrer = (*nativeNode)(nil)
+	_ fs.NodeLookuper  = (*nativeNode)(nil)
+	_ fs.NodeReaddirer = (*nativeNode)(nil)
+	_ fs.NodeOpener    = (*nativeNode)(nil)
+	_ fs.NodeCreater   = (*nativeNode)(nil)
+	_ fs.NodeMkdirer   = (*nativeNode)(nil)
+	_ fs.NodeUnlinker  = (*nativeNode)(nil)
+	_ fs.NodeRmdirer   = (*nativeNode)(nil)
+	_ fs.NodeRenamer   = (*nativeNode)(nil)
+	_ fs.NodeStatfser  = (*nativeNode)(nil)
+)
+
+// dropboxPath returns the path of the node in Dropbox, "" for the root. It
+// fails with ENOENT once the node is removed from the tree.
+func (n *nativeNode) dropboxPath() (string, syscall.Errno) {
+	p := ""
+	for node := n.EmbeddedInode(); !node.IsRoot(); {
+		name, parent := node.Parent()
+		if parent == nil {
+			return "", syscall.ENOENT
+		}
+		p = "/" + name + p
+		node = parent
+	}
+	return p, 0
+}
+
+func (n *nativeNode) childPath(name string) (string, syscall.Errno) {
+	p, errno := n.dropboxPath()
+	return p + "/" + name, errno
+}
+
+func (n *nativeNode) setMetadata(m *metadata) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.size = m.Size
+	n.mtime = m.ServerModified
+}
+
+func (n *nativeNode) setSize(size uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.size = size
+	n.mtime = time.Now()
+}
+
+func (n *nativeNode) getSize() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.size
+}
+
+func (n *nativeNode) fillAttr(out *fuse.Attr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.IsDir() {
+		out.Mode = syscall.S_IFDIR | n.fsys.dirMode
+	} else {
+		out.Mode = syscall.S_IFREG | n.fsys.fileMode
+		out.Size = n.size
+		out.Blocks = (n.size + 511) / 512
+	}
+	out.Nlink = 1
+	out.Uid = n.fsys.uid
+	out.Gid = n.fsys.gid
+	if !n.mtime.IsZero() {
+		out.SetTimes(nil, &n.mtime, &n.mtime)
+	}
+}
+
+// child returns the inode of the entry m in the node, reusing the known
+// inode of the name if it has the same type.
+func (n *nativeNode) child(ctx context.Context, name string, m *metadata) *fs.Inode {
+	mode := uint32(syscall.S_IFREG)
+	if m.Tag == "folder" {
+		mode = syscall.S_IFDIR
+	}
+	if existing := n.GetChild(name); existing != nil && existing.Mode() == mode {
+		existing.Operations().(*nativeNode).setMetadata(m)
+		return existing
+	}
+
+	node := &nativeNode{fsys: n.fsys}
+	node.setMetadata(m)
+	return n.NewInode(ctx, node, fs.StableAttr{Mode: mode})
+}
+
+func (n *nativeNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	if file, ok := f.(*nativeFile); ok {
+		if size, ok := file.bufferedSize(); ok {
+			out.Size = size
+		}
+	}
+	return 0
+}
+
+// Setattr truncates files. Changes of the mode, owner and times are
+// ignored, Dropbox has no place for them.
+func (n *nativeNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok && !n.IsDir() {
+		file, ok := f.(*nativeFile)
+		if !ok || file.buffer == nil {
+			var errno syscall.Errno
+			if file, errno = n.openBuffer(ctx, size > 0); errno != 0 {
+				return errno
+			}
+			defer file.Release(ctx)
+		}
+		if errno := file.truncate(size); errno != 0 {
+			return errno
+		}
+		if errno := file.Flush(ctx); errno != 0 {
+			return errno
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *nativeNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	m, err := n.fsys.api().getMetadata(ctx, p)
+	if err != nil {
+		return nil, apiErrno(err)
+	}
+	child := n.child(ctx, name, m)
+	child.Operations().(*nativeNode).fillAttr(&out.Attr)
+	return child, 0
+}
+
+func (n *nativeNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	p, errno := n.dropboxPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	entries, err := n.fsys.api().listFolder(ctx, p)
+	if err != nil {
+		return nil, apiErrno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		mode := uint32(syscall.S_IFREG)
+		if e.Tag == "folder" {
+			mode = syscall.S_IFDIR
+		}
+		list = append(list, fuse.DirEntry{Name: e.Name, Mode: mode})
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+// Open reads files with ranged downloads. Files opened for writing are
+// buffered in the cache dir and uploaded when they are flushed.
+func (n *nativeNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return &nativeFile{node: n}, 0, 0
+	}
+	file, errno := n.openBuffer(ctx, flags&syscall.O_TRUNC == 0)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		file.dirty = true
+	}
+	return file, 0, 0
+}
+
+// openBuffer returns a file writing to a buffer, holding the current
+// contents of the file if load is set.
+func (n *nativeNode) openBuffer(ctx context.Context, load bool) (*nativeFile, syscall.Errno) {
+	var data []byte
+	if load {
+		p, errno := n.dropboxPath()
+		if errno != 0 {
+			return nil, errno
+		}
+		var err error
+		if data, err = n.fsys.api().download(ctx, p); err != nil {
+			return nil, apiErrno(err)
+		}
+	}
+
+	buffer, err := ioutil.TempFile(n.fsys.cacheDir, "write-")
+	if err != nil {
+		glog.Errorf("Can't create write buffer in %s: %v", n.fsys.cacheDir, err)
+		return nil, syscall.EIO
+	}
+	// The buffer is gone once closed
+	os.Remove(buffer.Name())
+
+	if data != nil {
+		if _, err := buffer.Write(data); err != nil {
+			buffer.Close()
+			return nil, syscall.EIO
+		}
+	}
+	return &nativeFile{node: n, buffer: buffer}, 0
+}
+
+// Create uploads an empty file, so that it exists in Dropbox before it is
+// written.
+func (n *nativeNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	p, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	if err := n.fsys.api().upload(ctx, p, nil); err != nil {
+		return nil, nil, 0, apiErrno(err)
+	}
+	node := &nativeNode{fsys: n.fsys, mtime: time.Now()}
+	child := n.NewInode(ctx, node, fs.StableAttr{Mode: syscall.S_IFREG})
+	file, errno := node.openBuffer(ctx, false)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	node.fillAttr(&out.Attr)
+	return child, file, 0, 0
+}
+
+func (n *nativeNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	if err := n.fsys.api().createFolder(ctx, p); err != nil {
+		return nil, apiErrno(err)
+	}
+	child := n.child(ctx, name, &metadata{Tag: "folder", Name: name})
+	child.Operations().(*nativeNode).fillAttr(&out.Attr)
+	return child, 0
+}
+
+func (n *nativeNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	p, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	return apiErrno(n.fsys.api().remove(ctx, p))
+}
+
+// Rmdir removes an empty folder, Dropbox would delete a folder with all its
+// entries.
+func (n *nativeNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	entries, err := n.fsys.api().listFolder(ctx, p)
+	if err != nil {
+		return apiErrno(err)
+	}
+	if len(entries) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return apiErrno(n.fsys.api().remove(ctx, p))
+}
+
+// Rename moves the entry on the server. Like rename(2), it replaces a file
+// at the new path unless RENAME_NOREPLACE is given.
+func (n *nativeNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	parent, ok := newParent.(*nativeNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	from, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	to, errno := parent.childPath(newName)
+	if errno != 0 {
+		return errno
+	}
+
+	api := n.fsys.api()
+	err := api.move(ctx, from, to)
+	if isAPIConflict(err) && flags&unix.RENAME_NOREPLACE == 0 {
+		if m, mErr := api.getMetadata(ctx, to); mErr == nil && m.Tag == "file" {
+			if err = api.remove(ctx, to); err == nil {
+				err = api.move(ctx, from, to)
+			}
+		}
+	}
+	return apiErrno(err)
+}
+
+// Statfs reports the space of the Dropbox account.
+func (n *nativeNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	usage, err := n.fsys.api().getSpaceUsage(ctx)
+	if err != nil {
+		return apiErrno(err)
+	}
+	out.Bsize = nativeBlockSize
+	out.Frsize = nativeBlockSize
+	out.NameLen = 255
+	out.Blocks = usage.Allocation.Allocated / nativeBlockSize
+	out.Bfree = usage.available() / nativeBlockSize
+	out.Bavail = out.Bfree
+	return 0
+}
+
+// nativeFile is an open file of a native mount. Files opened for writing
+// have a buffer.
+type nativeFile struct {
+	node *nativeNode
+
+	mu     sync.Mutex
+	buffer *os.File
+	// Set when the buffer has changes which are not uploaded
+	dirty bool
+}
+
+var (
+	_ fs.FileReader   = (*nativeFile)(nil)
+	_ fs.FileWriter   = (*nativeFile)(nil)
+	_ fs.FileFlusher  = (*nativeFile)(nil)
+	_ fs.FileFsyncer  = (*nativeFile)(nil)
+	_ fs.FileReleaser = (*nativeFile)(nil)
+)
+
+// bufferedSize returns the size of the buffer, if the file has one.
+func (f *nativeFile) bufferedSize() (uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buffer == nil {
+		return 0, false
+	}
+	info, err := f.buffer.Stat()
+	if err != nil {
+		return 0, false
+	}
+	return uint64(info.Size()), true
+}
+
+func (f *nativeFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buffer != nil {
+		n, err := f.buffer.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			return nil, syscall.EIO
+		}
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+
+	size := int64(f.node.getSize())
+	if off >= size {
+		return fuse.ReadResultData(nil), 0
+	}
+	length := int64(len(dest))
+	if off+length > size {
+		length = size - off
+	}
+	p, errno := f.node.dropboxPath()
+	if errno != 0 {
+		return nil, errno
+	}
+	data, err := f.node.fsys.api().downloadRange(ctx, p, off, length)
+	if err != nil {
+		return nil, apiErrno(err)
+	}
+	return fuse.ReadResultData(data), 0
+}
+
+func (f *nativeFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buffer == nil {
+		return 0, syscall.EBADF
+	}
+	n, err := f.buffer.WriteAt(data, off)
+	if n > 0 {
+		f.dirty = true
+	}
+	if err != nil {
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), 0
+}
+
+func (f *nativeFile) truncate(size uint64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.buffer.Truncate(int64(size)); err != nil {
+		return syscall.EIO
+	}
+	f.dirty = true
+	return 0
+}
+
+// Flush uploads the buffer if it has changes.
+func (f *nativeFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return 0
+	}
+
+	info, err := f.buffer.Stat()
+	if err != nil {
+		return syscall.EIO
+	}
+	data := make([]byte, info.Size())
+	if _, err := f.buffer.ReadAt(data, 0); err != nil && err != io.EOF {
+		return syscall.EIO
+	}
+	p, errno := f.node.dropboxPath()
+	if errno != 0 {
+		return errno
+	}
+	if err := f.node.fsys.api().upload(ctx, p, data); err != nil {
+		return apiErrno(err)
+	}
+	f.dirty = false
+	f.node.setSize(uint64(len(data)))
+	return 0
+}
+
+func (f *nativeFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.Flush(ctx)
+}
+
+func (f *nativeFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buffer != nil {
+		f.buffer.Close()
+		f.buffer = nil
+	}
+	return 0
+}
+
+// apiErrno returns the errno of a failed Dropbox API request.
+func apiErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case isAPINotFound(err):
+		return syscall.ENOENT
+	case isAPIConflict(err):
+		return syscall.EEXIST
+	case isAPIAuthError(err):
+		return syscall.EACCES
+	case isAPIRateLimited(err):
+		return syscall.EAGAIN
+	case err == context.Canceled:
+		return syscall.EINTR
+	}
+	glog.Warningf("Dropbox API request of %s mount failed: %v", backendNative, err)
+	return syscall.EIO
+}
@@ -0,0 +1,407 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// memDropbox is a Dropbox API server keeping the files of an account in
+// memory. Folders are the keys with a nil value.
+type memDropbox struct {
+	token string
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemDropbox(t *testing.T, token string) (*memDropbox, *httptest.Server) {
+	d := &memDropbox{token: token, files: map[string][]byte{}}
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	return d, server
+}
+
+func (d *memDropbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var arg struct {
+		Path     string `json:"path"`
+		FromPath string `json:"from_path"`
+		ToPath   string `json:"to_path"`
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if h := r.Header.Get("Dropbox-API-Arg"); h != "" {
+		json.Unmarshal([]byte(h), &arg)
+	} else {
+		json.Unmarshal(body, &arg)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+d.token {
+		d.fail(w, http.StatusUnauthorized, "invalid_access_token/")
+		return
+	}
+	switch r.URL.Path {
+	case "/users/get_current_account":
+		d.reply(w, &account{AccountID: "dbid:1"})
+	case "/users/get_space_usage":
+		d.reply(w, map[string]interface{}{
+			"used":       4096,
+			"allocation": map[string]interface{}{".tag": "individual", "allocated": 40960},
+		})
+	case "/files/get_metadata":
+		data, ok := d.files[arg.Path]
+		if !ok {
+			d.fail(w, http.StatusConflict, "path/not_found/")
+			return
+		}
+		d.reply(w, memMetadata(arg.Path, data))
+	case "/files/list_folder":
+		if data, ok := d.files[arg.Path]; arg.Path != "" && (!ok || data != nil) {
+			d.fail(w, http.StatusConflict, "path/not_found/")
+			return
+		}
+		entries := []*metadata{}
+		for p, data := range d.files {
+			if path.Dir(p) == arg.Path || (arg.Path == "" && path.Dir(p) == "/") {
+				entries = append(entries, memMetadata(p, data))
+			}
+		}
+		d.reply(w, map[string]interface{}{"entries": entries})
+	case "/files/create_folder_v2":
+		if _, ok := d.files[arg.Path]; ok {
+			d.fail(w, http.StatusConflict, "path/conflict/folder/")
+			return
+		}
+		d.files[arg.Path] = nil
+		d.reply(w, nil)
+	case "/files/delete_v2":
+		if _, ok := d.files[arg.Path]; !ok {
+			d.fail(w, http.StatusConflict, "path_lookup/not_found/")
+			return
+		}
+		for p := range d.files {
+			if p == arg.Path || strings.HasPrefix(p, arg.Path+"/") {
+				delete(d.files, p)
+			}
+		}
+		d.reply(w, nil)
+	case "/files/move_v2":
+		if _, ok := d.files[arg.FromPath]; !ok {
+			d.fail(w, http.StatusConflict, "from_lookup/not_found/")
+			return
+		}
+		if _, ok := d.files[arg.ToPath]; ok {
+			d.fail(w, http.StatusConflict, "to/conflict/file/")
+			return
+		}
+		for p, data := range d.files {
+			if p == arg.FromPath || strings.HasPrefix(p, arg.FromPath+"/") {
+				delete(d.files, p)
+				d.files[arg.ToPath+strings.TrimPrefix(p, arg.FromPath)] = data
+			}
+		}
+		d.reply(w, nil)
+	case "/files/upload":
+		if body == nil {
+			body = []byte{}
+		}
+		d.files[arg.Path] = body
+		d.reply(w, memMetadata(arg.Path, body))
+	case "/files/download":
+		data, ok := d.files[arg.Path]
+		if !ok || data == nil {
+			d.fail(w, http.StatusConflict, "path/not_found/")
+			return
+		}
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 {
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Write(data)
+	default:
+		d.fail(w, http.StatusBadRequest, "unknown endpoint "+r.URL.Path)
+	}
+}
+
+func (d *memDropbox) reply(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (d *memDropbox) fail(w http.ResponseWriter, status int, summary string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error_summary": summary})
+}
+
+func memMetadata(p string, data []byte) *metadata {
+	if data == nil {
+		return &metadata{Tag: "folder", Name: path.Base(p), PathDisplay: p}
+	}
+	return &metadata{
+		Tag:            "file",
+		Name:           path.Base(p),
+		PathDisplay:    p,
+		Size:           uint64(len(data)),
+		ServerModified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func (d *memDropbox) get(p string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.files[p]
+	return data, ok
+}
+
+// newNativeTestBackend returns a native backend talking to server.
+func newNativeTestBackend(cfg *Config, server *httptest.Server) *nativeBackend {
+	cfg.DropboxAPIURL = server.URL
+	cfg.DropboxContentURL = server.URL
+	return newNativeBackend(cfg, mount.New(""))
+}
+
+// mountNative mounts the native backend to a temporary directory, skipping
+// the test where FUSE can't be mounted.
+func mountNative(t *testing.T, b *nativeBackend, token string, readonly bool, onExit func(int, error, string)) string {
+	if err := unix.Access(fuseDevice, unix.R_OK|unix.W_OK); err != nil || os.Geteuid() != 0 {
+		t.Skipf("FUSE mounts need root and %s", fuseDevice)
+	}
+	dir := t.TempDir()
+	mountPath := path.Join(dir, "mount")
+	configDir := path.Join(dir, "config")
+	for _, d := range []string{mountPath, configDir} {
+		if err := os.Mkdir(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := b.Mount(context.Background(), &mountRequest{
+		MountPath: mountPath,
+		ConfigDir: configDir,
+		CacheDir:  path.Join(dir, "cache"),
+		Token:     token,
+		ReadOnly:  readonly,
+		OnExit:    onExit,
+	})
+	if status.Code(err) == codes.Internal && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("Can't mount FUSE: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Unmount(mountPath) })
+	return mountPath
+}
+
+func TestNativeMountChecksToken(t *testing.T) {
+	_, server := newMemDropbox(t, "token")
+	b := newNativeTestBackend(&Config{}, server)
+	dir := t.TempDir()
+
+	_, err := b.Mount(context.Background(), &mountRequest{
+		MountPath: path.Join(dir, "mount"),
+		ConfigDir: dir,
+		CacheDir:  path.Join(dir, "cache"),
+		Token:     "revoked",
+	})
+	expectCode(t, err, codes.Unauthenticated)
+	if len(b.mounts) != 0 {
+		t.Errorf("Mount with a revoked token is served: %v", b.mounts)
+	}
+}
+
+func TestNativeFiles(t *testing.T) {
+	d, server := newMemDropbox(t, "token")
+	d.files["/docs"] = nil
+	d.files["/docs/a.txt"] = []byte("hello world")
+	b := newNativeTestBackend(&Config{}, server)
+	mountPath := mountNative(t, b, "token", false, nil)
+
+	entries, err := ioutil.ReadDir(mountPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "docs" || !entries[0].IsDir() {
+		t.Fatalf("Expected the docs folder, got %v", entries)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(mountPath, "docs/a.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected hello world, got %q %v", data, err)
+	}
+	info, err := os.Stat(path.Join(mountPath, "docs/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 11 || info.Mode() != 0644 || !info.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Unexpected attributes of a.txt: %d %v %v", info.Size(), info.Mode(), info.ModTime())
+	}
+
+	if err := ioutil.WriteFile(path.Join(mountPath, "docs/b.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.get("/docs/b.txt"); string(data) != "new" {
+		t.Errorf("Expected new uploaded to b.txt, got %q", data)
+	}
+
+	f, err := os.OpenFile(path.Join(mountPath, "docs/a.txt"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("!")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.get("/docs/a.txt"); string(data) != "hello world!" {
+		t.Errorf("Expected hello world! uploaded to a.txt, got %q", data)
+	}
+	if err := os.Truncate(path.Join(mountPath, "docs/a.txt"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.get("/docs/a.txt"); string(data) != "hello" {
+		t.Errorf("Expected a.txt truncated to hello, got %q", data)
+	}
+
+	if err := os.Mkdir(path.Join(mountPath, "docs/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path.Join(mountPath, "docs/a.txt"), path.Join(mountPath, "docs/sub/c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path.Join(mountPath, "docs/b.txt"), path.Join(mountPath, "docs/sub/c.txt")); err != nil {
+		t.Fatalf("Rename doesn't replace a file: %v", err)
+	}
+	if err := os.Remove(path.Join(mountPath, "docs/sub")); !isErrno(err, syscall.ENOTEMPTY) {
+		t.Errorf("Expected ENOTEMPTY removing a folder with files, got %v", err)
+	}
+	if err := os.Remove(path.Join(mountPath, "docs/sub/c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(mountPath, "docs/sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	var paths []string
+	for p := range d.files {
+		paths = append(paths, p)
+	}
+	d.mu.Unlock()
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, []string{"/docs"}) {
+		t.Errorf("Expected only /docs left, got %v", paths)
+	}
+
+	usage, err := b.Stats(mountPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage[0].Total != 40960 || usage[0].Available != 36864 {
+		t.Errorf("Expected the space of the account, got %v", usage[0])
+	}
+}
+
+func TestNativeReadOnly(t *testing.T) {
+	d, server := newMemDropbox(t, "token")
+	d.files["/a.txt"] = []byte("a")
+	b := newNativeTestBackend(&Config{}, server)
+	mountPath := mountNative(t, b, "token", true, nil)
+
+	if data, err := ioutil.ReadFile(path.Join(mountPath, "a.txt")); err != nil || string(data) != "a" {
+		t.Fatalf("Expected a, got %q %v", data, err)
+	}
+	if err := ioutil.WriteFile(path.Join(mountPath, "a.txt"), []byte("b"), 0644); !isErrno(err, syscall.EROFS) {
+		t.Errorf("Expected EROFS writing to a read-only mount, got %v", err)
+	}
+	if data, _ := d.get("/a.txt"); string(data) != "a" {
+		t.Errorf("a.txt is changed through a read-only mount: %q", data)
+	}
+}
+
+func TestNativeWriteToken(t *testing.T) {
+	d, server := newMemDropbox(t, "old")
+	d.files["/a.txt"] = []byte("a")
+	b := newNativeTestBackend(&Config{}, server)
+	mountPath := mountNative(t, b, "old", false, nil)
+
+	d.mu.Lock()
+	d.token = "new"
+	d.mu.Unlock()
+	if _, err := os.Stat(path.Join(mountPath, "b.txt")); !isErrno(err, syscall.EACCES) {
+		t.Errorf("Expected EACCES with a revoked token, got %v", err)
+	}
+
+	if err := b.WriteToken(b.mounts[mountPath].configDir, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(mountPath, "a.txt")); err != nil || string(data) != "a" {
+		t.Errorf("Expected a with the new token, got %q %v", data, err)
+	}
+}
+
+func TestNativeUnmount(t *testing.T) {
+	_, server := newMemDropbox(t, "token")
+	b := newNativeTestBackend(&Config{}, server)
+	exited := make(chan error, 1)
+	onExit := func(pid int, err error, stderr string) { exited <- err }
+
+	mountPath := mountNative(t, b, "token", false, onExit)
+	if err := b.Unmount(mountPath); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		t.Errorf("Unmount is reported as an exit: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// An unmount by someone else is an exit of the mount
+	mountPath = mountNative(t, b, "token", false, onExit)
+	if err := unix.Unmount(mountPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err == nil {
+			t.Error("Expected the exit error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The exit isn't reported")
+	}
+	if len(b.mounts) != 0 {
+		t.Errorf("Unmounted mount is still served: %v", b.mounts)
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	if linkErr, ok := err.(*os.LinkError); ok {
+		err = linkErr.Err
+	}
+	return err == errno
+}
@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+package dropbox
+
+import (
+	"runtime"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// nativeBackend serves mounts with go-fuse, which the driver uses on Linux
+// only. Elsewhere it fails to mount.
+type nativeBackend struct {
+	mounter mount.Interface
+}
+
+func newNativeBackend(cfg *Config, mounter mount.Interface) *nativeBackend {
+	return &nativeBackend{mounter: mounter}
+}
+
+func (b *nativeBackend) Name() string {
+	return backendNative
+}
+
+func (b *nativeBackend) Command() string {
+	return ""
+}
+
+func (b *nativeBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	return 0, status.Errorf(codes.InvalidArgument, "The %s backend is not supported on %s", backendNative, runtime.GOOS)
+}
+
+func (b *nativeBackend) Unmount(mountPath string) error {
+	return unmountIfMounted(b.mounter, mountPath)
+}
+
+func (b *nativeBackend) WriteToken(configDir, token string) error {
+	return writeFile(tokenPath(configDir), token)
+}
+
+func (b *nativeBackend) RemoveConfig(configDir string) error {
+	return shredFiles(tokenPath(configDir))
+}
+
+func (b *nativeBackend) Stats(mountPath string) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(mountPath)
+}
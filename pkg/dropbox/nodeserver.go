@@ -2,7 +2,6 @@ package dropbox
 
 import (
 	"bufio"
-	"bytes"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -10,97 +9,684 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/utils/mount"
 	"os"
-	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 type nodeServer struct {
-	nodeID string
+	nodeID  string
+	cfg     *Config
+	rootDir string
+	// Directory of the per-volume config dirs holding credentials
+	credentialsDir string
+	caps           []*csi.NodeServiceCapability
+	runner         commandRunner
+	mounter        mount.Interface
+	backends       map[string]Backend
+
+	// Mounts and unmounts are limited separately so teardown is never
+	// starved by a backlog of mounts
+	mountSem   semaphore
+	unmountSem semaphore
+
+	tokens *tokenUsage
+
+	env nodeEnv
+	// Result of the last checks of the node of runPreflight
+	preflightMu      sync.Mutex
+	preflightErr     error
+	preflightChecked bool
+
+	topologyMu sync.Mutex
+	topology   map[string]string
+
+	usage *usageCache
+	// Sizes of the folders of volumes with enforceCapacity
+	folderSizes *folderSizeCache
+
+	volumeLocks *volumeLocks
+	crashes     *mountCrashes
+	problems    *volumeProblems
+	stats       *statsCache
+	events      *eventRecorder
+	shared      *sharedMounts
+
+	refreshersMu sync.Mutex
+	refreshers   map[string]chan struct{}
+
+	// Staged volumes, persisted under the state dir
+	volumesMu sync.Mutex
+	volumes   map[string]*volumeState
+
+	// In-flight stage operations, canceled on shutdown
+	mu           sync.Mutex
+	stages       map[string]context.CancelFunc
+	stagesWg     sync.WaitGroup
+	shuttingDown bool
+	stopCh       chan struct{}
 }
 
-func NewNodeServer(nodeId string) *nodeServer {
+func NewNodeServer(cfg *Config) *nodeServer {
+	rootDir := cfg.RootDir
+	if rootDir == "" {
+		rootDir = defaultRootDir
+	}
+
+	credentialsDir := cfg.CredentialsDir
+	if credentialsDir == "" {
+		credentialsDir = defaultCredentialsDir
+	}
+
+	volumes, err := loadVolumeStates(stateDir(rootDir))
+	if err != nil {
+		glog.Errorf("Can't load volume states: %v", err)
+		volumes = map[string]*volumeState{}
+	}
+	for volumeID, vol := range volumes {
+		glog.Infof("Recovered staged volume %s at %s", volumeID, vol.MountPath)
+	}
+	stagedVolumes.Set(float64(len(volumes)))
+
+	runner := execCommandRunner{maxOutput: cfg.MaxCommandOutput}
+	mounter := mount.New("")
+
 	return &nodeServer{
-		nodeID: nodeId,
+		nodeID:  cfg.NodeID,
+		cfg:     cfg,
+		rootDir: rootDir,
+
+		credentialsDir: credentialsDir,
+		caps: getNodeServiceCapabilities(
+			[]csi.NodeServiceCapability_RPC_Type{
+				csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+			}),
+		runner:   runner,
+		mounter:  mounter,
+		backends: newBackends(cfg, runner, mounter),
+
+		mountSem:   newSemaphore(cfg.MaxConcurrentMounts),
+		unmountSem: newSemaphore(cfg.MaxConcurrentUnmounts),
+
+		tokens: newTokenUsage(cfg.TokenShareWarnThreshold),
+
+		env: osNodeEnv{},
+
+		usage:       newUsageCache(),
+		folderSizes: newFolderSizeCache(),
+		volumeLocks: newVolumeLocks(),
+		crashes:     newMountCrashes(),
+		problems:    newVolumeProblems(),
+		stats:       newStatsCache(),
+		events:      newEventRecorder(cfg),
+		shared:      newSharedMounts(volumes),
+		refreshers:  map[string]chan struct{}{},
+		volumes:     volumes,
+		stopCh:      make(chan struct{}),
+
+		stages: map[string]context.CancelFunc{},
 	}
 }
 
-const (
-	rootDir = "/mnt/csi-dropbox"
-	dataDir = rootDir + "/data"
-)
-
-func (n *nodeServer) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+func (n *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	segments, err := n.getTopology(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: n.nodeID,
+		NodeId:            n.nodeID,
+		MaxVolumesPerNode: n.cfg.MaxVolumesPerNode,
+		AccessibleTopology: &csi.Topology{
+			Segments: segments,
+		},
 	}, nil
 }
 
-func (n nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (n *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if !n.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.volumeLocks.release(req.GetVolumeId())
+
+	// Without credentials in nodeStageSecretRef, the volume is staged by
+	// NodePublishVolume with the secrets of nodePublishSecretRef. Nothing
+	// is recorded until then, so unstaging it before is a no-op, and the
+	// request is still validated to fail here rather than on publish.
+	if !hasCredentials(req.GetSecrets()) {
+		if _, err := n.parseStageRequest(req); err != nil {
+			n.events.stageFailed(req.GetVolumeId(), err)
+			return nil, err
+		}
+		glog.Infof("No credentials in the stage secrets of volume %s, it is staged on publish", req.GetVolumeId())
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	resp, err := n.stageVolume(ctx, req)
+	if err != nil {
+		n.events.stageFailed(req.GetVolumeId(), err)
+	}
+	return resp, err
+}
+
+// stageOptions are the options of a volume parsed from a stage request.
+type stageOptions struct {
+	volCtx     map[string]string
+	readOnly   bool
+	backend    Backend
+	encrypted  bool
+	capacity   int64
+	mountGroup string
+	owner      mountOwner
+}
+
+// parseStageRequest validates a stage request but its secrets, which may be
+// given on publish, and returns the options of the volume.
+func (n *nodeServer) parseStageRequest(req *csi.NodeStageVolumeRequest) (*stageOptions, error) {
 	if len(req.GetStagingTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capability missing in request")
 	}
-	token, exists := req.Secrets["token"]
-	if !exists {
-		return nil, status.Error(codes.InvalidArgument, "Token not exists")
+	if err := validateVolumeCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	// Backend options in the mountOptions of the persistent volume are
+	// applied to the backend mount, the others to the bind mounts
+	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	volCtx, err := volumeContextFromMountFlags(req.GetVolumeContext(), mountFlags)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	opts := &stageOptions{
+		volCtx:     volCtx,
+		readOnly:   isReadOnlyCapability(req.GetVolumeCapability()) || contains(mountFlags, "ro"),
+		mountGroup: req.GetVolumeCapability().GetMount().GetVolumeMountGroup(),
+	}
+	if opts.backend, err = n.backend(volCtx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateVolumeContext(opts.backend.Name(), volCtx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateSubPath(volCtx["path"]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if opts.encrypted, err = isEncrypted(volCtx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if opts.capacity, err = capacityFromVolumeContext(volCtx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateEnforceCapacity(volCtx, opts.capacity); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The size of the folder is measured by the usage check
+	if enforced, _ := isCapacityEnforced(volCtx); enforced && n.cfg.UsageCheckInterval <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s requires the driver to run with --usage-check-interval", enforceCapacityKey)
+	}
+	// Conflicted copies are looked for by the usage check too
+	conflictPolicy, err := conflictFilesPolicy(volCtx)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if conflictPolicy != "" && n.cfg.UsageCheckInterval <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s requires the driver to run with --usage-check-interval", conflictFilesKey)
+	}
+	owner, err := mountOwnerFromVolumeContext(volCtx, opts.mountGroup, n.cfg)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if owner.AllowOther {
+		if err := checkAllowOther(); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	// The label of a FUSE mount is set when mounting the backend, bind
+	// mounts of it can't change it
+	owner.SELinuxContext = seLinuxContextOption(mountFlags)
+	opts.owner = owner
+	return opts, nil
+}
 
-	glog.Infof("targetPath: %v", req.GetStagingTargetPath())
-	glog.Infof("dataDir: %v", dataDir)
-
-	err := os.MkdirAll(dataDir, 0777)
+// stageVolume stages a volume with the volume lock held. The request is
+// validated before a mount slot is taken, so that invalid requests don't
+// wait behind the mounts of other volumes.
+func (n *nodeServer) stageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	opts, err := n.parseStageRequest(req)
 	if err != nil {
-		glog.Error("Can't create dataDir %s", dataDir)
 		return nil, err
 	}
+	creds, err := credentialsFromSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var encryption *encryptionKeys
+	if opts.encrypted {
+		if encryption, err = encryptionKeysFromSecrets(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
-	dbxfsConfigPath := path.Join(rootDir, "dbxfs_config.json")
-	dbxfsTokenPath := path.Join(rootDir, "dbxfs_token")
+	ctx, done, ok := n.beginStage(ctx, req.GetVolumeId())
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "Driver is shutting down")
+	}
+	defer done()
 
-	err = writeFile(dbxfsConfigPath, "{\"access_token_command\": [\"cat\", \""+dbxfsTokenPath+"\"], \"send_error_reports\": true, \"asked_send_error_reports\": true}")
+	if err := n.mountSem.acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "Waiting for mount slot: %v", err)
+	}
+	defer n.mountSem.release()
+
+	stagingPath := req.GetStagingTargetPath()
+	glog.Infof("stagingPath: %v", stagingPath)
+
+	staged, err := n.checkStagedVolume(req.GetVolumeId(), stagingPath, opts.readOnly)
 	if err != nil {
-		glog.Error("Can't create dbxfs config file")
 		return nil, err
 	}
+	if staged {
+		glog.V(4).Infof("dropbox-csi: volume %s is already staged at %s", req.GetVolumeId(), stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	// Clear a dead or unknown mount left at the staging path
+	if err := opts.backend.Unmount(stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't unmount %s: %v", stagingPath, err)
+	}
 
-	err = writeFile(dbxfsTokenPath, token)
+	token, expiresIn, err := creds.accessTokenWithRetry(ctx, n.cfg.MountRetries, n.cfg.MountRetryInterval)
 	if err != nil {
-		glog.Error("Can't create dbxfs token file")
+		return nil, accessTokenError(err)
+	}
+
+	if err := ensureVolumePath(ctx, n.cfg, req.GetVolumeId(), token, opts.volCtx); err != nil {
 		return nil, err
 	}
 
-	cmd := exec.Command("dbxfs", dataDir, "-c", dbxfsConfigPath)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	err = prepareMountPoint(stagingPath)
 	if err != nil {
-		glog.Errorf("Cant mount dbxfs: %s %s", stdout.String(), stderr.String())
-		return nil, err
+		glog.Errorf("Can't create staging path %s: %v", stagingPath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Every volume has its own config and token files and its own mount
+	// process, so volumes of different accounts never share credentials.
+	// With ShareMounts, volumes of the same credentials and mount options
+	// share them.
+	configDir := n.volumeConfigDir(req.GetVolumeId())
+	sharedKey := ""
+	// Encrypted volumes of one account may have different keys
+	if n.cfg.ShareMounts && !opts.encrypted {
+		sharedKey = sharedMountKey(opts.backend.Name(), creds.id(), opts.readOnly, opts.owner, opts.volCtx)
+		configDir = n.sharedConfigDir(sharedKey)
+	}
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		glog.Errorf("Can't create config dir %s: %v", configDir, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := saveRefreshCredentials(configDir, creds); err != nil {
+		glog.Errorf("Can't save refresh token of volume %s: %v", req.GetVolumeId(), err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	glog.V(4).Infof("dropbox-csi: volume %s is mounted %s", dataDir, stdout.String())
+	mountReq := &mountRequest{
+		MountPath:     stagingPath,
+		ConfigDir:     configDir,
+		CacheDir:      n.volumeCacheDir(req.GetVolumeId()),
+		Token:         token,
+		ReadOnly:      opts.readOnly,
+		Owner:         opts.owner,
+		Encryption:    encryption,
+		VolumeContext: opts.volCtx,
+		Env:           n.mountEnv(req.GetVolumeId()),
+		VolumeID:      req.GetVolumeId(),
+		OnExit:        n.mountExitHandler(req.GetVolumeId()),
+	}
+	var pid int
+	if sharedKey != "" {
+		pid, err = n.mountShared(ctx, opts.backend, sharedKey, req.GetVolumeId(), mountReq)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pid, err = opts.backend.Mount(ctx, mountReq)
+		if err != nil {
+			n.cleanupStage(opts.backend, stagingPath, configDir)
+			return nil, err
+		}
+	}
+	n.crashes.reset(req.GetVolumeId())
+	n.tokens.add(req.GetVolumeId(), creds.id())
+	n.startTokenRefresh(req.GetVolumeId(), creds, opts.backend, configDir, expiresIn)
+
+	n.addVolume(&volumeState{
+		VolumeID:  req.GetVolumeId(),
+		Backend:   opts.backend.Name(),
+		MountPath: stagingPath,
+		ConfigDir: configDir,
+		TokenPath: tokenPath(configDir),
+		Pid:       pid,
+		SubPath:   opts.volCtx["path"],
+		Capacity:  opts.capacity,
+		ReadOnly:  opts.readOnly,
+
+		VolumeContext:   opts.volCtx,
+		MountGroup:      opts.mountGroup,
+		CredentialsHash: hashToken(creds.id()),
+		SharedMount:     sharedKey,
+		SELinuxContext:  opts.owner.SELinuxContext,
+	})
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// ensureVolumePath checks with the Dropbox API that the folder of the path
+// attribute exists before it is mounted, creating it if createPath is set.
+// Folders of path templates are per pod and created when publishing.
+func ensureVolumePath(ctx context.Context, cfg *Config, volumeID, token string, volCtx map[string]string) error {
+	subPath := volCtx["path"]
+	p := path.Clean("/" + subPath)
+	if p == "/" || isPathTemplate(subPath) {
+		return nil
+	}
+
+	client, err := teamAPIClient(ctx, cfg, token, teamSpaceFrom(volCtx))
+	if err != nil {
+		return err
+	}
+	client = client.forVolume(volumeID)
+	m, err := client.getMetadata(ctx, p)
+	if err == nil {
+		if m.Tag != "folder" {
+			return status.Errorf(codes.FailedPrecondition, "Path %s is not a folder in Dropbox", p)
+		}
+		return nil
+	}
+	if !isAPINotFound(err) {
+		return apiStatusError(err, "Can't check path %s", p)
+	}
+	if volCtx["createPath"] != "true" {
+		return status.Errorf(codes.NotFound, "Path %s doesn't exist in Dropbox, set createPath to \"true\" to create it", p)
+	}
+
+	glog.Infof("Creating path %s in Dropbox", p)
+	if err := client.createFolder(ctx, p); err != nil {
+		return apiStatusError(err, "Can't create path %s", p)
+	}
+	return nil
+}
+
+// checkStagedVolume tells whether volumeID is already staged at stagingPath
+// with a live mount. Staging it again to a different path or with a different
+// read-only mode is an error.
+func (n *nodeServer) checkStagedVolume(volumeID, stagingPath string, readonly bool) (bool, error) {
+	n.volumesMu.Lock()
+	vol, ok := n.volumes[volumeID]
+	n.volumesMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	if vol.MountPath != stagingPath {
+		return false, status.Errorf(codes.AlreadyExists, "Volume %s is already staged at %s", volumeID, vol.MountPath)
+	}
+	if vol.ReadOnly != readonly {
+		return false, status.Errorf(codes.AlreadyExists, "Volume %s is already staged with different readonly mode", volumeID)
+	}
+
+	if healthy, reason := n.isMountHealthy(vol); !healthy {
+		glog.Warningf("Staged mount of volume %s is dead (%s), staging it again", volumeID, reason)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (n *nodeServer) addVolume(vol *volumeState) {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	n.volumes[vol.VolumeID] = vol
+	stagedVolumes.Set(float64(len(n.volumes)))
+	if err := saveVolumeState(stateDir(n.rootDir), vol); err != nil {
+		glog.Errorf("Can't save state of volume %s: %v", vol.VolumeID, err)
+	}
+}
+
+// updateVolume applies update to a copy of the state of volumeID and saves
+// it. It returns false if the volume is not staged.
+func (n *nodeServer) updateVolume(volumeID string, update func(vol *volumeState)) bool {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	vol, ok := n.volumes[volumeID]
+	if !ok {
+		return false
+	}
+	updated := *vol
+	updated.Targets = append([]string(nil), vol.Targets...)
+	updated.TargetMounts = make(map[string]targetMount, len(vol.TargetMounts))
+	for t, m := range vol.TargetMounts {
+		updated.TargetMounts[t] = m
+	}
+	updated.CapacityReadOnlyTargets = append([]string(nil), vol.CapacityReadOnlyTargets...)
+	updated.ConflictedFiles = append([]string(nil), vol.ConflictedFiles...)
+	update(&updated)
+
+	n.volumes[volumeID] = &updated
+	if err := saveVolumeState(stateDir(n.rootDir), &updated); err != nil {
+		glog.Errorf("Can't save state of volume %s: %v", volumeID, err)
+	}
+	return true
+}
+
+// addTarget records that volumeID is published to targetPath with the bind
+// mount m. The bind mount recorded first is kept.
+func (n *nodeServer) addTarget(volumeID, targetPath string, m targetMount) {
+	n.updateVolume(volumeID, func(vol *volumeState) {
+		if !contains(vol.Targets, targetPath) {
+			vol.Targets = append(vol.Targets, targetPath)
+		}
+		if _, ok := vol.TargetMounts[targetPath]; !ok {
+			vol.TargetMounts[targetPath] = m
+		}
+	})
+}
+
+func (n *nodeServer) removeTarget(volumeID, targetPath string) {
+	n.updateVolume(volumeID, func(vol *volumeState) {
+		var targets []string
+		for _, t := range vol.Targets {
+			if t != targetPath {
+				targets = append(targets, t)
+			}
+		}
+		vol.Targets = targets
+		delete(vol.TargetMounts, targetPath)
+	})
+}
+
+// publishedTargets returns the targets volumeID is still mounted at. Targets
+// which are gone without an unpublish are forgotten.
+func (n *nodeServer) publishedTargets(volumeID string) []string {
+	n.volumesMu.Lock()
+	vol, ok := n.volumes[volumeID]
+	n.volumesMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var live []string
+	for _, t := range vol.Targets {
+		notMnt, err := isNotMountPoint(n.mounter, t)
+		if err == nil && notMnt || os.IsNotExist(err) {
+			glog.Warningf("Volume %s is no longer mounted at %s", volumeID, t)
+			continue
+		}
+		live = append(live, t)
+	}
+	if len(live) != len(vol.Targets) {
+		n.updateVolume(volumeID, func(vol *volumeState) {
+			vol.Targets = live
+			for t := range vol.TargetMounts {
+				if !contains(live, t) {
+					delete(vol.TargetMounts, t)
+				}
+			}
+		})
+	}
+	return live
+}
+
+func (n *nodeServer) stagedCount() int {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	return len(n.volumes)
+}
+
+func (n *nodeServer) removeVolume(volumeID string) {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	delete(n.volumes, volumeID)
+	n.crashes.reset(volumeID)
+	stagedVolumes.Set(float64(len(n.volumes)))
+	if err := removeVolumeState(stateDir(n.rootDir), volumeID); err != nil {
+		glog.Errorf("Can't remove state of volume %s: %v", volumeID, err)
+	}
+}
+
+// publishCapability returns the capability of a publish request, with a
+// read-only access mode if the volume is published read-only. The mount of an
+// ephemeral volume is only used by this publish, so it is mounted read-only
+// as well.
+func publishCapability(req *csi.NodePublishVolumeRequest) *csi.VolumeCapability {
+	vc := req.GetVolumeCapability()
+	if !req.GetReadonly() || isReadOnlyCapability(vc) {
+		return vc
+	}
+	mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	if vc.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
+		vc.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER {
+		mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	}
+	return &csi.VolumeCapability{
+		AccessType: vc.GetAccessType(),
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func isReadOnlyCapability(vc *csi.VolumeCapability) bool {
+	switch vc.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// beginStage registers an in-flight stage operation. The returned context is
+// canceled when the node server shuts down, and done must be called when the
+// operation finishes.
+func (n *nodeServer) beginStage(ctx context.Context, volumeID string) (context.Context, func(), bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.shuttingDown {
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	n.stages[volumeID] = cancel
+	n.stagesWg.Add(1)
+
+	return ctx, func() {
+		n.mu.Lock()
+		delete(n.stages, volumeID)
+		n.mu.Unlock()
+		cancel()
+		n.stagesWg.Done()
+	}, true
+}
+
+// Shutdown cancels in-flight stage operations and waits for them to clean up.
+func (n *nodeServer) Shutdown() {
+	n.mu.Lock()
+	if !n.shuttingDown {
+		close(n.stopCh)
+	}
+	n.shuttingDown = true
+	for volumeID, cancel := range n.stages {
+		glog.Infof("Canceling in-flight stage of volume %s", volumeID)
+		cancel()
+	}
+	n.mu.Unlock()
+
+	n.stagesWg.Wait()
+}
+
+// cleanupStage removes a partially staged mount and its credentials.
+func (n *nodeServer) cleanupStage(backend Backend, stagingPath, configDir string) {
+	if err := backend.Unmount(stagingPath); err != nil {
+		glog.Errorf("Can't unmount %s: %v", stagingPath, err)
+		// Never remove files of a mount which may still be alive
+		return
+	}
+	removeVolumeConfig(backend, configDir)
+}
+
+// removeVolumeConfig shreds the config and token of a volume and removes its
+// config dir.
+func removeVolumeConfig(backend Backend, configDir string) {
+	if err := backend.RemoveConfig(configDir); err != nil {
+		glog.Errorf("Can't remove config of %s: %v", configDir, err)
+		return
+	}
+	if err := shredDir(configDir); err != nil {
+		glog.Errorf("Can't remove %s: %v", configDir, err)
+	}
+}
+
+// volumeBackend returns the backend a staged volume is mounted with.
+func (n *nodeServer) volumeBackend(volumeID string) Backend {
+	n.volumesMu.Lock()
+	vol, ok := n.volumes[volumeID]
+	n.volumesMu.Unlock()
+
+	if ok && vol.Backend != "" {
+		if b, ok := n.backends[vol.Backend]; ok {
+			return b
+		}
+	}
+	b, err := n.backend(nil)
+	if err != nil {
+		// The default backend is validated by NewDropboxDriver
+		return n.backends[backendDbxfs]
+	}
+	return b
+}
+
+// writeFile writes contents to path, readable only by the driver as it may be
+// a credential.
 func writeFile(path, contents string) error {
-	outfile, err := os.Create(path)
+	outfile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		glog.Error("Can't create %s", path)
+		glog.Errorf("Can't create %s: %v", path, err)
 		return err
 	}
 
 	writer := bufio.NewWriter(outfile)
 	_, err = writer.WriteString(contents)
 	if err != nil {
-		glog.Error("Can't write %s", path)
+		glog.Errorf("Can't write %s: %v", path, err)
 		return err
 	}
 
@@ -110,24 +696,64 @@ func writeFile(path, contents string) error {
 	return nil
 }
 
-func (n nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (n *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if !n.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.volumeLocks.release(req.GetVolumeId())
+
+	return n.unstageVolume(ctx, req)
+}
+
+// unstageVolume unstages a volume with the volume lock held.
+func (n *nodeServer) unstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	if len(req.GetStagingTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	err := mount.New("").Unmount(dataDir)
+	if err := n.unmountSem.acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "Waiting for unmount slot: %v", err)
+	}
+	defer n.unmountSem.release()
+
+	// The mount is shared by every target of the volume, so it is kept until
+	// the last one is unpublished
+	if targets := n.publishedTargets(req.GetVolumeId()); len(targets) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is still published at %s", req.GetVolumeId(), strings.Join(targets, ", "))
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	backend := n.volumeBackend(req.GetVolumeId())
+	err := backend.Unmount(stagingPath)
 	if err != nil {
+		// e.g. the last sync of a mirror failing with Unavailable
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	glog.V(4).Infof("dropbox-csi: volume %s is unmounted,", dataDir)
+	glog.V(4).Infof("dropbox-csi: volume %s is unmounted,", stagingPath)
+	if vol, ok := n.stagedVolume(req.GetVolumeId()); ok && vol.SharedMount != "" {
+		n.releaseShared(backend, vol.SharedMount, req.GetVolumeId())
+	} else {
+		removeVolumeConfig(backend, n.volumeConfigDir(req.GetVolumeId()))
+	}
+	n.removeVolumeCache(req.GetVolumeId())
+	n.tokens.remove(req.GetVolumeId())
+	n.stopTokenRefresh(req.GetVolumeId())
+	n.removeVolume(req.GetVolumeId())
+	n.usage.remove(req.GetVolumeId())
+	n.folderSizes.remove(req.GetVolumeId())
+	n.problems.remove(req.GetVolumeId())
+	n.stats.remove(req.GetVolumeId())
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (n nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (n *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
@@ -137,45 +763,227 @@ func (n nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishV
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := validateVolumeCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !n.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.volumeLocks.release(req.GetVolumeId())
+	backend, err := n.backend(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateVolumeContext(backend.Name(), req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	targetPath := req.GetTargetPath()
 
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	// kubelet doesn't stage ephemeral inline volumes, so they are staged here
+	// to a path of the driver
+	stagingPath := req.GetStagingTargetPath()
+	if isEphemeralVolume(req.GetVolumeContext()) {
+		stagingPath = n.ephemeralStagingPath(req.GetVolumeId())
+		_, err := n.stageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          req.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  publishCapability(req),
+			Secrets:           req.GetSecrets(),
+			VolumeContext:     req.GetVolumeContext(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if _, staged := n.stagedVolume(req.GetVolumeId()); !staged {
+		if !hasCredentials(req.GetSecrets()) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged and the publish secrets have no credentials to stage it with", req.GetVolumeId())
+		}
+		// The stage secrets had no credentials, see NodeStageVolume
+		_, err := n.stageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          req.GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  req.GetVolumeCapability(),
+			Secrets:           req.GetSecrets(),
+			VolumeContext:     req.GetVolumeContext(),
+		})
+		if err != nil {
+			n.events.stageFailed(req.GetVolumeId(), err)
+			return nil, err
+		}
+	}
+	if !bindMountOptions {
+		if err := n.checkLinkOptions(req); err != nil {
+			return nil, err
+		}
+	}
+	subPath := req.GetVolumeContext()["path"]
+	// The template itself is checked too, so that no variable can add a
+	// segment escaping the volume root
+	if err := validateSubPath(subPath); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	templated := isPathTemplate(subPath)
+	if templated {
+		subPath, err = expandPathTemplate(subPath, req.GetVolumeContext())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	dirToMountInDropbox, err := resolveSubPath(stagingPath, subPath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Folders of a template are per pod, so they are created on demand
+	if templated {
+		if err := os.MkdirAll(dirToMountInDropbox, 0750); err != nil {
+			return nil, fsStatusError(err, "Can't create %s", dirToMountInDropbox)
+		}
+	} else if _, err := os.Stat(dirToMountInDropbox); err != nil {
+		if !os.IsNotExist(err) || req.GetVolumeContext()["createPath"] != "true" {
+			return nil, fsStatusError(err, "Can't find path %q in Dropbox", subPath)
+		}
+		// Deleted in Dropbox since the volume was staged
+		if err := os.MkdirAll(dirToMountInDropbox, 0750); err != nil {
+			return nil, fsStatusError(err, "Can't create %s", dirToMountInDropbox)
+		}
+	}
+
+	createdTarget := false
+	notMnt, err := isNotMountPoint(n.mounter, targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err = os.MkdirAll(targetPath, 0750); err != nil {
+			if err = prepareMountPoint(targetPath); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
+			createdTarget = true
 			notMnt = true
 		} else {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 	if !notMnt {
+		// A target made read-only at the capacity of the volume stays so
+		readonly := req.GetReadonly()
+		if vol, ok := n.stagedVolume(req.GetVolumeId()); ok && contains(vol.CapacityReadOnlyTargets, targetPath) {
+			readonly = true
+		}
+		if err := n.checkPublishedMount(dirToMountInDropbox, targetPath, readonly); err != nil {
+			return nil, err
+		}
+		options := []string{"bind"}
+		if req.GetReadonly() {
+			options = append(options, "ro")
+		}
+		n.addTarget(req.GetVolumeId(), targetPath, targetMount{Source: dirToMountInDropbox, Options: options})
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	// The readonly request takes precedence over the capability mount flags,
+	// which take precedence over the volume context mountOptions
 	options := []string{"bind"}
 	if req.GetReadonly() {
 		options = append(options, "ro")
 	}
+	options, err = mergeMountOptions(
+		options,
+		bindMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags()),
+		splitMountOptions(req.GetVolumeContext()["mountOptions"]))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	dirToMountInDropbox := dataDir
-	if len(req.VolumeContext["path"]) != 0 {
-		dirToMountInDropbox = path.Join(dirToMountInDropbox, req.VolumeContext["path"])
+	if err := n.mountSem.acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "Waiting for mount slot: %v", err)
 	}
+	defer n.mountSem.release()
 
-	mounter := mount.New("")
-	if err := mounter.Mount(dirToMountInDropbox, targetPath, "", options); err != nil {
-		var errList strings.Builder
-		errList.WriteString(err.Error())
+	if err := n.mounter.Mount(dirToMountInDropbox, targetPath, "", options); err != nil {
+		glog.Errorf("Can't mount %s to %s: %v", dirToMountInDropbox, targetPath, err)
+		if createdTarget {
+			if err := os.Remove(targetPath); err != nil {
+				glog.Errorf("Can't remove %s: %v", targetPath, err)
+			}
+		}
+		return nil, status.Errorf(codes.Internal, "Can't mount %s to %s: %v", dirToMountInDropbox, targetPath, err)
 	}
 	glog.V(4).Infof("dropbox-csi: volume %s is mount to %s.", dirToMountInDropbox, targetPath)
+	n.addTarget(req.GetVolumeId(), targetPath, targetMount{Source: dirToMountInDropbox, Options: options})
+	if !req.GetReadonly() {
+		if err := n.limitTarget(req.GetVolumeId(), targetPath); err != nil {
+			glog.Errorf("Can't make %s of volume %s over its capacity read-only: %v", targetPath, req.GetVolumeId(), err)
+		}
+	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (n nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+// checkLinkOptions rejects what a published target which is a link instead of
+// a bind mount can't do: it is only read-only if the staged mount is, and it
+// takes no mount flags.
+func (n *nodeServer) checkLinkOptions(req *csi.NodePublishVolumeRequest) error {
+	for _, flag := range bindMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags()) {
+		if flag != "ro" {
+			return status.Errorf(codes.InvalidArgument, "Mount flag %q is not supported on %s", flag, runtime.GOOS)
+		}
+	}
+	vol, _ := n.stagedVolume(req.GetVolumeId())
+	if req.GetReadonly() && (vol == nil || !vol.ReadOnly) {
+		return status.Errorf(codes.InvalidArgument, "Volume %s is staged writable and can't be published read-only on %s", req.GetVolumeId(), runtime.GOOS)
+	}
+	return nil
+}
+
+// checkPublishedMount verifies that the existing mount at targetPath is a bind
+// mount of source with the requested read-only mode.
+func (n *nodeServer) checkPublishedMount(source, targetPath string, readonly bool) error {
+	mps, err := n.mounter.List()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	var mp *mount.MountPoint
+	for i := range mps {
+		// The last entry is the topmost mount on the path
+		if mps[i].Path == targetPath {
+			mp = &mps[i]
+		}
+	}
+	if mp == nil {
+		glog.Warningf("Can't find mount entry of %s, assuming it is already published", targetPath)
+		return nil
+	}
+
+	if contains(mp.Opts, "ro") != readonly {
+		return status.Errorf(codes.AlreadyExists, "Target path %s is already mounted with different readonly option", targetPath)
+	}
+
+	// A bind mount shows the device of the underlying filesystem rather than
+	// the source directory, so compare the directories themselves as well.
+	if mp.Device != source && !isSameFile(source, targetPath) {
+		return status.Errorf(codes.AlreadyExists, "Target path %s is already mounted from a different source", targetPath)
+	}
+
+	return nil
+}
+
+func isSameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func (n *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
@@ -185,33 +993,179 @@ func (n nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubl
 
 	targetPath := req.GetTargetPath()
 
-	err := mount.New("").Unmount(targetPath)
+	if !n.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.volumeLocks.release(req.GetVolumeId())
+
+	if err := n.unmountSem.acquire(ctx); err != nil {
+		return nil, status.Errorf(codes.Aborted, "Waiting for unmount slot: %v", err)
+	}
+	err := unmountIfMounted(n.mounter, targetPath)
+	n.unmountSem.release()
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	glog.V(4).Infof("dropbox-csi: volume %s is unmounted,", targetPath)
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "Can't remove %s: %v", targetPath, err)
+	}
+	n.removeTarget(req.GetVolumeId(), targetPath)
+
+	if n.isStagedAt(req.GetVolumeId(), n.ephemeralStagingPath(req.GetVolumeId())) && len(n.publishedTargets(req.GetVolumeId())) == 0 {
+		if err := n.unstageEphemeralVolume(ctx, req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (n *nodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-					},
+		Capabilities: n.caps,
+	}, nil
+}
+
+func getNodeServiceCapabilities(nl []csi.NodeServiceCapability_RPC_Type) []*csi.NodeServiceCapability {
+	var nsc []*csi.NodeServiceCapability
+
+	for _, cap := range nl {
+		glog.Infof("Enabling node service capability: %v", cap.String())
+		nsc = append(nsc, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: cap,
 				},
 			},
-		},
+		})
+	}
+
+	return nsc
+}
+
+func (n *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	if cached := n.cachedStats(req.GetVolumeId(), req.GetVolumePath()); cached != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage:           cached.usage,
+			VolumeCondition: cached.condition,
+		}, nil
+	}
+
+	stats, err := n.volumeStats(ctx, req.GetVolumeId(), req.GetVolumePath())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           stats,
+		VolumeCondition: n.volumeCondition(req.GetVolumeId()),
 	}, nil
 }
 
-func (n nodeServer) NodeGetVolumeStats(context.Context, *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	panic("implement me node volumestats")
+// volumeStats returns the usage of a volume mounted at volumePath.
+func (n *nodeServer) volumeStats(ctx context.Context, volumeID, volumePath string) ([]*csi.VolumeUsage, error) {
+	stats, err := n.volumeBackend(volumeID).Stats(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %s not found", volumePath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The FUSE filesystem doesn't know the account space, so bytes come from
+	// the Dropbox space usage when it is available
+	usage, err := n.spaceUsage(ctx, volumeID)
+	if err != nil {
+		glog.Warningf("Can't get Dropbox space usage of volume %s, using statfs: %v", volumeID, err)
+	} else if bytesUsage := findVolumeUsage(stats, csi.VolumeUsage_BYTES); bytesUsage != nil && usage.Allocation.Allocated > 0 {
+		bytesUsage.Total = int64(usage.Allocation.Allocated)
+		bytesUsage.Used = int64(usage.Used)
+		bytesUsage.Available = int64(usage.available())
+
+		// A provisioned volume reports its requested size, with what is
+		// left of it as much as the account has free
+		if capacity := n.volumeCapacity(volumeID); capacity > 0 {
+			bytesUsage.Total = capacity
+			if bytesUsage.Available > capacity {
+				bytesUsage.Available = capacity
+			}
+			bytesUsage.Used = capacity - bytesUsage.Available
+			// The folder of a volume with enforceCapacity is measured
+			if vol, ok := n.stagedVolume(volumeID); ok {
+				if enforced, _ := isCapacityEnforced(vol.VolumeContext); enforced {
+					bytesUsage.Used = vol.UsedBytes
+					if left := capacity - vol.UsedBytes; left < bytesUsage.Available {
+						bytesUsage.Available = left
+					}
+					if bytesUsage.Available < 0 {
+						bytesUsage.Available = 0
+					}
+				}
+			}
+		}
+	}
+
+	return stats, nil
 }
 
-func (n nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	panic("implement me node expand")
+// volumeCapacity returns the requested size of a staged volume, or 0 if it
+// is unknown.
+func (n *nodeServer) volumeCapacity(volumeID string) int64 {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	if vol, ok := n.volumes[volumeID]; ok {
+		return vol.Capacity
+	}
+	return 0
+}
+
+func findVolumeUsage(stats []*csi.VolumeUsage, unit csi.VolumeUsage_Unit) *csi.VolumeUsage {
+	for _, u := range stats {
+		if u.Unit == unit {
+			return u
+		}
+	}
+	return nil
+}
+
+// NodeExpandVolume updates the capacity reported for a staged volume. There
+// is no filesystem to grow on a FUSE mount of Dropbox.
+func (n *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	if !n.volumeLocks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.volumeLocks.release(req.GetVolumeId())
+
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	staged := n.updateVolume(req.GetVolumeId(), func(vol *volumeState) {
+		if capacity > 0 {
+			vol.Capacity = capacity
+		}
+	})
+	if !staged {
+		return nil, status.Errorf(codes.NotFound, "Volume %s is not staged", req.GetVolumeId())
+	}
+	if capacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Required bytes missing in request")
+	}
+	n.usage.remove(req.GetVolumeId())
+	n.stats.remove(req.GetVolumeId())
+	n.applyCapacity(req.GetVolumeId())
+	glog.V(4).Infof("dropbox-csi: volume %s is expanded to %d bytes", req.GetVolumeId(), capacity)
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacity}, nil
 }
@@ -0,0 +1,259 @@
+package dropbox
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"k8s.io/utils/mount"
+)
+
+func TestPublishChecksExistingMount(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		path     string
+		readonly bool
+		code     codes.Code
+	}{
+		{name: "same source and mode", path: "docs", code: codes.OK},
+		{name: "same source with different readonly", path: "docs", readonly: true, code: codes.AlreadyExists},
+		{name: "different source", path: "photos", code: codes.AlreadyExists},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stagingPath, targetPath := path.Join(t.TempDir(), "staging"), t.TempDir()
+			n := NewNodeServer(&Config{})
+			mounter := mount.NewFakeMounter([]mount.MountPoint{
+				{Device: path.Join(stagingPath, "docs"), Path: targetPath, Type: "none", Opts: []string{"bind"}},
+			})
+			n.mounter = mounter
+			if err := os.MkdirAll(path.Join(stagingPath, test.path), 0750); err != nil {
+				t.Fatal(err)
+			}
+			markStaged(n, "published", stagingPath)
+
+			_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "published",
+				StagingTargetPath: stagingPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  mountCapability(),
+				VolumeContext:     map[string]string{"path": test.path},
+				Readonly:          test.readonly,
+			})
+			expectCode(t, err, test.code)
+			if log := mounter.GetLog(); len(log) != 0 {
+				t.Errorf("Expected the existing mount to be kept, got %v", log)
+			}
+		})
+	}
+}
+
+func TestCheckPublishedMount(t *testing.T) {
+	dir := t.TempDir()
+	source := path.Join(dir, "source")
+	bindTarget := path.Join(dir, "bind")
+	otherTarget := path.Join(dir, "other")
+	for _, d := range []string{source, otherTarget} {
+		if err := os.Mkdir(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The target of a bind mount is the source directory itself
+	if err := os.Symlink(source, bindTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNodeServer(&Config{})
+	n.mounter = mount.NewFakeMounter([]mount.MountPoint{
+		// A bind mount shows the device of the filesystem of its source
+		{Device: "/dev/sda1", Path: bindTarget, Type: "ext4", Opts: []string{"rw", "relatime"}},
+		{Device: "/dev/sda1", Path: otherTarget, Type: "ext4", Opts: []string{"ro", "relatime"}},
+		{Device: source, Path: "/ro", Type: "none", Opts: []string{"ro", "bind"}},
+	})
+
+	for _, test := range []struct {
+		name     string
+		target   string
+		readonly bool
+		code     codes.Code
+	}{
+		{name: "source directory under another device", target: bindTarget, code: codes.OK},
+		{name: "readonly mismatch", target: bindTarget, readonly: true, code: codes.AlreadyExists},
+		{name: "different directory", target: otherTarget, readonly: true, code: codes.AlreadyExists},
+		{name: "source device and readonly", target: "/ro", readonly: true, code: codes.OK},
+		{name: "target not in the mount table", target: path.Join(dir, "unknown"), code: codes.OK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			expectCode(t, n.checkPublishedMount(source, test.target, test.readonly), test.code)
+		})
+	}
+}
+
+func TestCheckLinkOptions(t *testing.T) {
+	n := NewNodeServer(&Config{})
+	markStaged(n, "writable", "")
+	markStaged(n, "readonly", "")
+	n.volumes["readonly"].ReadOnly = true
+
+	for _, test := range []struct {
+		name     string
+		volumeID string
+		readonly bool
+		flags    []string
+		code     codes.Code
+	}{
+		{name: "writable", volumeID: "writable", code: codes.OK},
+		{name: "readonly publish of a writable volume", volumeID: "writable", readonly: true, code: codes.InvalidArgument},
+		{name: "readonly publish of a readonly volume", volumeID: "readonly", readonly: true, code: codes.OK},
+		{name: "ro flag of a readonly volume", volumeID: "readonly", flags: []string{"ro"}, code: codes.OK},
+		{name: "bind mount flag", volumeID: "writable", flags: []string{"noexec"}, code: codes.InvalidArgument},
+		{name: "backend mount flag", volumeID: "writable", flags: []string{"uid=1000"}, code: codes.OK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			vc := mountCapability()
+			vc.GetMount().MountFlags = test.flags
+			expectCode(t, n.checkLinkOptions(&csi.NodePublishVolumeRequest{
+				VolumeId:         test.volumeID,
+				VolumeCapability: vc,
+				Readonly:         test.readonly,
+			}), test.code)
+		})
+	}
+}
+
+func TestUnpublishIsIdempotent(t *testing.T) {
+	targetPath := path.Join(t.TempDir(), "target")
+	if err := os.Mkdir(targetPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	n := NewNodeServer(&Config{})
+	n.mounter = mount.NewFakeMounter([]mount.MountPoint{{Device: path.Join(t.TempDir(), "staging"), Path: targetPath, Type: "none", Opts: []string{"bind"}}})
+
+	req := &csi.NodeUnpublishVolumeRequest{VolumeId: "published", TargetPath: targetPath}
+	// Unmounted and removed, then already removed on a retry of kubelet
+	for i := 0; i < 2; i++ {
+		if _, err := n.NodeUnpublishVolume(context.Background(), req); err != nil {
+			t.Fatalf("Unpublish %d: %v", i+1, err)
+		}
+		if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+			t.Fatalf("Target path after unpublish %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestPublishBindsStagingPath(t *testing.T) {
+	dir := t.TempDir()
+	stagingPath, targetPath := path.Join(dir, "staging"), path.Join(dir, "target")
+	n := NewNodeServer(&Config{})
+	mounter := mount.NewFakeMounter(nil)
+	n.mounter = mounter
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "published",
+		TargetPath:       targetPath,
+		VolumeCapability: mountCapability(),
+		VolumeContext:    map[string]string{"path": "docs"},
+	}
+	_, err := n.NodePublishVolume(context.Background(), req)
+	expectCode(t, err, codes.InvalidArgument)
+
+	req.StagingTargetPath = stagingPath
+	markStaged(n, "published", stagingPath)
+	if err := os.MkdirAll(path.Join(stagingPath, "docs"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	log := mounter.GetLog()
+	if len(log) != 1 || log[0].Source != path.Join(stagingPath, "docs") || log[0].Target != targetPath {
+		t.Errorf("Expected a bind mount of %s, got %v", path.Join(stagingPath, "docs"), log)
+	}
+}
+
+func TestStageWithoutCredentialsStagesOnPublish(t *testing.T) {
+	n := newTestNodeServer(t, &Config{})
+	dir := t.TempDir()
+	stagingPath, targetPath := path.Join(dir, "staging"), path.Join(dir, "target")
+	volCtx := map[string]string{"path": testFolder(t)}
+
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "deferred",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     volCtx,
+	}
+	if _, err := n.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, staged := n.stagedVolume("deferred"); staged {
+		t.Fatal("Volume without credentials is staged before publish")
+	}
+	// Nothing is recorded, so unstaging before publish does nothing
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "deferred", StagingTargetPath: stagingPath}
+	if _, err := n.NodeUnstageVolume(context.Background(), unstageReq); err != nil {
+		t.Fatalf("Unstage before publish: %v", err)
+	}
+	if _, err := n.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatal(err)
+	}
+
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "deferred",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     volCtx,
+	}
+	_, err := n.NodePublishVolume(context.Background(), publishReq)
+	expectCode(t, err, codes.FailedPrecondition)
+
+	publishReq.Secrets = tokenSecrets()
+	if _, err := n.NodePublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatal(err)
+	}
+	if vol, staged := n.stagedVolume("deferred"); !staged || vol.MountPath != stagingPath {
+		t.Fatalf("Volume isn't staged at %s on publish: %+v", stagingPath, vol)
+	}
+	if targets := n.publishedTargets("deferred"); len(targets) != 1 || targets[0] != targetPath {
+		t.Fatalf("Expected target %s, got %v", targetPath, targets)
+	}
+	_, err = n.NodeUnstageVolume(context.Background(), unstageReq)
+	expectCode(t, err, codes.FailedPrecondition)
+
+	if _, err := n.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "deferred", TargetPath: targetPath}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.NodeUnstageVolume(context.Background(), unstageReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, staged := n.stagedVolume("deferred"); staged {
+		t.Error("Volume is still staged after unstage")
+	}
+}
+
+func TestStageIsValidatedBeforeMountSlot(t *testing.T) {
+	n := newTestNodeServer(t, &Config{MaxConcurrentMounts: 1})
+
+	// The only mount slot is taken by a slow mount
+	if err := n.mountSem.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.mountSem.release()
+
+	for _, secrets := range []map[string]string{tokenSecrets(), nil} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "invalid",
+			StagingTargetPath: t.TempDir(),
+			VolumeCapability:  mountCapability(),
+			Secrets:           secrets,
+			VolumeContext:     map[string]string{"capacity": "lots"},
+		})
+		cancel()
+		expectCode(t, err, codes.InvalidArgument)
+	}
+}
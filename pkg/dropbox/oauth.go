@@ -0,0 +1,313 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var oauthTokenURL = "https://api.dropbox.com/oauth2/token"
+
+// Secret keys for the credentials of a volume. Either token, or appKey,
+// appSecret and refreshToken must be set.
+const (
+	secretToken        = "token"
+	secretAppKey       = "appKey"
+	secretAppSecret    = "appSecret"
+	secretRefreshToken = "refreshToken"
+)
+
+const (
+	// Minimum interval between token refreshes, in case the token endpoint
+	// returns a short or no expires_in
+	minTokenRefreshInterval = time.Minute
+	// Interval to retry a failed token refresh, doubled on each further
+	// failure up to maxTokenRefreshRetryInterval
+	tokenRefreshRetryInterval    = 30 * time.Second
+	maxTokenRefreshRetryInterval = 10 * time.Minute
+)
+
+type credentials struct {
+	token        string
+	appKey       string
+	appSecret    string
+	refreshToken string
+}
+
+func credentialsFromSecrets(secrets map[string]string) (*credentials, error) {
+	creds := &credentials{
+		token:        secrets[secretToken],
+		appKey:       secrets[secretAppKey],
+		appSecret:    secrets[secretAppSecret],
+		refreshToken: secrets[secretRefreshToken],
+	}
+	if creds.refreshToken != "" {
+		if creds.appKey == "" || creds.appSecret == "" {
+			return nil, fmt.Errorf("%s and %s are required with %s", secretAppKey, secretAppSecret, secretRefreshToken)
+		}
+		return creds, nil
+	}
+	if creds.token == "" {
+		return nil, fmt.Errorf("Token not exists")
+	}
+	return creds, nil
+}
+
+// refreshCredentialsPath is the file keeping the refresh token of a volume
+// in its config dir, so that the refresh is resumed after a restart.
+func refreshCredentialsPath(configDir string) string {
+	return path.Join(configDir, "dropbox_refresh_token")
+}
+
+type savedCredentials struct {
+	AppKey       string `json:"appKey"`
+	AppSecret    string `json:"appSecret"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// saveRefreshCredentials writes the refresh token of creds to configDir, or
+// removes the one of former credentials if creds have none.
+func saveRefreshCredentials(configDir string, creds *credentials) error {
+	p := refreshCredentialsPath(configDir)
+	if creds.refreshToken == "" {
+		return shredFiles(p)
+	}
+	data, err := json.Marshal(&savedCredentials{
+		AppKey:       creds.appKey,
+		AppSecret:    creds.appSecret,
+		RefreshToken: creds.refreshToken,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(p, string(data))
+}
+
+// loadRefreshCredentials reads the refresh token saved in configDir, and
+// returns nil if there is none.
+func loadRefreshCredentials(configDir string) (*credentials, error) {
+	data, err := ioutil.ReadFile(refreshCredentialsPath(configDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved savedCredentials
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	return credentialsFromSecrets(map[string]string{
+		secretAppKey:       saved.AppKey,
+		secretAppSecret:    saved.AppSecret,
+		secretRefreshToken: saved.RefreshToken,
+	})
+}
+
+// hasCredentials tells whether secrets hold a token or a refresh token.
+func hasCredentials(secrets map[string]string) bool {
+	return secrets[secretToken] != "" || secrets[secretRefreshToken] != ""
+}
+
+// id identifies the account of the credentials without exposing them.
+func (c *credentials) id() string {
+	if c.refreshToken != "" {
+		return c.refreshToken
+	}
+	return c.token
+}
+
+// accessToken returns an access token and its lifetime, which is 0 for a
+// long-lived token.
+func (c *credentials) accessToken(ctx context.Context) (string, time.Duration, error) {
+	if c.refreshToken == "" {
+		return c.token, 0, nil
+	}
+	return c.refresh(ctx)
+}
+
+// accessTokenWithRetry gets an access token like accessToken, retrying
+// transient failures with a jittered exponential backoff up to retries
+// times. An invalid token fails at once.
+func (c *credentials) accessTokenWithRetry(ctx context.Context, retries int, interval time.Duration) (string, time.Duration, error) {
+	for attempt := 0; ; attempt++ {
+		token, expiresIn, err := c.accessToken(ctx)
+		if err == nil || !isTransientError(err) || attempt == retries {
+			return token, expiresIn, err
+		}
+
+		wait := jitter(interval)
+		glog.Warningf("Getting access token failed (%d/%d), retrying in %v: %v", attempt+1, retries+1, wait, err)
+		select {
+		case <-ctx.Done():
+			return "", 0, err
+		case <-time.After(wait):
+		}
+		if interval *= 2; interval > maxRemountBackoff {
+			interval = maxRemountBackoff
+		}
+	}
+}
+
+func (c *credentials) refresh(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.refreshToken},
+		"client_id":     {c.appKey},
+		"client_secret": {c.appSecret},
+	}
+	req, err := http.NewRequest(http.MethodPost, oauthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Dropbox answers 400 for an invalid or revoked refresh token
+		code := resp.StatusCode
+		if code == http.StatusBadRequest {
+			code = http.StatusUnauthorized
+		}
+		return "", 0, &apiError{StatusCode: code, Summary: string(body)}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// accessTokenError converts a failure to get an access token to a gRPC error.
+func accessTokenError(err error) error {
+	if isAPIAuthError(err) {
+		return status.Errorf(codes.Unauthenticated, "Can't get access token: %v", err)
+	}
+	return status.Errorf(codes.Unavailable, "Can't get access token: %v", err)
+}
+
+// startTokenRefresh writes a new access token to the backend config of a
+// volume before the current one expires, until stopTokenRefresh is called.
+func (n *nodeServer) startTokenRefresh(volumeID string, creds *credentials, backend Backend, configDir string, expiresIn time.Duration) {
+	if creds.refreshToken == "" {
+		return
+	}
+
+	n.stopTokenRefresh(volumeID)
+	stop := make(chan struct{})
+	n.refreshersMu.Lock()
+	n.refreshers[volumeID] = stop
+	n.refreshersMu.Unlock()
+
+	go func() {
+		wait := tokenRefreshInterval(expiresIn)
+		retry := tokenRefreshRetryInterval
+		for {
+			select {
+			case <-stop:
+				return
+			case <-n.stopCh:
+				return
+			case <-time.After(wait):
+			}
+
+			token, exp, err := creds.refresh(context.Background())
+			if err != nil {
+				tokenRefreshesTotal.WithLabelValues("failure").Inc()
+				glog.Errorf("Can't refresh token of volume %s, retrying in %v: %v", volumeID, retry, err)
+				wait = retry
+				retry = nextTokenRefreshRetry(retry)
+				continue
+			}
+			if err := backend.WriteToken(configDir, token); err != nil {
+				glog.Errorf("Can't write refreshed token of volume %s: %v", volumeID, err)
+			}
+			tokenRefreshesTotal.WithLabelValues("success").Inc()
+			glog.V(4).Infof("dropbox-csi: token of volume %s is refreshed", volumeID)
+			wait = tokenRefreshInterval(exp)
+			retry = tokenRefreshRetryInterval
+		}
+	}()
+}
+
+// tokenRefreshInterval returns the time to refresh a token that expires in
+// expiresIn, when 80% of its lifetime has passed but not before
+// minTokenRefreshInterval.
+func tokenRefreshInterval(expiresIn time.Duration) time.Duration {
+	if d := expiresIn * 4 / 5; d > minTokenRefreshInterval {
+		return d
+	}
+	return minTokenRefreshInterval
+}
+
+// nextTokenRefreshRetry returns the interval to retry a token refresh that
+// failed again after retry.
+func nextTokenRefreshRetry(retry time.Duration) time.Duration {
+	if retry*2 > maxTokenRefreshRetryInterval {
+		return maxTokenRefreshRetryInterval
+	}
+	return retry * 2
+}
+
+// resumeTokenRefresh starts the refresh of the access token of a volume
+// recovered after a restart of the driver, with the refresh token saved in
+// its config dir. The access token left there may have expired while the
+// driver was down, so a new one is written at once.
+func (n *nodeServer) resumeTokenRefresh(ctx context.Context, vol *volumeState) error {
+	configDir := vol.ConfigDir
+	if configDir == "" {
+		configDir = n.volumeConfigDir(vol.VolumeID)
+	}
+	creds, err := loadRefreshCredentials(configDir)
+	if err != nil || creds == nil {
+		return err
+	}
+
+	backend := n.volumeBackend(vol.VolumeID)
+	token, expiresIn, err := creds.refresh(ctx)
+	if err != nil {
+		// Retried by the refresh after minTokenRefreshInterval
+		n.startTokenRefresh(vol.VolumeID, creds, backend, configDir, 0)
+		return err
+	}
+	if err := backend.WriteToken(configDir, token); err != nil {
+		return err
+	}
+	n.startTokenRefresh(vol.VolumeID, creds, backend, configDir, expiresIn)
+	return nil
+}
+
+func (n *nodeServer) stopTokenRefresh(volumeID string) {
+	n.refreshersMu.Lock()
+	defer n.refreshersMu.Unlock()
+
+	if stop, ok := n.refreshers[volumeID]; ok {
+		close(stop)
+		delete(n.refreshers, volumeID)
+	}
+}
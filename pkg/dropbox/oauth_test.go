@@ -0,0 +1,132 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// startTokenServer serves the OAuth token endpoint, answering every refresh
+// with a new access token.
+func startTokenServer(t *testing.T) {
+	var mu sync.Mutex
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("refresh_token") != "refresh" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		issued++
+		fmt.Fprintf(w, `{"access_token": "access-%d", "expires_in": 14400}`, issued)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	u := oauthTokenURL
+	t.Cleanup(func() { oauthTokenURL = u })
+	oauthTokenURL = server.URL
+}
+
+func refreshSecrets() map[string]string {
+	return map[string]string{secretAppKey: "key", secretAppSecret: "secret", secretRefreshToken: "refresh"}
+}
+
+func TestRefreshResumesAfterRestart(t *testing.T) {
+	startTokenServer(t)
+	dir := t.TempDir()
+	cfg := &Config{
+		RootDir:        path.Join(dir, "root"),
+		CredentialsDir: path.Join(dir, "credentials"),
+	}
+
+	n := newTestNodeServer(t, cfg)
+	req := stageRequest(t, "refresh")
+	req.Secrets = refreshSecrets()
+	if _, err := n.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	configDir := n.volumeConfigDir("refresh")
+	info, err := os.Stat(refreshCredentialsPath(configDir))
+	if err != nil {
+		t.Fatalf("Refresh token isn't saved: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Refresh token is saved with mode %v", info.Mode().Perm())
+	}
+	n.Shutdown()
+
+	// The restarted driver knows the volume from its state only
+	restarted := newTestNodeServer(t, cfg)
+	restarted.reconcileVolumes()
+
+	token, err := ioutil.ReadFile(tokenPath(configDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(token) != "access-2" {
+		t.Errorf("Expected a new access token after the restart, got %q", token)
+	}
+	restarted.refreshersMu.Lock()
+	_, refreshing := restarted.refreshers["refresh"]
+	restarted.refreshersMu.Unlock()
+	if !refreshing {
+		t.Error("Refresh of the recovered volume isn't resumed")
+	}
+}
+
+func TestSavedRefreshTokenRemovedWithLongLivedToken(t *testing.T) {
+	configDir := t.TempDir()
+	creds, err := credentialsFromSecrets(refreshSecrets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveRefreshCredentials(configDir, creds); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadRefreshCredentials(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *creds {
+		t.Errorf("Expected %+v, got %+v", creds, loaded)
+	}
+
+	// Rotated to a long-lived token
+	if err := saveRefreshCredentials(configDir, &credentials{token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := loadRefreshCredentials(configDir); loaded != nil || err != nil {
+		t.Errorf("Expected no refresh token, got %+v, %v", loaded, err)
+	}
+}
+
+func TestTokenRefreshInterval(t *testing.T) {
+	for _, tc := range []struct {
+		expiresIn time.Duration
+		want      time.Duration
+	}{
+		{4 * time.Hour, 192 * time.Minute},
+		{0, minTokenRefreshInterval},
+		{30 * time.Second, minTokenRefreshInterval},
+	} {
+		if got := tokenRefreshInterval(tc.expiresIn); got != tc.want {
+			t.Errorf("tokenRefreshInterval(%v) = %v, want %v", tc.expiresIn, got, tc.want)
+		}
+	}
+
+	retry := tokenRefreshRetryInterval
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, maxTokenRefreshRetryInterval, maxTokenRefreshRetryInterval} {
+		if retry = nextTokenRefreshRetry(retry); retry != want {
+			t.Errorf("Expected retry after %v, got %v", want, retry)
+		}
+	}
+}
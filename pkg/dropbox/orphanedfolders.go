@@ -0,0 +1,139 @@
+package dropbox
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// What the reconciler does with provisioned folders no persistent volume uses
+const (
+	orphanedFoldersReport  = "report"
+	orphanedFoldersArchive = "archive"
+	orphanedFoldersDelete  = "delete"
+)
+
+// A folder is only orphaned once it is seen without a persistent volume for
+// this long, as CreateVolume creates it before the persistent volume
+const orphanGracePeriod = 10 * time.Minute
+
+// reconcileFolders looks for provisioned folders in the account of TokenFile
+// which no persistent volume of the driver uses, as left by failed
+// DeleteVolume calls or persistent volumes deleted by hand, every
+// ReconcileInterval until the process exits.
+func (c controllerServer) reconcileFolders() {
+	if c.cfg.ReconcileInterval <= 0 {
+		return
+	}
+	if c.kube == nil || c.cfg.TokenFile == "" {
+		glog.Warningf("Not looking for orphaned folders, it requires a token file and running in a cluster")
+		return
+	}
+
+	firstSeen := map[string]time.Time{}
+	ticker := time.NewTicker(c.cfg.ReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Another replica looks for them, and starts over if it fails
+		if !c.leader.isLeader() {
+			firstSeen = map[string]time.Time{}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ReconcileInterval)
+		if err := c.reconcileFoldersOnce(ctx, firstSeen); err != nil {
+			glog.Errorf("Can't look for orphaned folders: %v", err)
+		}
+		cancel()
+	}
+}
+
+// reconcileFoldersOnce reports the orphaned folders and cleans them up as set
+// by OrphanedFolders. firstSeen keeps when each folder without a persistent
+// volume was first seen.
+func (c controllerServer) reconcileFoldersOnce(ctx context.Context, firstSeen map[string]time.Time) error {
+	pvs, err := persistentVolumes(ctx, c.kube, c.cfg.DriverName)
+	if err != nil {
+		return err
+	}
+	token, err := c.tokenFromSecretsOrFile(ctx, nil)
+	if err != nil {
+		return err
+	}
+	client := newAPIClient(c.cfg, token)
+
+	used := map[string]bool{}
+	parents := map[string]bool{defaultParentPath: true}
+	for _, pv := range pvs {
+		used[strings.Trim(pv.Spec.CSI.VolumeHandle, "/")] = true
+		// The parentPath of a StorageClass is only known from its volumes.
+		// Folders of team spaces aren't in the account of TokenFile.
+		if pv.Annotations[provisionedByAnnotation] == c.cfg.DriverName && teamSpaceFrom(pv.Spec.CSI.VolumeAttributes) == (teamSpace{}) {
+			parents[path.Dir(strings.Trim(pv.Spec.CSI.VolumeHandle, "/"))] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	var orphans []string
+	for parent := range parents {
+		if parent == "." {
+			continue
+		}
+		folders, err := client.listFolder(ctx, "/"+parent)
+		if err != nil {
+			if isAPINotFound(err) {
+				continue
+			}
+			return err
+		}
+		for _, f := range folders {
+			p := path.Join(parent, f.Name)
+			if f.Tag != "folder" || used[p] {
+				continue
+			}
+			seen[p] = true
+			if _, ok := firstSeen[p]; !ok {
+				firstSeen[p] = time.Now()
+			}
+			if time.Since(firstSeen[p]) >= orphanGracePeriod {
+				orphans = append(orphans, p)
+			}
+		}
+	}
+	// Forget the folders which got a persistent volume or were removed
+	for p := range firstSeen {
+		if !seen[p] {
+			delete(firstSeen, p)
+		}
+	}
+	sort.Strings(orphans)
+	orphanedFolderCount.Set(float64(len(orphans)))
+
+	for _, p := range orphans {
+		switch c.cfg.OrphanedFolders {
+		case orphanedFoldersArchive:
+			archivePath := path.Join(strings.Trim(c.cfg.ArchiveDir, "/"), p)
+			err = client.moveFolder(ctx, "/"+p, "/"+archivePath)
+			c.recordOrphanCleanup(p, err)
+		case orphanedFoldersDelete:
+			err = client.deleteFolder(ctx, "/"+p)
+			c.recordOrphanCleanup(p, err)
+		default:
+			glog.Warningf("Folder %s in Dropbox is used by no persistent volume of %s", p, c.cfg.DriverName)
+		}
+	}
+	return nil
+}
+
+func (c controllerServer) recordOrphanCleanup(p string, err error) {
+	if err != nil && !isAPINotFound(err) {
+		glog.Errorf("Can't %s orphaned folder %s: %v", c.cfg.OrphanedFolders, p, err)
+		orphanedFoldersCleanedTotal.WithLabelValues(c.cfg.OrphanedFolders, "error").Inc()
+		return
+	}
+	glog.Infof("Orphaned folder %s is %sd", p, c.cfg.OrphanedFolders)
+	orphanedFoldersCleanedTotal.WithLabelValues(c.cfg.OrphanedFolders, "success").Inc()
+}
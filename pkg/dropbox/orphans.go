@@ -0,0 +1,134 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/utils/mount"
+)
+
+// cleanupOrphans unmounts the mounts of the driver which belong to no staged
+// volume, as left by a node crash or a driver restart losing its state, and
+// removes the ephemeral volume, config and cache directories of unknown
+// volumes. Caches are kept with RetainCache.
+// It must run after reconcileVolumes.
+func (n *nodeServer) cleanupOrphans() {
+	known := map[string]bool{}
+	staged := map[string]bool{}
+	n.volumesMu.Lock()
+	for _, vol := range n.volumes {
+		staged[vol.VolumeID] = true
+		known[vol.MountPath] = true
+		for _, t := range vol.Targets {
+			known[t] = true
+		}
+	}
+	n.volumesMu.Unlock()
+	for _, p := range n.sharedMountPaths() {
+		known[p] = true
+	}
+	// Shared mounts keep their config and cache in a dir of this name, which
+	// is no volume
+	staged[sharedDirName] = true
+
+	mps, err := n.mounter.List()
+	if err != nil {
+		glog.Errorf("Can't list mounts to clean up orphans: %v", err)
+	} else {
+		n.unmountOrphans(mps, known)
+	}
+
+	n.removeOrphanedDirs(path.Join(n.rootDir, "ephemeral"), staged, func(dir string) {
+		for _, d := range []string{path.Join(dir, "data"), dir} {
+			if err := os.Remove(d); err != nil && !os.IsNotExist(err) {
+				glog.Errorf("Can't remove %s: %v", d, err)
+			}
+		}
+	})
+	if !n.cfg.RetainCache {
+		n.removeOrphanedDirs(path.Join(n.rootDir, "cache"), staged, func(dir string) {
+			if err := os.RemoveAll(dir); err != nil {
+				glog.Errorf("Can't remove %s: %v", dir, err)
+			}
+		})
+	}
+	n.removeOrphanedDirs(n.credentialsDir, staged, func(dir string) {
+		if err := shredDir(dir); err != nil {
+			glog.Errorf("Can't remove %s: %v", dir, err)
+		}
+	})
+}
+
+// unmountOrphans unmounts the FUSE mounts of a backend, and the bind mounts of
+// them, under the kubelet dir and rootDir which are not in known.
+func (n *nodeServer) unmountOrphans(mps []mount.MountPoint, known map[string]bool) {
+	var orphans []string
+	for _, mp := range mps {
+		if known[mp.Path] || !n.isBackendMount(mp) {
+			continue
+		}
+		if !isUnder(mp.Path, kubeletDir) && !isUnder(mp.Path, n.rootDir) {
+			continue
+		}
+		orphans = append(orphans, mp.Path)
+	}
+
+	// Bind mounts in pods go first, they are deeper than the staging paths
+	sort.Slice(orphans, func(i, j int) bool { return len(orphans[i]) > len(orphans[j]) })
+	for _, p := range orphans {
+		glog.Warningf("Unmounting orphaned mount %s", p)
+		if err := n.mounter.Unmount(p); err != nil {
+			glog.Errorf("Can't unmount orphaned mount %s: %v", p, err)
+		}
+	}
+}
+
+// isBackendMount tells whether mp is a FUSE mount of one of the backends.
+func (n *nodeServer) isBackendMount(mp mount.MountPoint) bool {
+	if !strings.HasPrefix(mp.Type, "fuse") {
+		return false
+	}
+	for name := range n.backends {
+		if strings.Contains(mp.Type, name) || strings.Contains(mp.Device, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOrphanedDirs calls remove for every directory in dir named after the
+// escaped ID of a volume which isn't staged. A directory still used as a
+// mount point is kept.
+func (n *nodeServer) removeOrphanedDirs(dir string, staged map[string]bool, remove func(dir string)) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("Can't list %s to clean up orphans: %v", dir, err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		volumeID, err := url.PathUnescape(e.Name())
+		if !e.IsDir() || err != nil || staged[volumeID] {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		if notMnt, err := n.mounter.IsLikelyNotMountPoint(p); err != nil || !notMnt {
+			continue
+		}
+		glog.Infof("Removing orphaned directory %s of volume %s", p, volumeID)
+		remove(p)
+	}
+}
+
+// isUnder tells whether p is dir or inside of it.
+func isUnder(p, dir string) bool {
+	p, dir = path.Clean(p), path.Clean(dir)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
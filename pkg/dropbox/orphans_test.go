@@ -0,0 +1,77 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"k8s.io/utils/mount"
+)
+
+func TestCleanupOrphans(t *testing.T) {
+	dir := t.TempDir()
+	n := NewNodeServer(&Config{
+		RootDir:        path.Join(dir, "root"),
+		CredentialsDir: path.Join(dir, "credentials"),
+	})
+	kubeletTarget := func(volumeID string) string {
+		return path.Join(kubeletDir, "pods/uid/volumes/kubernetes.io~csi", volumeID, "mount")
+	}
+	n.addVolume(&volumeState{
+		VolumeID:  "kept",
+		Backend:   backendDbxfs,
+		MountPath: path.Join(n.rootDir, "kept"),
+		Targets:   []string{kubeletTarget("kept")},
+	})
+
+	orphanStaging := path.Join(n.rootDir, "orphan")
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "dbxfs", Path: path.Join(n.rootDir, "kept"), Type: "fuse.dbxfs"},
+		{Device: "dbxfs", Path: kubeletTarget("kept"), Type: "fuse.dbxfs"},
+		{Device: "dbxfs", Path: orphanStaging, Type: "fuse.dbxfs"},
+		{Device: "dbxfs", Path: kubeletTarget("orphan"), Type: "fuse.dbxfs"},
+		{Device: "dropbox:", Path: path.Join(n.rootDir, "rclone-orphan"), Type: "fuse.rclone"},
+		// Mounts of other drivers and outside of the driver dirs are kept
+		{Device: "sshfs", Path: path.Join(n.rootDir, "sshfs"), Type: "fuse.sshfs"},
+		{Device: "/dev/sda1", Path: path.Join(n.rootDir, "disk"), Type: "ext4"},
+		{Device: "dbxfs", Path: "/mnt/dropbox", Type: "fuse.dbxfs"},
+	})
+	useMounter(n, mounter)
+
+	dirs := map[string]bool{
+		path.Join(n.credentialsDir, "kept"):                   true,
+		path.Join(n.credentialsDir, url.PathEscape("a/gone")): false,
+		path.Join(n.rootDir, "ephemeral", "gone", "data"):     false,
+	}
+	for dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("token"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(path.Join(n.rootDir, "ephemeral", "gone", "data", "file"))
+
+	n.cleanupOrphans()
+
+	var unmounted []string
+	for _, action := range mounter.GetLog() {
+		if action.Action == mount.FakeActionUnmount {
+			unmounted = append(unmounted, action.Target)
+		}
+	}
+	// Bind mounts in pods go first
+	expected := []string{kubeletTarget("orphan"), path.Join(n.rootDir, "rclone-orphan"), orphanStaging}
+	if !reflect.DeepEqual(unmounted, expected) {
+		t.Errorf("Expected %v to be unmounted, got %v", expected, unmounted)
+	}
+	for dir, kept := range dirs {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept: %t, got %v", dir, kept, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dropbox
+
+import (
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultRootDir = "/mnt/csi-dropbox"
+	// Expected to be a tmpfs, so credentials never hit the disk
+	defaultCredentialsDir = "/run/csi-dropbox"
+
+	// Kubelet directory holding the staging and target paths of CSI volumes
+	kubeletDir = "/var/lib/kubelet"
+
+	// Backend of the volumes which don't choose one
+	defaultBackend = backendDbxfs
+)
+
+// FUSE device the backends mount with, and the access they need to it
+const (
+	fuseDevice     = "/dev/fuse"
+	fuseAccessMode = unix.R_OK | unix.W_OK
+)
+
+// Commands the backends mount and unmount FUSE with as another user than
+// root, one of which has to be installed
+var fusermountCommands = []string{"fusermount", "fusermount3"}
+
+// Published targets are bind mounts, which take mount options
+const bindMountOptions = true
+
+// Every volume context key is supported on Linux
+var unsupportedVolumeContextKeys []string
+
+func (osNodeEnv) Access(path string, mode uint32) error {
+	return unix.Access(path, mode)
+}
+
+// processExited tells whether the process pid is gone.
+func processExited(pid int) bool {
+	return unix.Kill(pid, 0) == unix.ESRCH
+}
+
+// prepareMountPoint creates the directory a backend is mounted to.
+func prepareMountPoint(p string) error {
+	return os.MkdirAll(p, 0750)
+}
+
+// statfsUsage returns the usage of the filesystem mounted at mountPath.
+func statfsUsage(mountPath string) ([]*csi.VolumeUsage, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(mountPath, &statfs); err != nil {
+		return nil, err
+	}
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * int64(statfs.Bsize),
+			Available: int64(statfs.Bavail) * int64(statfs.Bsize),
+			Used:      int64(statfs.Blocks-statfs.Bfree) * int64(statfs.Bsize),
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
+
+// setReadOnly makes the mount at p read-only or writable again, keeping its
+// other flags. Only the mount at p changes, not the filesystem of a bind
+// mount.
+func setReadOnly(p string, readOnly bool) error {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(p, &statfs); err != nil {
+		return err
+	}
+	// The ST_ flags of statfs have the values of the MS_ flags of mount
+	flags := uintptr(statfs.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	flags |= unix.MS_REMOUNT | unix.MS_BIND
+	if readOnly {
+		flags |= unix.MS_RDONLY
+	}
+	return unix.Mount("", p, "", flags, "")
+}
@@ -0,0 +1,61 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package dropbox
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Other OSes only build the driver, e.g. to run the controller or the tests
+// of the package. The node plugin is supported on Linux and Windows.
+const (
+	defaultRootDir        = "/mnt/csi-dropbox"
+	defaultCredentialsDir = "/run/csi-dropbox"
+
+	kubeletDir = "/var/lib/kubelet"
+
+	defaultBackend = backendDbxfs
+)
+
+const (
+	fuseDevice     = "/dev/fuse"
+	fuseAccessMode = 0
+)
+
+var fusermountCommands = []string{"fusermount", "fusermount3"}
+
+const bindMountOptions = false
+
+var unsupportedVolumeContextKeys = []string{enforceCapacityKey, "mountOptions"}
+
+// Access only checks that path exists.
+func (osNodeEnv) Access(path string, mode uint32) error {
+	_, err := os.Stat(path)
+	return err
+}
+
+func processExited(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) != nil
+}
+
+func prepareMountPoint(p string) error {
+	return os.MkdirAll(p, 0750)
+}
+
+func statfsUsage(mountPath string) ([]*csi.VolumeUsage, error) {
+	return nil, fmt.Errorf("Can't get the usage of %s on %s", mountPath, runtime.GOOS)
+}
+
+func setReadOnly(p string, readOnly bool) error {
+	return fmt.Errorf("Can't change the read-only mode of %s on %s", p, runtime.GOOS)
+}
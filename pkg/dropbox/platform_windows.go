@@ -0,0 +1,102 @@
+package dropbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/windows"
+)
+
+// On Windows only the rclone backend is supported, it mounts with WinFsp.
+// Published volumes are linked to the staging path by the Windows mounter
+// instead of bind mounted.
+const (
+	defaultRootDir        = `C:\csi-dropbox`
+	defaultCredentialsDir = `C:\csi-dropbox\credentials`
+
+	kubeletDir = `C:\var\lib\kubelet`
+
+	defaultBackend = backendRclone
+)
+
+// WinFsp takes the place of the FUSE device
+const (
+	fuseDevice     = `C:\Program Files (x86)\WinFsp\bin\winfsp-x64.dll`
+	fuseAccessMode = 0
+)
+
+// WinFsp mounts without a fusermount command
+var fusermountCommands []string
+
+// Published targets are links, which can't be read-only or take mount
+// options
+const bindMountOptions = false
+
+// Volume context keys rejected instead of being ignored, as csi-proxy is not
+// used yet. Links can't be made read-only at the capacity of a volume, and
+// take no mount options.
+var unsupportedVolumeContextKeys = []string{enforceCapacityKey, "mountOptions"}
+
+// Access only checks that path exists, Windows has no access(2).
+func (osNodeEnv) Access(path string, mode uint32) error {
+	_, err := os.Stat(path)
+	return err
+}
+
+// Exit code of a running process
+const stillActive = 259
+
+func processExited(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_INVALID_PARAMETER
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code != stillActive
+}
+
+// prepareMountPoint creates the parent of p. WinFsp and the links of the
+// Windows mounter create p themselves and fail if it exists.
+func prepareMountPoint(p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// statfsUsage returns the usage of the filesystem mounted at mountPath.
+// Windows doesn't report inodes.
+func statfsUsage(mountPath string) ([]*csi.VolumeUsage, error) {
+	p, err := windows.UTF16PtrFromString(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return nil, err
+	}
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(total),
+			Available: int64(available),
+			Used:      int64(total - free),
+		},
+	}, nil
+}
+
+// setReadOnly is not supported by the links of the Windows mounter.
+func setReadOnly(p string, readOnly bool) error {
+	return fmt.Errorf("Can't change the read-only mode of %s on Windows", p)
+}
@@ -0,0 +1,280 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Interval to run the preflight checks again after the driver started, and
+// the time the checks running a command or reaching Dropbox are given
+const (
+	preflightInterval = time.Minute
+	preflightTimeout  = 10 * time.Second
+)
+
+// nodeEnv is the part of the node environment checked by Preflight.
+type nodeEnv interface {
+	LookPath(file string) (string, error)
+	// Access checks the permission of a file like access(2)
+	Access(path string, mode uint32) error
+	MkdirAll(path string, perm os.FileMode) error
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	Geteuid() int
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	Dial(ctx context.Context, addr string) error
+}
+
+type osNodeEnv struct{}
+
+func (osNodeEnv) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+func (osNodeEnv) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osNodeEnv) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (osNodeEnv) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osNodeEnv) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osNodeEnv) Geteuid() int {
+	return os.Geteuid()
+}
+
+func (osNodeEnv) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func (osNodeEnv) Dial(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Preflight checks that the node can mount Dropbox volumes: the command of the
+// default backend, if it has one, is found and runs, FUSE and fusermount are
+// available, allow_other can be used if set, the root dir is writable and
+// Dropbox is reachable. Every failed check is reported in the returned error
+// with what to do about it.
+func (n *nodeServer) Preflight(ctx context.Context) error {
+	failures := n.nodeChecks(ctx)
+	if err := n.checkDropboxReachable(ctx); err != nil {
+		failures = append(failures, err.Error())
+	}
+	return preflightError(failures)
+}
+
+// nodeChecks runs the preflight checks of the node itself and returns their
+// failures.
+func (n *nodeServer) nodeChecks(ctx context.Context) []string {
+	var failures []string
+
+	if backend, err := n.backend(nil); err != nil {
+		failures = append(failures, err.Error())
+	} else if err := n.checkBackendCommand(ctx, backend); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if err := n.env.Access(fuseDevice, fuseAccessMode); err != nil {
+		failures = append(failures, fmt.Sprintf("%s is not accessible: %v. Load the fuse kernel module and run the driver privileged", fuseDevice, err))
+	}
+	if err := n.checkFusermount(); err != nil {
+		failures = append(failures, err.Error())
+	}
+	if n.cfg.AllowOther {
+		if err := checkAllowOther(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if err := n.env.MkdirAll(n.rootDir, 0750); err != nil {
+		failures = append(failures, fmt.Sprintf("Can't create %s: %v. Check --root-dir and its volume", n.rootDir, err))
+	} else {
+		probeFile := path.Join(n.rootDir, ".preflight")
+		if err := n.env.WriteFile(probeFile, []byte("ok"), 0600); err != nil {
+			failures = append(failures, fmt.Sprintf("%s is not writable: %v. Check --root-dir and its volume", n.rootDir, err))
+		} else {
+			n.env.Remove(probeFile)
+		}
+	}
+
+	return failures
+}
+
+func preflightError(failures []string) error {
+	if len(failures) > 0 {
+		return fmt.Errorf("Preflight checks failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// checkBackendCommand checks that the command of backend is found and runs,
+// e.g. that none of its libraries is missing.
+func (n *nodeServer) checkBackendCommand(ctx context.Context, backend Backend) error {
+	// The native backend mounts in the driver
+	if backend.Command() == "" {
+		return nil
+	}
+	command, err := n.env.LookPath(backend.Command())
+	if err != nil {
+		return fmt.Errorf("%s not found: %v. Install it in the driver image, or set --dbxfs-path or --backend", backend.Command(), err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	if _, stderr, err := n.runner.Run(ctx, nil, command, "--help"); err != nil {
+		return fmt.Errorf("%s doesn't run: %v: %s", command, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// checkFusermount checks that a fusermount command is found, which the
+// backends unmount with, and mount with unless the driver runs as root.
+func (n *nodeServer) checkFusermount() error {
+	if len(fusermountCommands) == 0 {
+		return nil
+	}
+	for _, name := range fusermountCommands {
+		p, err := n.env.LookPath(name)
+		if err != nil {
+			continue
+		}
+		if n.env.Geteuid() == 0 {
+			return nil
+		}
+		info, err := n.env.Stat(p)
+		if err == nil && info.Mode()&os.ModeSetuid != 0 {
+			return nil
+		}
+		return fmt.Errorf("%s is not setuid root, so the driver can't mount as user %d. Run the driver as root or make %s setuid", p, n.env.Geteuid(), p)
+	}
+	return fmt.Errorf("None of %s is found. Install the fuse package in the driver image", strings.Join(fusermountCommands, ", "))
+}
+
+// checkDropboxReachable checks that the host of the Dropbox API resolves and
+// accepts connections.
+func (n *nodeServer) checkDropboxReachable(ctx context.Context) error {
+	u, err := url.Parse(newAPIClient(n.cfg, "").baseURL)
+	if err != nil {
+		return err
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	if _, err := n.env.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("Can't resolve %s: %v. Check the DNS of the node and the dnsPolicy of the driver pod", host, err)
+	}
+	if err := n.env.Dial(ctx, net.JoinHostPort(host, port)); err != nil {
+		return fmt.Errorf("Can't connect to %s: %v. Check the egress network policies and proxies of the node", net.JoinHostPort(host, port), err)
+	}
+	return nil
+}
+
+// checkDropboxAPI checks that the Dropbox API answers with the token in
+// TokenFile. It is skipped if no token file is configured.
+func (n *nodeServer) checkDropboxAPI(ctx context.Context) error {
+	if n.cfg.TokenFile == "" {
+		return nil
+	}
+	token, err := ioutil.ReadFile(n.cfg.TokenFile)
+	if err != nil {
+		return fmt.Errorf("Can't read token file: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	if _, err := newAPIClient(n.cfg, strings.TrimSpace(string(token))).getCurrentAccount(ctx); err != nil {
+		return fmt.Errorf("Dropbox API is not available: %v", err)
+	}
+	return nil
+}
+
+// runPreflight runs the preflight checks every preflightInterval until the
+// node server shuts down, and keeps the driver not ready while they fail.
+// Probe only fails with the checks of the node, so that the livenessprobe
+// sidecar doesn't restart the driver, and the mounts it serves, while
+// Dropbox is unreachable.
+func (n *nodeServer) runPreflight(ready *readiness) {
+	ticker := time.NewTicker(preflightInterval)
+	defer ticker.Stop()
+	failed := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*preflightTimeout)
+		failures := n.nodeChecks(ctx)
+		nodeErr := preflightError(failures)
+		if err := n.checkDropboxReachable(ctx); err != nil {
+			failures = append(failures, err.Error())
+		} else if err := n.checkDropboxAPI(ctx); err != nil {
+			failures = append(failures, err.Error())
+		}
+		cancel()
+		err := preflightError(failures)
+		if err != nil {
+			glog.Errorf("%v", err)
+		} else if failed {
+			glog.Infof("Preflight checks passed")
+		}
+		failed = err != nil
+		n.setPreflightError(nodeErr)
+		ready.setPreflightError(err)
+
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *nodeServer) setPreflightError(err error) {
+	n.preflightMu.Lock()
+	defer n.preflightMu.Unlock()
+
+	n.preflightErr = err
+	n.preflightChecked = true
+}
+
+// checkPreflight returns the result of the last checks of the node of
+// runPreflight, or runs them if they didn't run yet.
+func (n *nodeServer) checkPreflight(ctx context.Context) error {
+	n.preflightMu.Lock()
+	checked, err := n.preflightChecked, n.preflightErr
+	n.preflightMu.Unlock()
+	if checked {
+		return err
+	}
+	return preflightError(n.nodeChecks(ctx))
+}
+
+// Preflight runs the node preflight checks without serving CSI, e.g. from an
+// init container.
+func Preflight(ctx context.Context, cfg *Config) error {
+	return NewNodeServer(cfg).Preflight(ctx)
+}
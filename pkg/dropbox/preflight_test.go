@@ -0,0 +1,104 @@
+package dropbox
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestPreflight(t *testing.T) {
+	notFound := func(names ...string) func(string) (string, error) {
+		return func(file string) (string, error) {
+			for _, name := range names {
+				if file == name {
+					return "", errors.New("executable file not found in $PATH")
+				}
+			}
+			return "/usr/bin/" + file, nil
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		backend  string
+		env      *stubEnv
+		runErr   error
+		failures []string
+	}{
+		{
+			name: "all pass",
+			env:  &stubEnv{},
+		},
+		{
+			name:     "dbxfs missing",
+			env:      &stubEnv{lookPath: notFound("dbxfs")},
+			failures: []string{"dbxfs not found"},
+		},
+		{
+			name:     "dbxfs broken",
+			env:      &stubEnv{},
+			runErr:   errors.New("exit status 1"),
+			failures: []string{"dbxfs doesn't run: exit status 1"},
+		},
+		{
+			name:    "native backend needs no command",
+			backend: backendNative,
+			env:     &stubEnv{lookPath: notFound("dbxfs")},
+		},
+		{
+			name:     "fusermount missing",
+			env:      &stubEnv{lookPath: notFound("fusermount", "fusermount3")},
+			failures: []string{"None of fusermount, fusermount3 is found"},
+		},
+		{
+			name:     "fuse device inaccessible",
+			env:      &stubEnv{access: func(string) error { return os.ErrPermission }},
+			failures: []string{fuseDevice + " is not accessible"},
+		},
+		{
+			name:     "root dir not writable",
+			env:      &stubEnv{writeFile: func(string) error { return os.ErrPermission }},
+			failures: []string{defaultRootDir + " is not writable"},
+		},
+		{
+			name: "several failures",
+			env: &stubEnv{
+				lookPath: notFound("dbxfs"),
+				access:   func(string) error { return os.ErrPermission },
+			},
+			failures: []string{"dbxfs not found", fuseDevice + " is not accessible"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := NewNodeServer(&Config{Backend: test.backend})
+			n.env = test.env
+			n.runner = &stubRunner{run: func(int, string, []string) (string, string, error) {
+				return "", "", test.runErr
+			}}
+			ids := NewIdentityServer("dropbox.csi.woohhan.com", "test", n)
+
+			err := n.Preflight(context.Background())
+			_, probeErr := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if len(test.failures) == 0 {
+				if err != nil || probeErr != nil {
+					t.Fatalf("Expected no failure, got %v and probe %v", err, probeErr)
+				}
+				return
+			}
+			expectCode(t, probeErr, codes.FailedPrecondition)
+			if err == nil {
+				t.Fatal("Preflight passed")
+			}
+			for _, failure := range test.failures {
+				if !strings.Contains(err.Error(), failure) {
+					t.Errorf("Expected failure %q in %v", failure, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// Name of the Dropbox remote in the rclone config
+const rcloneRemote = "dropbox"
+
+// rcloneBackend mounts Dropbox with rclone mount, which offers VFS caching and
+// bandwidth limits.
+type rcloneBackend struct {
+	cmd     *fuseCommand
+	mirrors *mirrors
+}
+
+func newRcloneBackend(cfg *Config, runner commandRunner, mounter mount.Interface) *rcloneBackend {
+	return &rcloneBackend{
+		cmd: &fuseCommand{
+			name:    "rclone",
+			runner:  runner,
+			mounter: mounter,
+			cfg:     cfg,
+			// rclone mount stays in foreground unless --daemon is given
+			foreground: true,
+			authErrors: []string{
+				"invalid_access_token",
+				"expired_access_token",
+				"missing_scope",
+				"401 Unauthorized",
+			},
+			transientErrors: []string{
+				"connection reset",
+				"connection refused",
+				"i/o timeout",
+				"no such host",
+				"TLS handshake timeout",
+				"internal_error",
+			},
+			rateLimitErrors: []string{
+				"too_many_requests",
+			},
+			unsupportedOptionErrors: []string{
+				"unknown flag",
+			},
+		},
+		mirrors: &mirrors{mirrors: map[string]*mirror{}},
+	}
+}
+
+func (b *rcloneBackend) Name() string {
+	return backendRclone
+}
+
+func (b *rcloneBackend) Command() string {
+	return b.cmd.command()
+}
+
+func (b *rcloneBackend) Mount(ctx context.Context, req *mountRequest) (int, error) {
+	if member := req.VolumeContext[teamMemberIDKey]; member != "" && !strings.Contains(member, "@") {
+		return 0, status.Errorf(codes.InvalidArgument, "rclone selects team members by email, %s is not an email address", member)
+	}
+	if err := validateSyncMode(req.VolumeContext); err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	remote, err := b.prepareEncryption(req)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.WriteToken(req.ConfigDir, req.Token); err != nil {
+		return 0, err
+	}
+
+	cache, err := cacheArgs(req.VolumeContext, req.CacheDir)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bwLimit, err := bwLimitArgs(req.VolumeContext)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	exclude, err := excludeArgs(req.VolumeContext)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	team := rcloneTeamArgs(req.VolumeContext)
+
+	if isMirror(req.VolumeContext) {
+		var args []string
+		args = append(args, bwLimit...)
+		args = append(args, exclude...)
+		args = append(args, team...)
+		return 0, b.mountMirror(ctx, req, remote, args)
+	}
+
+	configPath := rcloneConfigPath(req.ConfigDir)
+	return b.cmd.mount(ctx, req, func(readonly bool) []string {
+		args := []string{"mount", remote + ":", req.MountPath, "--config", configPath}
+		if readonly {
+			args = append(args, "--read-only")
+		}
+		args = append(args, cache...)
+		args = append(args, bwLimit...)
+		args = append(args, exclude...)
+		if req.Owner.UID != "" {
+			args = append(args, "--uid", req.Owner.UID)
+		}
+		if req.Owner.GID != "" {
+			args = append(args, "--gid", req.Owner.GID)
+		}
+		if req.Owner.FileMode != "" {
+			args = append(args, "--file-perms", req.Owner.FileMode)
+		}
+		if req.Owner.DirMode != "" {
+			args = append(args, "--dir-perms", req.Owner.DirMode)
+		}
+		if req.Owner.AllowOther {
+			args = append(args, "--allow-other")
+		}
+		if req.Owner.DefaultPermissions {
+			args = append(args, "--default-permissions")
+		}
+		if req.Owner.Umask != "" {
+			args = append(args, "--umask", req.Owner.Umask)
+		}
+		if req.Owner.SELinuxContext != "" {
+			args = append(args, "--option", req.Owner.SELinuxContext)
+		}
+		args = append(args, team...)
+		return args
+	})
+}
+
+// prepareEncryption writes the crypt remote of an encrypted volume and
+// returns the remote to mount. The keys are only in the request when staging,
+// remounts use the crypt remote written then.
+func (b *rcloneBackend) prepareEncryption(req *mountRequest) (string, error) {
+	encrypted, err := isEncrypted(req.VolumeContext)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !encrypted {
+		return rcloneRemote, nil
+	}
+	if req.Encryption != nil {
+		if err := writeRcloneCryptConfig(req.ConfigDir, req.Encryption); err != nil {
+			return "", status.Errorf(codes.Internal, "Can't write rclone crypt config: %v", err)
+		}
+		return rcloneCryptRemote, nil
+	}
+	if config, err := readRcloneCryptConfig(req.ConfigDir); err != nil || config == "" {
+		return "", status.Error(codes.FailedPrecondition, "The keys of the encrypted volume are missing, it has to be staged again")
+	}
+	return rcloneCryptRemote, nil
+}
+
+// rcloneTeamArgs returns the flags selecting the team space of volCtx.
+func rcloneTeamArgs(volCtx map[string]string) []string {
+	var args []string
+	if ns := volCtx[namespaceIDKey]; ns != "" {
+		args = append(args, "--dropbox-root-namespace", ns)
+	}
+	if member := volCtx[teamMemberIDKey]; member != "" {
+		args = append(args, "--dropbox-impersonate", member)
+	}
+	return args
+}
+
+func (b *rcloneBackend) Unmount(mountPath string) error {
+	if err := b.unmountMirror(mountPath); err != nil {
+		return err
+	}
+	return unmountIfMounted(b.cmd.mounter, mountPath)
+}
+
+// WriteToken writes the token file and the rclone config holding the token.
+func (b *rcloneBackend) WriteToken(configDir, token string) error {
+	if err := writeFile(tokenPath(configDir), token); err != nil {
+		glog.Errorf("Can't create rclone token file: %v", err)
+		return err
+	}
+
+	rcloneToken, err := json.Marshal(map[string]string{
+		"access_token": token,
+		"token_type":   "bearer",
+	})
+	if err != nil {
+		return err
+	}
+	config := fmt.Sprintf("[%s]\ntype = dropbox\ntoken = %s\n", rcloneRemote, rcloneToken)
+	// The crypt remote of an encrypted volume is kept across token changes
+	crypt, err := readRcloneCryptConfig(configDir)
+	if err != nil {
+		return err
+	}
+	if crypt != "" {
+		config += "\n" + crypt
+	}
+	if err := writeFile(rcloneConfigPath(configDir), config); err != nil {
+		glog.Errorf("Can't create rclone config file: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (b *rcloneBackend) RemoveConfig(configDir string) error {
+	return shredFiles(rcloneConfigPath(configDir), rcloneCryptConfigPath(configDir), tokenPath(configDir))
+}
+
+func (b *rcloneBackend) Stats(mountPath string) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(mountPath)
+}
+
+func rcloneConfigPath(configDir string) string {
+	return path.Join(configDir, "rclone.conf")
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package dropbox
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
+	ginkgoconfig "github.com/onsi/ginkgo/config"
+	"google.golang.org/grpc"
+)
+
+// newTestDriver returns a driver of cfg with the fake backend, serving the
+// services of cfg.Mode.
+func newTestDriver(t *testing.T, cfg *Config) *dropbox {
+	cfg.DriverName = "dropbox.csi.k8s.io"
+	if cfg.Version == "" {
+		cfg.Version = "test"
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = "test"
+	}
+	d := &dropbox{
+		cfg:   cfg,
+		ready: newReadiness(),
+	}
+	if cfg.Mode != ModeController {
+		d.ns = newTestNodeServer(t, cfg)
+	}
+	d.ids = NewIdentityServer(cfg.DriverName, cfg.Version, d.ns)
+	if cfg.Mode != ModeNode {
+		d.cs = NewControllerServer(cfg)
+	}
+	return d
+}
+
+// serveTestDriver serves d over gRPC on a unix socket and returns the server
+// and its endpoint.
+func serveTestDriver(t *testing.T, d *dropbox) (*nonBlockingGRPCServer, string) {
+	s := NewNonBlockingGRPCServer(d.ready, 0)
+	endpoint := "unix://" + path.Join(t.TempDir(), "csi.sock")
+	s.Start(endpoint, d.ids, d.controllerService(), d.nodeService())
+	for i := 0; !d.ready.isReady(); i++ {
+		if i == 100 {
+			t.Fatal("Driver isn't serving")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Cleanup(s.ForceStop)
+	return s, endpoint
+}
+
+func dialTestDriver(t *testing.T, endpoint string) *grpc.ClientConn {
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestSanity runs csi-sanity of kubernetes-csi/csi-test against a driver with
+// the fake backend and the fake Dropbox.
+func TestSanity(t *testing.T) {
+	dir := t.TempDir()
+	// For the calls without secrets, the fake Dropbox accepts any token
+	tokenFile := path.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("fake"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(t, &Config{
+		Version:                  "sanity",
+		NodeID:                   "sanity",
+		TokenFile:                tokenFile,
+		DeleteProvisionedFolders: true,
+	})
+	_, endpoint := serveTestDriver(t, d)
+
+	config := sanity.NewTestConfig()
+	config.Address = endpoint
+	config.TargetPath = path.Join(dir, "target")
+	config.StagingPath = path.Join(dir, "staging")
+	config.SecretsFile = "../../test/sanity/secrets.yaml"
+	// The capacity of a volume isn't kept in Dropbox, so CreateVolume can't
+	// tell an existing folder of another capacity
+	ginkgoconfig.GinkgoConfig.SkipStrings = []string{"already existing name and different capacity"}
+	sanity.Test(t, config)
+}
@@ -0,0 +1,118 @@
+package dropbox
+
+import (
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchSecrets watches the secrets and persistent volumes of the cluster,
+// and writes the token of a changed nodeStageSecretRef of a staged volume to
+// the volume without remounting it. Every secret is synced again every
+// SecretWatchInterval.
+func (n *nodeServer) watchSecrets() {
+	if n.cfg.SecretWatchInterval <= 0 {
+		return
+	}
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		glog.Errorf("Can't watch secrets of volumes: %v", err)
+		return
+	}
+
+	factory := informers.NewSharedInformerFactory(kube, n.cfg.SecretWatchInterval)
+	pvs := factory.Core().V1().PersistentVolumes().Lister()
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			n.syncSecret(context.Background(), pvs, obj.(*v1.Secret))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			n.syncSecret(context.Background(), pvs, obj.(*v1.Secret))
+		},
+	})
+	factory.Start(n.stopCh)
+}
+
+// syncSecret rotates the credentials of the staged volumes whose persistent
+// volume in pvs refers to secret, if they changed.
+func (n *nodeServer) syncSecret(ctx context.Context, pvs corelisters.PersistentVolumeLister, secret *v1.Secret) {
+	list, err := pvs.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("Can't list persistent volumes: %v", err)
+		return
+	}
+	refs := map[string]*v1.SecretReference{}
+	for _, pv := range list {
+		if isDriverVolume(pv, n.cfg.DriverName) {
+			refs[pv.Spec.CSI.VolumeHandle] = nodeStageSecretRef(pv)
+		}
+	}
+
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		ref := refs[vol.VolumeID]
+		if ref != nil && ref.Namespace == secret.Namespace && ref.Name == secret.Name {
+			volumes = append(volumes, vol)
+		}
+	}
+	n.volumesMu.Unlock()
+	if len(volumes) == 0 {
+		return
+	}
+
+	creds, err := credentialsFromSecrets(secretData(secret))
+	if err != nil {
+		glog.Errorf("Invalid secret %s/%s of %d volumes: %v", secret.Namespace, secret.Name, len(volumes), err)
+		return
+	}
+	for _, vol := range volumes {
+		if hashToken(creds.id()) == vol.CredentialsHash {
+			continue
+		}
+
+		// A busy volume is rotated on the next sync
+		if !n.volumeLocks.tryAcquire(vol.VolumeID) {
+			continue
+		}
+		if err := n.rotateCredentials(ctx, vol, creds); err != nil {
+			glog.Errorf("Can't rotate credentials of volume %s: %v", vol.VolumeID, err)
+		} else {
+			glog.Infof("Credentials of volume %s are rotated from secret %s/%s", vol.VolumeID, secret.Namespace, secret.Name)
+		}
+		n.volumeLocks.release(vol.VolumeID)
+	}
+}
+
+// rotateCredentials writes the token of creds to the config of a staged
+// volume, which the backend reads on its next request. The volume lock must
+// be held.
+func (n *nodeServer) rotateCredentials(ctx context.Context, vol *volumeState, creds *credentials) error {
+	token, expiresIn, err := creds.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	backend := n.volumeBackend(vol.VolumeID)
+	configDir := vol.ConfigDir
+	if configDir == "" {
+		configDir = n.volumeConfigDir(vol.VolumeID)
+	}
+	if err := backend.WriteToken(configDir, token); err != nil {
+		return err
+	}
+	if err := saveRefreshCredentials(configDir, creds); err != nil {
+		return err
+	}
+
+	n.tokens.add(vol.VolumeID, creds.id())
+	n.startTokenRefresh(vol.VolumeID, creds, backend, configDir, expiresIn)
+	n.updateVolume(vol.VolumeID, func(vol *volumeState) {
+		vol.CredentialsHash = hashToken(creds.id())
+	})
+	return nil
+}
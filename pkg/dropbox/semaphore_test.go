@@ -0,0 +1,50 @@
+package dropbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestUnmountsProceedWhileMountsAreSaturated(t *testing.T) {
+	n := NewNodeServer(&Config{MaxConcurrentMounts: 1, MaxConcurrentUnmounts: 1})
+
+	// The only mount slot is taken by a slow mount
+	if err := n.mountSem.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.mountSem.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "waiting",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability:  mountCapability(),
+		Secrets:           map[string]string{"token": "fake"},
+	})
+	expectCode(t, err, codes.Aborted)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "published",
+		TargetPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Unpublish waits for the mounts: %v", err)
+	}
+}
+
+func TestUnboundedSemaphore(t *testing.T) {
+	s := newSemaphore(0)
+	for i := 0; i < 100; i++ {
+		if err := s.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.release()
+}
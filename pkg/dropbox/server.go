@@ -1,26 +1,39 @@
 package dropbox
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
 	server *grpc.Server
+	ready  *readiness
+	// Permissions of a unix socket endpoint, 0 to keep the umask default
+	socketMode os.FileMode
 }
 
-func NewNonBlockingGRPCServer() *nonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+func NewNonBlockingGRPCServer(ready *readiness, socketMode os.FileMode) *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{
+		ready:      ready,
+		socketMode: socketMode,
+	}
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -33,13 +46,17 @@ func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, c
 }
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	defer s.wg.Done()
+
 	proto, addr, err := parseEndpoint(endpoint)
 	if err != nil {
 		glog.Fatal(err.Error())
 	}
 
 	if proto == "unix" {
-		addr = "/" + addr
+		if err := os.MkdirAll(path.Dir(addr), 0750); err != nil {
+			glog.Fatalf("Failed to create directory of %s, error: %s", addr, err.Error())
+		}
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) { //nolint: vetshadow
 			glog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
 		}
@@ -49,6 +66,11 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	if err != nil {
 		glog.Fatalf("Failed to listen: %v", err)
 	}
+	if proto == "unix" && s.socketMode != 0 {
+		if err := os.Chmod(addr, s.socketMode); err != nil {
+			glog.Fatalf("Failed to set permissions of %s, error: %s", addr, err.Error())
+		}
+	}
 
 	opts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(logGRPC),
@@ -65,34 +87,97 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	if ns != nil {
 		csi.RegisterNodeServer(server, ns)
 	}
+	healthpb.RegisterHealthServer(server, s.ready.health)
 
 	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+	s.ready.set(true)
 
 	server.Serve(listener)
 }
 
+// parseEndpoint splits ep into the protocol and address to listen on. The
+// path of a unix endpoint is absolute, e.g. unix://tmp/csi.sock is
+// /tmp/csi.sock.
 func parseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
 		s := strings.SplitN(ep, "://", 2)
+		proto := strings.ToLower(s[0])
 		if s[1] != "" {
-			return s[0], s[1], nil
+			if proto == "unix" {
+				return proto, path.Clean("/" + s[1]), nil
+			}
+			return proto, s[1], nil
 		}
 	}
 	return "", "", fmt.Errorf("Invalid endpoint: %v", ep)
 }
 
+type requestIDKey struct{}
+
+// requestID returns the ID logGRPC gave to the RPC of ctx, to correlate other
+// logs with the RPC.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// logGRPC logs every RPC with its request ID, volume ID, duration and result
+// code as key=value pairs. Requests and responses are logged with secrets
+// stripped.
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	glog.V(5).Infof("GRPC request: %+v", protosanitizer.StripSecrets(req))
+	id := newRequestID()
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	kv := []interface{}{"requestID", id, "method", info.FullMethod}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		kv = append(kv, "volumeID", r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		kv = append(kv, "snapshotID", r.GetSnapshotId())
+	}
+	glog.V(3).Infof("GRPC call %s", formatKV(kv...))
+	glog.V(5).Infof("GRPC request %s request=%+v", formatKV("requestID", id), protosanitizer.StripSecrets(req))
+
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	duration := time.Since(start)
+	recordOperation(info.FullMethod, err, duration)
+
+	kv = append(kv, "duration", duration.String(), "code", status.Code(err).String())
 	if err != nil {
-		glog.Errorf("GRPC error: %v", err)
+		glog.Errorf("GRPC error %s", formatKV(append(kv, "error", status.Convert(err).Message())...))
 	} else {
-		glog.V(5).Infof("GRPC response: %+v", protosanitizer.StripSecrets(resp))
+		glog.V(3).Infof("GRPC done %s", formatKV(kv...))
+		glog.V(5).Infof("GRPC response %s response=%+v", formatKV("requestID", id), protosanitizer.StripSecrets(resp))
 	}
 	return resp, err
 }
 
+// formatKV formats key/value pairs as key=value, quoting the values which
+// contain spaces or quotes.
+func formatKV(kv ...interface{}) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&sb, "%v=%s", kv[i], v)
+	}
+	return sb.String()
+}
+
 func (s *nonBlockingGRPCServer) Wait() {
 	s.wg.Wait()
 }
@@ -0,0 +1,268 @@
+package dropbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Directory under rootDir, credentialsDir and the cache dir holding the
+// shared mounts
+const sharedDirName = ".shared"
+
+// Volume context keys which don't change the backend mount, so volumes
+// differing only in them can share it
+var unsharedVolumeContextKeys = map[string]bool{
+	"path":             true,
+	"createPath":       true,
+	"mountOptions":     true,
+	"capacity":         true,
+	enforceCapacityKey: true,
+	conflictFilesKey:   true,
+	"sharedLink":       true,
+	"onDelete":         true,
+}
+
+// sharedMounts counts the volumes using each shared mount. With ShareMounts,
+// volumes of the same account and mount options use one backend mount,
+// which is bind mounted to their staging paths.
+type sharedMounts struct {
+	// Guards the maps only, a shared mount is mounted and unmounted under
+	// the lock of its key
+	mu sync.Mutex
+	// Volume IDs by shared mount key
+	users map[string]map[string]bool
+	// Pid of the process serving each shared mount, 0 if unknown
+	pids map[string]int
+	// Locks of the keys in use
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	ch chan struct{}
+	// Holder and waiters of the lock, it's dropped with the last one
+	refs int
+}
+
+// newSharedMounts rebuilds the users of shared mounts from the volumes
+// recovered from the state dir.
+func newSharedMounts(volumes map[string]*volumeState) *sharedMounts {
+	s := &sharedMounts{
+		users: map[string]map[string]bool{},
+		pids:  map[string]int{},
+		locks: map[string]*keyLock{},
+	}
+	for _, vol := range volumes {
+		if vol.SharedMount == "" {
+			continue
+		}
+		if s.users[vol.SharedMount] == nil {
+			s.users[vol.SharedMount] = map[string]bool{}
+		}
+		s.users[vol.SharedMount][vol.VolumeID] = true
+		s.pids[vol.SharedMount] = vol.Pid
+	}
+	return s
+}
+
+// sharedMountKey identifies the backend mount of a volume by its backend,
+// credentials, read-only mode, owner and the backend options of volCtx.
+func sharedMountKey(backend, credsID string, readonly bool, owner mountOwner, volCtx map[string]string) string {
+	var keys []string
+	for key := range volCtx {
+		if !unsharedVolumeContextKeys[key] && !strings.Contains(key, "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%t\n%+v\n", backend, credsID, readonly, owner)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\n", key, volCtx[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// lockKey locks the shared mount of key, so that mounting the backend of one
+// shared mount doesn't hold up the others. It fails if ctx is done first.
+func (s *sharedMounts) lockKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	select {
+	case l.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		s.dropKeyLock(key, l)
+		return ctx.Err()
+	}
+}
+
+func (s *sharedMounts) unlockKey(key string) {
+	s.mu.Lock()
+	l := s.locks[key]
+	s.mu.Unlock()
+
+	<-l.ch
+	s.dropKeyLock(key, l)
+}
+
+func (s *sharedMounts) dropKeyLock(key string, l *keyLock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l.refs--; l.refs == 0 {
+		delete(s.locks, key)
+	}
+}
+
+func (n *nodeServer) sharedMountPath(key string) string {
+	return path.Join(n.rootDir, sharedDirName, key)
+}
+
+func (n *nodeServer) sharedConfigDir(key string) string {
+	return path.Join(n.credentialsDir, sharedDirName, key)
+}
+
+func (n *nodeServer) sharedCacheDir(key string) string {
+	return path.Join(n.rootDir, "cache", sharedDirName, key)
+}
+
+// mountShared bind mounts the shared mount of key to req.MountPath for
+// volumeID, mounting the backend first if the shared mount is not alive. It
+// returns the pid of the process serving the shared mount.
+func (n *nodeServer) mountShared(ctx context.Context, backend Backend, key, volumeID string, req *mountRequest) (int, error) {
+	if err := n.shared.lockKey(ctx, key); err != nil {
+		return 0, status.Errorf(codes.Aborted, "Waiting for shared mount %s: %v", key, err)
+	}
+	defer n.shared.unlockKey(key)
+
+	sharedPath := n.sharedMountPath(key)
+	n.shared.mu.Lock()
+	pid, inUse := n.shared.pids[key], len(n.shared.users[key]) > 0
+	n.shared.mu.Unlock()
+	alive := inUse && n.isSharedMountAlive(sharedPath, pid)
+	if !alive {
+		if err := backend.Unmount(sharedPath); err != nil {
+			return 0, err
+		}
+		for _, dir := range []string{sharedPath, n.sharedConfigDir(key)} {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return 0, err
+			}
+		}
+		var err error
+		pid, err = backend.Mount(ctx, &mountRequest{
+			MountPath:     sharedPath,
+			ConfigDir:     n.sharedConfigDir(key),
+			CacheDir:      n.sharedCacheDir(key),
+			Token:         req.Token,
+			ReadOnly:      req.ReadOnly,
+			Owner:         req.Owner,
+			VolumeContext: req.VolumeContext,
+			// Traffic of a shared mount can't be told apart by volume
+			Env:      n.mountEnv(path.Join(sharedDirName, key)),
+			VolumeID: path.Join(sharedDirName, key),
+			OnExit: func(pid int, err error, stderr string) {
+				glog.Warningf("Shared mount %s exited: %v: %s, its volumes are remounted by the health monitor", key, err, stderr)
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		n.shared.mu.Lock()
+		n.shared.pids[key] = pid
+		n.shared.mu.Unlock()
+		glog.Infof("Shared mount %s is mounted at %s", key, sharedPath)
+	}
+
+	options := []string{"bind"}
+	if req.ReadOnly {
+		options = append(options, "ro")
+	}
+	if err := n.mounter.Mount(sharedPath, req.MountPath, "", options); err != nil {
+		n.releaseSharedLocked(backend, key, volumeID)
+		return 0, err
+	}
+
+	n.shared.mu.Lock()
+	if n.shared.users[key] == nil {
+		n.shared.users[key] = map[string]bool{}
+	}
+	n.shared.users[key][volumeID] = true
+	n.shared.mu.Unlock()
+	return pid, nil
+}
+
+// releaseShared drops volumeID from the users of the shared mount of key,
+// and unmounts it after the last one.
+func (n *nodeServer) releaseShared(backend Backend, key, volumeID string) {
+	n.shared.lockKey(context.Background(), key)
+	defer n.shared.unlockKey(key)
+
+	n.releaseSharedLocked(backend, key, volumeID)
+}
+
+// releaseSharedLocked is releaseShared with the lock of key held.
+func (n *nodeServer) releaseSharedLocked(backend Backend, key, volumeID string) {
+	n.shared.mu.Lock()
+	delete(n.shared.users[key], volumeID)
+	if len(n.shared.users[key]) > 0 {
+		n.shared.mu.Unlock()
+		return
+	}
+	delete(n.shared.users, key)
+	delete(n.shared.pids, key)
+	n.shared.mu.Unlock()
+
+	sharedPath := n.sharedMountPath(key)
+	if err := backend.Unmount(sharedPath); err != nil {
+		glog.Errorf("Can't unmount shared mount %s: %v", sharedPath, err)
+		return
+	}
+	os.Remove(sharedPath)
+	removeVolumeConfig(backend, n.sharedConfigDir(key))
+	if !n.cfg.RetainCache {
+		if err := os.RemoveAll(n.sharedCacheDir(key)); err != nil {
+			glog.Errorf("Can't remove cache of shared mount %s: %v", key, err)
+		}
+	}
+	glog.Infof("Shared mount %s is unmounted, no volume uses it", key)
+}
+
+func (n *nodeServer) isSharedMountAlive(sharedPath string, pid int) bool {
+	if pid != 0 && processExited(pid) {
+		return false
+	}
+	notMnt, err := isNotMountPoint(n.mounter, sharedPath)
+	return err == nil && !notMnt
+}
+
+// sharedMountPaths returns the paths of the shared mounts in use.
+func (n *nodeServer) sharedMountPaths() []string {
+	n.shared.mu.Lock()
+	defer n.shared.mu.Unlock()
+
+	var paths []string
+	for key := range n.shared.users {
+		paths = append(paths, n.sharedMountPath(key))
+	}
+	return paths
+}
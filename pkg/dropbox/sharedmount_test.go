@@ -0,0 +1,102 @@
+package dropbox
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func sharedMountRequest(t *testing.T) *mountRequest {
+	return &mountRequest{MountPath: path.Join(t.TempDir(), "staging"), Token: "fake"}
+}
+
+func TestSharedMountsDontWaitForOtherKeys(t *testing.T) {
+	n := newTestNodeServer(t, &Config{ShareMounts: true})
+	backend := newBlockingBackend(n.backends[backendFake])
+	unblock := backend.blockMount(n.sharedMountPath("slow"))
+
+	slow := make(chan error, 1)
+	slowReq := sharedMountRequest(t)
+	go func() {
+		_, err := n.mountShared(context.Background(), backend, "slow", "a", slowReq)
+		slow <- err
+	}()
+	defer func() { close(unblock); <-slow }()
+
+	fast := make(chan error, 1)
+	fastReq := sharedMountRequest(t)
+	go func() {
+		_, err := n.mountShared(context.Background(), backend, "fast", "b", fastReq)
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shared mount waits for the mount of another key")
+	}
+	select {
+	case <-slow:
+		t.Fatal("Blocked shared mount is done")
+	default:
+	}
+}
+
+func TestSharedMountOfKeyIsMountedOnce(t *testing.T) {
+	n := newTestNodeServer(t, &Config{ShareMounts: true})
+	backend := newBlockingBackend(n.backends[backendFake])
+	unblock := backend.blockMount(n.sharedMountPath("key"))
+
+	done := make(chan error, 2)
+	for _, volumeID := range []string{"a", "b"} {
+		req := sharedMountRequest(t)
+		go func(volumeID string) {
+			_, err := n.mountShared(context.Background(), backend, "key", volumeID, req)
+			done <- err
+		}(volumeID)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mounts := backend.mounts(); len(mounts) != 1 {
+		t.Errorf("Expected one backend mount, got %v", mounts)
+	}
+
+	n.releaseShared(backend, "key", "a")
+	if paths := n.sharedMountPaths(); len(paths) != 1 {
+		t.Errorf("Shared mount is unmounted while used: %v", paths)
+	}
+	n.releaseShared(backend, "key", "b")
+	if paths := n.sharedMountPaths(); len(paths) != 0 {
+		t.Errorf("Shared mount is kept without users: %v", paths)
+	}
+}
+
+func TestSharedMountWaitEndsWithContext(t *testing.T) {
+	n := newTestNodeServer(t, &Config{ShareMounts: true})
+	backend := newBlockingBackend(n.backends[backendFake])
+	unblock := backend.blockMount(n.sharedMountPath("key"))
+
+	first := make(chan error, 1)
+	req := sharedMountRequest(t)
+	go func() {
+		_, err := n.mountShared(context.Background(), backend, "key", "a", req)
+		first <- err
+	}()
+	defer func() { close(unblock); <-first }()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := n.mountShared(ctx, backend, "key", "b", sharedMountRequest(t))
+	expectCode(t, err, codes.Aborted)
+}
@@ -0,0 +1,154 @@
+//go:build !windows
+// +build !windows
+
+package dropbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestShutdownCancelsInFlightStage(t *testing.T) {
+	started := make(chan struct{})
+	n, _ := newDbxfsTestNodeServer(&Config{}, func(call int, name string, args []string) (string, string, error) {
+		close(started)
+		// A slow dbxfs, killed when the stage is canceled
+		time.Sleep(50 * time.Millisecond)
+		return "", "", nil
+	})
+
+	ctx, done, ok := n.beginStage(context.Background(), "slow")
+	if !ok {
+		t.Fatal("Stage refused before shutdown")
+	}
+	errCh := make(chan error)
+	go func() {
+		defer done()
+		_, err := mountDbxfs(ctx, t, n, false)
+		errCh <- err
+	}()
+
+	<-started
+	shutdown := make(chan struct{})
+	go func() {
+		n.Shutdown()
+		close(shutdown)
+	}()
+	expectCode(t, <-errCh, codes.Aborted)
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown doesn't return after the stage is canceled")
+	}
+
+	if _, _, ok := n.beginStage(context.Background(), "late"); ok {
+		t.Error("Stage accepted after shutdown")
+	}
+}
+
+func TestCleanupStageRemovesCredentials(t *testing.T) {
+	dataDir, dir := path.Join(t.TempDir(), "data"), path.Join(t.TempDir(), "config")
+	configPath := dbxfsConfigPath(dir)
+	tokenPath := tokenPath(dir)
+	for _, p := range []string{dataDir, dir} {
+		if err := os.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{configPath, tokenPath} {
+		if err := ioutil.WriteFile(p, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := NewNodeServer(&Config{})
+	backend := n.backends[backendDbxfs]
+	n.cleanupStage(backend, dataDir, dir)
+	for _, p := range []string{configPath, tokenPath} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s is left after a failed stage: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s is left after a failed stage: %v", dir, err)
+	}
+	if _, err := os.Stat(dataDir); err != nil {
+		t.Errorf("Mount point is removed: %v", err)
+	}
+	// Already removed files are not an error
+	n.cleanupStage(backend, dataDir, dir)
+}
+
+func TestShutdownDrainsInFlightStage(t *testing.T) {
+	d := newTestDriver(t, &Config{ShutdownTimeout: time.Minute})
+	backend := newBlockingBackend(d.ns.backends[backendFake])
+	d.ns.backends[backendFake] = backend
+	s, endpoint := serveTestDriver(t, d)
+	node := csi.NewNodeClient(dialTestDriver(t, endpoint))
+
+	req := stageRequest(t, "slow")
+	unblock := backend.blockMount(req.GetStagingTargetPath())
+	staged := make(chan error, 1)
+	go func() {
+		_, err := node.NodeStageVolume(context.Background(), req)
+		staged <- err
+	}()
+	for i := 0; !isStaging(d.ns, "slow"); i++ {
+		if i == 100 {
+			t.Fatal("Stage isn't in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.shutdown(s)
+		close(stopped)
+	}()
+
+	// New RPCs are refused while the stage finishes
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := csi.NewNodeClient(dialTestDriver(t, endpoint)).NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+		cancel()
+		if err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Driver still serves new RPCs while shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Driver stopped before the in-flight stage finished")
+	default:
+	}
+
+	close(unblock)
+	if err := <-staged; err != nil {
+		t.Fatalf("In-flight stage failed: %v", err)
+	}
+	<-stopped
+	if _, ok := d.ns.stagedVolume("slow"); !ok {
+		t.Error("Volume staged during the shutdown isn't kept")
+	}
+	if d.ready.isReady() {
+		t.Error("Driver is still ready after the shutdown")
+	}
+}
+
+func isStaging(n *nodeServer, volumeID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.stages[volumeID]
+	return ok
+}
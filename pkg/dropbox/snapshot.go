@@ -0,0 +1,246 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Folder in Dropbox keeping the snapshots. A snapshot is a copy of the volume
+// folder at .csi-snapshots/<name>, described by .csi-snapshots/<name>.json.
+const snapshotsFolder = ".csi-snapshots"
+
+// snapshotInfo is stored next to the folder of every snapshot, as a folder
+// has no creation time of its own.
+type snapshotInfo struct {
+	SnapshotID     string `json:"snapshotID"`
+	SourceVolumeID string `json:"sourceVolumeID"`
+	CreationTime   int64  `json:"creationTime"`
+}
+
+func snapshotInfoPath(snapshotPath string) string {
+	return "/" + snapshotPath + ".json"
+}
+
+func (i *snapshotInfo) toCSI() *csi.Snapshot {
+	creationTime, _ := ptypes.TimestampProto(time.Unix(i.CreationTime, 0))
+	return &csi.Snapshot{
+		SnapshotId:     i.SnapshotID,
+		SourceVolumeId: i.SourceVolumeID,
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}
+}
+
+// getSnapshotInfo returns the info of the snapshot at snapshotPath, or nil if
+// there is no such snapshot.
+func getSnapshotInfo(ctx context.Context, client *apiClient, snapshotPath string) (*snapshotInfo, error) {
+	data, err := client.download(ctx, snapshotInfoPath(snapshotPath))
+	if err != nil {
+		if isAPINotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	info := &snapshotInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// CreateSnapshot copies the folder of the source volume to the snapshots
+// folder of its team space. The snapshot ID is the path of the copy, with the
+// team space of the source volume.
+func (c controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID missing in request")
+	}
+	if strings.Contains(req.GetName(), "/") {
+		return nil, status.Errorf(codes.InvalidArgument, "Snapshot name %q must not contain /", req.GetName())
+	}
+	snapshotPath, err := resolveSubPath(snapshotsFolder, req.GetName())
+	if err != nil || snapshotPath == snapshotsFolder {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid snapshot name %q", req.GetName())
+	}
+	token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	sourcePath, team := splitID(req.GetSourceVolumeId())
+	team = team.or(teamSpaceFrom(req.GetSecrets()))
+	client, err := teamAPIClient(ctx, c.cfg, token, team)
+	if err != nil {
+		return nil, err
+	}
+	snapshotID := team.id(snapshotPath)
+
+	info, err := getSnapshotInfo(ctx, client, snapshotPath)
+	if err != nil {
+		return nil, apiStatusError(err, "Can't get snapshot %s", snapshotID)
+	}
+	if info != nil {
+		if info.SourceVolumeID != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", req.GetName(), info.SourceVolumeID)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: info.toCSI()}, nil
+	}
+
+	// A copy left by a failed attempt is replaced
+	if err := client.deleteFolder(ctx, "/"+snapshotPath); err != nil {
+		return nil, apiStatusError(err, "Can't delete incomplete snapshot %s", snapshotID)
+	}
+	if err := client.copyFolder(ctx, "/"+sourcePath, "/"+snapshotPath); err != nil {
+		if isAPINotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "Source volume %s not found", req.GetSourceVolumeId())
+		}
+		return nil, apiStatusError(err, "Can't copy volume %s to %s", req.GetSourceVolumeId(), snapshotID)
+	}
+
+	info = &snapshotInfo{
+		SnapshotID:     snapshotID,
+		SourceVolumeID: req.GetSourceVolumeId(),
+		CreationTime:   time.Now().Unix(),
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := client.upload(ctx, snapshotInfoPath(snapshotPath), data); err != nil {
+		return nil, apiStatusError(err, "Can't write info of snapshot %s", snapshotID)
+	}
+	glog.V(4).Infof("dropbox-csi: volume %s is copied to snapshot %s", req.GetSourceVolumeId(), snapshotID)
+
+	return &csi.CreateSnapshotResponse{Snapshot: info.toCSI()}, nil
+}
+
+func (c controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+	snapshotPath, team := splitID(req.GetSnapshotId())
+	if !isSnapshotID(snapshotPath) {
+		// Never created by this driver, so it is already gone
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	token, err := accessTokenFromSecrets(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	client, err := teamAPIClient(ctx, c.cfg, token, team.or(teamSpaceFrom(req.GetSecrets())))
+	if err != nil {
+		return nil, err
+	}
+
+	// The info goes first, so a half deleted snapshot is never listed
+	for _, p := range []string{snapshotInfoPath(snapshotPath), "/" + snapshotPath} {
+		if err := client.deleteFolder(ctx, p); err != nil {
+			return nil, apiStatusError(err, "Can't delete %s", p)
+		}
+	}
+	glog.V(4).Infof("dropbox-csi: snapshot %s is deleted", req.GetSnapshotId())
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists the snapshots of the account of the secrets, or of
+// TokenFile if the request has no secrets. starting_token is the index of the
+// first entry.
+func (c controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	token, err := c.tokenFromSecretsOrFile(ctx, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	// The snapshots are listed in the team space of the requested snapshot
+	// or source volume
+	snapshotPath, team := splitID(req.GetSnapshotId())
+	if req.GetSnapshotId() == "" {
+		_, team = splitID(req.GetSourceVolumeId())
+	}
+	client, err := teamAPIClient(ctx, c.cfg, token, team.or(teamSpaceFrom(req.GetSecrets())))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*snapshotInfo
+	if req.GetSnapshotId() != "" {
+		if isSnapshotID(snapshotPath) {
+			info, err := getSnapshotInfo(ctx, client, snapshotPath)
+			if err != nil {
+				return nil, apiStatusError(err, "Can't get snapshot %s", req.GetSnapshotId())
+			}
+			if info != nil {
+				infos = append(infos, info)
+			}
+		}
+	} else {
+		infos, err = listSnapshotInfos(ctx, client)
+		if err != nil {
+			return nil, apiStatusError(err, "Can't list snapshots")
+		}
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, info := range infos {
+		if req.GetSourceVolumeId() != "" && info.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: info.toCSI()})
+	}
+
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// listSnapshotInfos returns the info of every snapshot sorted by ID.
+func listSnapshotInfos(ctx context.Context, client *apiClient) ([]*snapshotInfo, error) {
+	entries, err := client.listFolder(ctx, "/"+snapshotsFolder)
+	if err != nil {
+		if isAPINotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []*snapshotInfo
+	for _, e := range entries {
+		if e.Tag != "file" || !strings.HasSuffix(e.Name, ".json") {
+			continue
+		}
+		snapshotPath := path.Join(snapshotsFolder, strings.TrimSuffix(e.Name, ".json"))
+		info, err := getSnapshotInfo(ctx, client, snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].SnapshotID < infos[j].SnapshotID })
+	return infos, nil
+}
+
+func isSnapshotID(id string) bool {
+	return path.Dir(id) == snapshotsFolder && path.Base(id) != snapshotsFolder
+}
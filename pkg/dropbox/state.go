@@ -0,0 +1,128 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// stateDir keeps the volume states, apart from the volume directories under
+// rootDir.
+func stateDir(rootDir string) string {
+	return path.Join(rootDir, ".state")
+}
+
+// volumeState is persisted for every staged volume so that the node server
+// can find its volumes again after a restart.
+type volumeState struct {
+	VolumeID  string `json:"volumeID"`
+	Backend   string `json:"backend,omitempty"`
+	MountPath string `json:"mountPath"`
+	ConfigDir string `json:"configDir,omitempty"`
+	TokenPath string `json:"tokenPath,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly"`
+	// Requested size of a provisioned volume in bytes
+	Capacity int64 `json:"capacity,omitempty"`
+	// Target paths the volume is published to
+	Targets []string `json:"targets,omitempty"`
+	// Bind mounts of Targets, to bind them again after a remount
+	TargetMounts map[string]targetMount `json:"targetMounts,omitempty"`
+	// Volume context of the stage request, for the mount options of the
+	// backend on remounts
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	// Group delegated by kubelet with the stage request
+	MountGroup string `json:"mountGroup,omitempty"`
+	// Hash of the credentials the volume is mounted with
+	CredentialsHash string `json:"credentialsHash,omitempty"`
+	// Key of the shared mount bind mounted to MountPath, empty if the
+	// volume has its own mount
+	SharedMount string `json:"sharedMount,omitempty"`
+	// SELinux context= option the backend mounts with
+	SELinuxContext string `json:"seLinuxContext,omitempty"`
+	// Size of the folder of a volume with enforceCapacity in bytes, and
+	// whether it reached the capacity
+	UsedBytes    int64 `json:"usedBytes,omitempty"`
+	OverCapacity bool  `json:"overCapacity,omitempty"`
+	// Targets made read-only as the volume reached its capacity, which are
+	// made writable again when it is below
+	CapacityReadOnlyTargets []string `json:"capacityReadOnlyTargets,omitempty"`
+	// Conflicted copies found in the folder of a volume with conflictFiles,
+	// relative to it
+	ConflictedFiles []string `json:"conflictedFiles,omitempty"`
+}
+
+// targetMount is the bind mount of a target path of a volume.
+type targetMount struct {
+	Source  string   `json:"source"`
+	Options []string `json:"options,omitempty"`
+}
+
+func stateFilePath(dir, volumeID string) string {
+	return path.Join(dir, url.PathEscape(volumeID)+".json")
+}
+
+func saveVolumeState(dir string, vol *volumeState) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial state
+	p := stateFilePath(dir, vol.VolumeID)
+	if err := ioutil.WriteFile(p+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func removeVolumeState(dir, volumeID string) error {
+	err := os.Remove(stateFilePath(dir, volumeID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadVolumeStates reads every state file in dir. Unreadable files are
+// skipped with an error log.
+func loadVolumeStates(dir string) (map[string]*volumeState, error) {
+	volumes := map[string]*volumeState{}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return volumes, nil
+		}
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			glog.Errorf("Can't read volume state %s: %v", f.Name(), err)
+			continue
+		}
+		vol := &volumeState{}
+		if err := json.Unmarshal(data, vol); err != nil || vol.VolumeID == "" {
+			glog.Errorf("Can't parse volume state %s: %v", f.Name(), err)
+			continue
+		}
+		volumes[vol.VolumeID] = vol
+	}
+
+	return volumes, nil
+}
@@ -0,0 +1,57 @@
+package dropbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestRecoverVolumeStates(t *testing.T) {
+	dir := path.Join(t.TempDir(), "state")
+	staged := &volumeState{
+		VolumeID:  "csi-volumes/staged",
+		MountPath: "/mnt/csi-dropbox/data",
+		Pid:       42,
+		SubPath:   "docs",
+		ReadOnly:  true,
+	}
+	removed := &volumeState{VolumeID: "removed", MountPath: "/mnt/csi-dropbox/data"}
+	for _, vol := range []*volumeState{staged, removed} {
+		if err := saveVolumeState(dir, vol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := removeVolumeState(dir, removed.VolumeID); err != nil {
+		t.Fatal(err)
+	}
+	// Removing a state twice is not an error
+	if err := removeVolumeState(dir, removed.VolumeID); err != nil {
+		t.Fatal(err)
+	}
+	// Neither a corrupt state nor one left by a crash while saving is loaded
+	for _, name := range []string{"corrupt.json", "partial.json.tmp"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte("{"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	volumes, err := loadVolumeStates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(volumes, map[string]*volumeState{staged.VolumeID: staged}) {
+		t.Errorf("Wrong recovered volumes %v", volumes)
+	}
+}
+
+func TestLoadVolumeStatesWithoutStateDir(t *testing.T) {
+	volumes, err := loadVolumeStates(path.Join(t.TempDir(), "missing"))
+	if err != nil || len(volumes) != 0 {
+		t.Errorf("Expected no volumes, got %v, %v", volumes, err)
+	}
+	if _, err := os.Stat(path.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("State directory is created on load: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package dropbox
+
+import (
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	n := NewNodeServer(&Config{})
+
+	caps, err := n.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		if c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_GET_VOLUME_STATS {
+			advertised = true
+		}
+	}
+	if !advertised {
+		t.Fatalf("GET_VOLUME_STATS isn't advertised in %v", caps.GetCapabilities())
+	}
+
+	stats, err := n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "stats",
+		VolumePath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, usage := range stats.GetUsage() {
+		if usage.GetTotal() <= 0 {
+			t.Errorf("No %v usage in %v", usage.GetUnit(), stats.GetUsage())
+		}
+	}
+	if len(stats.GetUsage()) != 2 {
+		t.Errorf("Expected bytes and inodes usage, got %v", stats.GetUsage())
+	}
+
+	_, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "stats",
+		VolumePath: path.Join(t.TempDir(), "missing"),
+	})
+	expectCode(t, err, codes.NotFound)
+
+	_, err = n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "stats"})
+	expectCode(t, err, codes.InvalidArgument)
+}
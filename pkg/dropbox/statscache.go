@@ -0,0 +1,140 @@
+package dropbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Time the stats of a volume are given to be collected, as statfs of a
+// wedged FUSE mount hangs
+const statsCollectTimeout = 10 * time.Second
+
+// cachedStats is the last usage and condition collected for a volume.
+type cachedStats struct {
+	usage       []*csi.VolumeUsage
+	condition   *csi.VolumeCondition
+	collectedAt time.Time
+}
+
+// statsCache keeps the stats per volume, refreshed by collectStats.
+type statsCache struct {
+	mu      sync.Mutex
+	volumes map[string]*cachedStats
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{
+		volumes: map[string]*cachedStats{},
+	}
+}
+
+func (c *statsCache) get(volumeID string) *cachedStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.volumes[volumeID]
+}
+
+func (c *statsCache) set(volumeID string, stats *cachedStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.volumes[volumeID] = stats
+}
+
+func (c *statsCache) remove(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.volumes, volumeID)
+}
+
+// collectStats refreshes the stats of staged volumes every StatsInterval
+// until the node server shuts down, so that NodeGetVolumeStats, which
+// kubelet polls for every volume, doesn't statfs the mounts and call Dropbox
+// each time.
+func (n *nodeServer) collectStats() {
+	if n.cfg.StatsInterval <= 0 {
+		return
+	}
+
+	n.refreshStats()
+	ticker := time.NewTicker(n.cfg.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+			n.refreshStats()
+		}
+	}
+}
+
+func (n *nodeServer) refreshStats() {
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	n.volumesMu.Unlock()
+
+	for _, vol := range volumes {
+		type result struct {
+			stats *cachedStats
+			err   error
+		}
+		done := make(chan result, 1)
+		go func(volumeID, mountPath string) {
+			ctx, cancel := context.WithTimeout(context.Background(), statsCollectTimeout)
+			defer cancel()
+			// The space usage of volumes of one account comes from a single
+			// API call of the usage check when it runs
+			usage, err := n.volumeStats(ctx, volumeID, mountPath)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			done <- result{stats: &cachedStats{
+				usage:       usage,
+				condition:   n.volumeCondition(volumeID),
+				collectedAt: time.Now(),
+			}}
+		}(vol.VolumeID, vol.MountPath)
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				glog.Warningf("Can't collect stats of volume %s: %v", vol.VolumeID, r.err)
+				n.stats.remove(vol.VolumeID)
+				continue
+			}
+			n.stats.set(vol.VolumeID, r.stats)
+		case <-time.After(statsCollectTimeout):
+			glog.Warningf("Stats of volume %s aren't collected in %v", vol.VolumeID, statsCollectTimeout)
+			n.stats.remove(vol.VolumeID)
+		}
+	}
+}
+
+// cachedStats returns the collected stats of a volume published or staged
+// at volumePath, or nil if they are missing or stale. Other paths are
+// checked on request, so that a missing path is reported.
+func (n *nodeServer) cachedStats(volumeID, volumePath string) *cachedStats {
+	if n.cfg.StatsInterval <= 0 {
+		return nil
+	}
+	vol, ok := n.stagedVolume(volumeID)
+	if !ok || vol.MountPath != volumePath && !contains(vol.Targets, volumePath) {
+		return nil
+	}
+	cached := n.stats.get(volumeID)
+	if cached == nil || time.Since(cached.collectedAt) > 2*n.cfg.StatsInterval {
+		return nil
+	}
+	return cached
+}
@@ -0,0 +1,174 @@
+package dropbox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+)
+
+// A mount process running longer than this since its last restart is
+// considered recovered, and its crashes are forgotten
+const crashResetPeriod = 10 * time.Minute
+
+// Interval to retry taking the lock of a volume with an operation in flight
+const supervisorLockInterval = time.Second
+
+// mountCrashes counts the crashes of the mount processes of staged volumes.
+type mountCrashes struct {
+	mu      sync.Mutex
+	crashes map[string]*crashRecord
+}
+
+type crashRecord struct {
+	count       int
+	lastError   string
+	lastRestart time.Time
+}
+
+func newMountCrashes() *mountCrashes {
+	return &mountCrashes{
+		crashes: map[string]*crashRecord{},
+	}
+}
+
+// record counts a crash of the mount of volumeID and returns the number of
+// crashes since the mount was last stable.
+func (c *mountCrashes) record(volumeID, reason string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.crashes[volumeID]
+	if !ok || time.Since(r.lastRestart) > crashResetPeriod {
+		r = &crashRecord{}
+		c.crashes[volumeID] = r
+	}
+	r.count++
+	r.lastError = reason
+	r.lastRestart = time.Now()
+	return r.count
+}
+
+// get returns the number of crashes of the mount of volumeID and the reason
+// of the last one.
+func (c *mountCrashes) get(volumeID string) (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.crashes[volumeID]
+	if !ok {
+		return 0, ""
+	}
+	return r.count, r.lastError
+}
+
+func (c *mountCrashes) reset(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.crashes, volumeID)
+}
+
+// gaveUp tells whether the mount of volumeID crashed more than MountRestarts
+// times and is no longer restarted.
+func (n *nodeServer) gaveUp(volumeID string) bool {
+	count, _ := n.crashes.get(volumeID)
+	return count > n.cfg.MountRestarts
+}
+
+// mountExitHandler returns the OnExit callback of the mount of volumeID.
+func (n *nodeServer) mountExitHandler(volumeID string) func(pid int, err error, stderr string) {
+	return func(pid int, err error, stderr string) {
+		n.superviseExit(volumeID, pid, err, stderr)
+	}
+}
+
+// superviseExit restarts the mount of volumeID after its process pid exited,
+// with an exponential backoff up to MountRestarts times. An exit caused by
+// unstaging or remounting the volume is ignored.
+func (n *nodeServer) superviseExit(volumeID string, pid int, exitErr error, stderr string) {
+	reason := fmt.Sprintf("mount process %d exited: %v", pid, exitErr)
+	for {
+		if !n.lockVolume(volumeID) {
+			return
+		}
+		vol, ok := n.stagedVolume(volumeID)
+		if !ok || vol.Pid != pid {
+			n.volumeLocks.release(volumeID)
+			return
+		}
+
+		count := n.crashes.record(volumeID, reason)
+		glog.Errorf("Mount of volume %s at %s crashed (%d/%d): %s: %s", volumeID, vol.MountPath, count, n.cfg.MountRestarts, reason, stderr)
+		if count > n.cfg.MountRestarts {
+			glog.Errorf("Mount of volume %s keeps crashing, giving up until it is staged again", volumeID)
+			n.events.warning(volumeID, eventMountCrashing, fmt.Sprintf("Dropbox mount on node %s crashed %d times and is not restarted until the volume is staged again: %s", n.nodeID, count, reason))
+			n.volumeLocks.release(volumeID)
+			return
+		}
+		n.volumeLocks.release(volumeID)
+
+		backoff := n.cfg.MountRetryInterval << uint(count-1)
+		if backoff <= 0 || backoff > maxRemountBackoff {
+			backoff = maxRemountBackoff
+		}
+		select {
+		case <-n.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		if !n.lockVolume(volumeID) {
+			return
+		}
+		// The volume may have been unstaged or remounted by the monitor
+		vol, ok = n.stagedVolume(volumeID)
+		if !ok || vol.Pid != pid {
+			n.volumeLocks.release(volumeID)
+			return
+		}
+		err := n.remount(vol)
+		n.volumeLocks.release(volumeID)
+		if err == nil {
+			glog.Infof("Mount of volume %s is restarted at %s", volumeID, vol.MountPath)
+			return
+		}
+		reason = fmt.Sprintf("restart failed: %v", err)
+	}
+}
+
+// lockVolume waits for the lock of volumeID. It returns false if the node
+// server shuts down first.
+func (n *nodeServer) lockVolume(volumeID string) bool {
+	for !n.volumeLocks.tryAcquire(volumeID) {
+		select {
+		case <-n.stopCh:
+			return false
+		case <-time.After(supervisorLockInterval):
+		}
+	}
+	return true
+}
+
+func (n *nodeServer) stagedVolume(volumeID string) (*volumeState, bool) {
+	n.volumesMu.Lock()
+	defer n.volumesMu.Unlock()
+
+	vol, ok := n.volumes[volumeID]
+	return vol, ok
+}
+
+// crashCondition returns an abnormal volume condition if the mount of the
+// volume keeps crashing.
+func (n *nodeServer) crashCondition(volumeID string) *csi.VolumeCondition {
+	count, reason := n.crashes.get(volumeID)
+	if count <= n.cfg.MountRestarts {
+		return nil
+	}
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("Mount crashed %d times and is not restarted, last: %s", count, reason),
+	}
+}
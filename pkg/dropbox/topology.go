@@ -0,0 +1,88 @@
+package dropbox
+
+import (
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Topology key telling whether the node can mount Dropbox volumes
+	topologyKeyAvailable = "topology.dropbox.csi.k8s.io/available"
+	// Topology key of the Dropbox account whose credentials the node holds
+	topologyKeyAccount = "topology.dropbox.csi.k8s.io/account"
+
+	topologyProbeAttempts = 3
+)
+
+// Interval between the probes of getTopology
+var topologyProbeInterval = time.Second
+
+// getTopology returns the topology of the node once the checks of the node
+// pass, and caches it. They are run again rather than taken from
+// runPreflight, a few times within ctx, so that a node which is still
+// starting up is registered on the first NodeGetInfo. While they fail,
+// NodeGetInfo fails with Unavailable so that the registrar retries it,
+// rather than registering the node without its topology for good.
+func (n *nodeServer) getTopology(ctx context.Context) (map[string]string, error) {
+	n.topologyMu.Lock()
+	defer n.topologyMu.Unlock()
+
+	if n.topology != nil {
+		return n.topology, nil
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = preflightError(n.nodeChecks(ctx)); err == nil {
+			n.topology = n.topologySegments()
+			return n.topology, nil
+		}
+		if attempt == topologyProbeAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, status.Errorf(codes.Unavailable, "Node can't mount Dropbox volumes yet: %v", err)
+		case <-time.After(topologyProbeInterval):
+		}
+	}
+
+	glog.Warningf("Node probe failed, not registering the node yet: %v", err)
+	return nil, status.Errorf(codes.Unavailable, "Node can't mount Dropbox volumes yet: %v", err)
+}
+
+func (n *nodeServer) topologySegments() map[string]string {
+	segments := map[string]string{topologyKeyAvailable: "true"}
+	if n.cfg.TopologyAccount != "" {
+		segments[topologyKeyAccount] = n.cfg.TopologyAccount
+	}
+	return segments
+}
+
+// accountTopology returns the accessible topology of a volume of account,
+// which must be one of the requisite topologies if there are any. A volume
+// without account is accessible from every node.
+func accountTopology(account string, req *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	if account == "" {
+		return nil, nil
+	}
+
+	if requisite := req.GetRequisite(); len(requisite) > 0 {
+		found := false
+		for _, t := range requisite {
+			if t.GetSegments()[topologyKeyAccount] == account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, status.Errorf(codes.ResourceExhausted, "No node of the requisite topology holds account %s", account)
+		}
+	}
+	return []*csi.Topology{{Segments: map[string]string{topologyKeyAccount: account}}}, nil
+}
@@ -0,0 +1,86 @@
+package dropbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestNodeGetInfoRetriesProbe(t *testing.T) {
+	defer func(interval time.Duration) { topologyProbeInterval = interval }(topologyProbeInterval)
+	topologyProbeInterval = time.Millisecond
+
+	n := newTestNodeServer(t, &Config{NodeID: "node", TopologyAccount: "team-a"})
+	probes := 0
+	n.env = &stubEnv{lookPath: func(file string) (string, error) {
+		probes++
+		if probes == 1 {
+			return "", errors.New("not found")
+		}
+		return "/bin/" + file, nil
+	}}
+
+	info, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := info.GetAccessibleTopology().GetSegments()
+	if segments[topologyKeyAvailable] != "true" || segments[topologyKeyAccount] != "team-a" {
+		t.Errorf("Wrong topology %v", segments)
+	}
+	if probes != 2 {
+		t.Errorf("Expected 2 probes, got %d", probes)
+	}
+
+	// The topology is cached
+	if _, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{}); err != nil || probes != 2 {
+		t.Errorf("Topology isn't cached: %d probes, %v", probes, err)
+	}
+}
+
+func TestNodeGetInfoFailsUntilProbeSucceeds(t *testing.T) {
+	defer func(interval time.Duration) { topologyProbeInterval = interval }(topologyProbeInterval)
+	topologyProbeInterval = time.Millisecond
+
+	n := newTestNodeServer(t, &Config{NodeID: "node"})
+	broken := true
+	n.env = &stubEnv{lookPath: func(file string) (string, error) {
+		if broken {
+			return "", errors.New("not found")
+		}
+		return "/bin/" + file, nil
+	}}
+
+	_, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	expectCode(t, err, codes.Unavailable)
+
+	// The registrar retries
+	broken = false
+	info, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetAccessibleTopology().GetSegments()[topologyKeyAvailable] != "true" {
+		t.Errorf("Wrong topology %v", info.GetAccessibleTopology())
+	}
+}
+
+func TestNodeGetInfoStopsProbingWithContext(t *testing.T) {
+	n := newTestNodeServer(t, &Config{NodeID: "node"})
+	n.env = &stubEnv{lookPath: func(file string) (string, error) {
+		return "", errors.New("not found")
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := n.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	expectCode(t, err, codes.Unavailable)
+	if time.Since(start) >= topologyProbeInterval {
+		t.Errorf("NodeGetInfo waited %v after its context was done", time.Since(start))
+	}
+}
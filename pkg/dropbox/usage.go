@@ -0,0 +1,201 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// cachedUsage is the last space usage of the account of a volume.
+type cachedUsage struct {
+	usage     *spaceUsage
+	checkedAt time.Time
+}
+
+// usageCache keeps the space usage per volume, refreshed by checkUsage.
+type usageCache struct {
+	mu      sync.Mutex
+	volumes map[string]*cachedUsage
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{
+		volumes: map[string]*cachedUsage{},
+	}
+}
+
+func (c *usageCache) get(volumeID string) *cachedUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.volumes[volumeID]
+}
+
+func (c *usageCache) set(volumeID string, usage *spaceUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.volumes[volumeID] = &cachedUsage{usage: usage, checkedAt: time.Now()}
+}
+
+func (c *usageCache) remove(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.volumes, volumeID)
+}
+
+// checkUsage refreshes the space usage of staged volumes every
+// UsageCheckInterval until the node server shuts down.
+func (n *nodeServer) checkUsage() {
+	if n.cfg.UsageCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(n.cfg.UsageCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+			n.refreshUsage(context.Background())
+		}
+	}
+}
+
+func (n *nodeServer) refreshUsage(ctx context.Context) {
+	n.volumesMu.Lock()
+	var volumes []*volumeState
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	n.volumesMu.Unlock()
+
+	// Volumes of the same account share a single API call
+	byToken := map[string]*spaceUsage{}
+	for _, vol := range volumes {
+		token, err := readVolumeToken(vol)
+		if err != nil {
+			glog.Errorf("Can't read token of volume %s: %v", vol.VolumeID, err)
+			continue
+		}
+
+		team := teamSpaceFrom(vol.VolumeContext)
+		client, err := newAPIClient(n.cfg, token).forVolume(vol.VolumeID).inTeamSpace(ctx, team)
+		if err != nil {
+			n.recordAPIError(vol.VolumeID, err)
+			glog.Errorf("Can't get team member of volume %s: %v", vol.VolumeID, err)
+			continue
+		}
+		n.checkFolder(ctx, client, vol)
+		n.checkCapacity(ctx, client, vol)
+		n.checkConflicts(ctx, client, vol)
+
+		hash := hashToken(token) + team.teamMember
+		usage, ok := byToken[hash]
+		if !ok {
+			usage, err = client.getSpaceUsage(ctx)
+			if err != nil {
+				n.recordAPIError(vol.VolumeID, err)
+				glog.Errorf("Can't get space usage of volume %s: %v", vol.VolumeID, err)
+				continue
+			}
+			byToken[hash] = usage
+		}
+
+		n.recordAPIError(vol.VolumeID, nil)
+		n.usage.set(vol.VolumeID, usage)
+		n.checkQuota(vol.VolumeID, usage)
+	}
+}
+
+func readVolumeToken(vol *volumeState) (string, error) {
+	if vol.TokenPath == "" {
+		return "", fmt.Errorf("No token file for volume %s", vol.VolumeID)
+	}
+	data, err := ioutil.ReadFile(vol.TokenPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Maximum age of the cached space usage served in NodeGetVolumeStats
+const maxUsageAge = time.Minute
+
+// spaceUsage returns the space usage of the account of a staged volume from
+// the cache, or from the Dropbox API if the cache is stale.
+func (n *nodeServer) spaceUsage(ctx context.Context, volumeID string) (*spaceUsage, error) {
+	maxAge := maxUsageAge
+	if n.cfg.UsageCheckInterval > maxAge {
+		maxAge = n.cfg.UsageCheckInterval
+	}
+	if cached := n.usage.get(volumeID); cached != nil && time.Since(cached.checkedAt) < maxAge {
+		return cached.usage, nil
+	}
+
+	n.volumesMu.Lock()
+	vol, ok := n.volumes[volumeID]
+	n.volumesMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Volume %s is not staged", volumeID)
+	}
+
+	token, err := readVolumeToken(vol)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAPIClient(n.cfg, token).inTeamSpace(ctx, teamSpaceFrom(vol.VolumeContext))
+	if err != nil {
+		return nil, err
+	}
+	usage, err := client.getSpaceUsage(ctx)
+	n.recordAPIError(volumeID, err)
+	if err != nil {
+		return nil, err
+	}
+	n.usage.set(volumeID, usage)
+
+	return usage, nil
+}
+
+// checkQuota warns when the account of a volume is fuller than
+// QuotaWarningThreshold, before writes start failing.
+func (n *nodeServer) checkQuota(volumeID string, usage *spaceUsage) {
+	ratio := usage.usedRatio()
+	quotaUsageRatio.WithLabelValues(volumeID).Set(ratio)
+	if n.cfg.QuotaWarningThreshold > 0 && ratio >= n.cfg.QuotaWarningThreshold {
+		quotaWarningsTotal.WithLabelValues(volumeID).Inc()
+		glog.Warningf("Dropbox account of volume %s is %.0f%% full", volumeID, ratio*100)
+		reason := eventQuotaLow
+		if ratio >= 1 {
+			reason = eventQuotaExceeded
+		}
+		n.events.warning(volumeID, reason, fmt.Sprintf("Dropbox account is %.0f%% full", ratio*100))
+	}
+}
+
+// quotaCondition returns an abnormal volume condition if the cached usage of
+// the volume is over QuotaWarningThreshold.
+func (n *nodeServer) quotaCondition(volumeID string) *csi.VolumeCondition {
+	cached := n.usage.get(volumeID)
+	if cached == nil || n.cfg.QuotaWarningThreshold <= 0 {
+		return nil
+	}
+
+	ratio := cached.usage.usedRatio()
+	if ratio < n.cfg.QuotaWarningThreshold {
+		return nil
+	}
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("Dropbox account is %.0f%% full", ratio*100),
+	}
+}
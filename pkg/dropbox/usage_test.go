@@ -0,0 +1,91 @@
+package dropbox
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+)
+
+func testUsage(used, allocated uint64) *spaceUsage {
+	usage := &spaceUsage{Used: used}
+	usage.Allocation.Allocated = allocated
+	return usage
+}
+
+func TestGetSpaceUsage(t *testing.T) {
+	client := newTestAPIClient(t, http.StatusOK, `{"used": 90, "allocation": {".tag": "individual", "allocated": 100}}`)
+
+	usage, err := client.getSpaceUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio := usage.usedRatio(); ratio != 0.9 {
+		t.Errorf("Expected usage ratio 0.9, got %v", ratio)
+	}
+}
+
+func TestQuotaWarningThreshold(t *testing.T) {
+	n := NewNodeServer(&Config{QuotaWarningThreshold: 0.9})
+	volumeID := "quota-" + t.Name()
+	warnings := quotaWarningsTotal.WithLabelValues(volumeID)
+
+	for _, tc := range []struct {
+		used     uint64
+		warnings float64
+		abnormal bool
+	}{
+		{used: 50, warnings: 0, abnormal: false},
+		{used: 89, warnings: 0, abnormal: false},
+		{used: 90, warnings: 1, abnormal: true},
+		{used: 120, warnings: 1, abnormal: true},
+		{used: 10, warnings: 0, abnormal: false},
+	} {
+		usage := testUsage(tc.used, 100)
+		before := testutil.ToFloat64(warnings)
+		n.usage.set(volumeID, usage)
+		n.checkQuota(volumeID, usage)
+
+		if got := testutil.ToFloat64(warnings) - before; got != tc.warnings {
+			t.Errorf("%d%% full: expected %v warnings, got %v", tc.used, tc.warnings, got)
+		}
+		if got := testutil.ToFloat64(quotaUsageRatio.WithLabelValues(volumeID)); got != usage.usedRatio() {
+			t.Errorf("%d%% full: expected usage ratio %v, got %v", tc.used, usage.usedRatio(), got)
+		}
+		stats, err := n.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   volumeID,
+			VolumePath: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if abnormal := stats.GetVolumeCondition().GetAbnormal(); abnormal != tc.abnormal {
+			t.Errorf("%d%% full: expected abnormal %v, got condition %v", tc.used, tc.abnormal, stats.GetVolumeCondition())
+		}
+	}
+}
+
+func TestQuotaWarningDisabled(t *testing.T) {
+	n := NewNodeServer(&Config{})
+	volumeID := "quota-" + t.Name()
+	warnings := quotaWarningsTotal.WithLabelValues(volumeID)
+
+	usage := testUsage(100, 100)
+	n.usage.set(volumeID, usage)
+	n.checkQuota(volumeID, usage)
+	if got := testutil.ToFloat64(warnings); got != 0 {
+		t.Errorf("Expected no warnings without a threshold, got %v", got)
+	}
+	if cond := n.quotaCondition(volumeID); cond != nil {
+		t.Errorf("Expected no condition without a threshold, got %v", cond)
+	}
+	// An unknown allocation is never over the threshold
+	n.cfg.QuotaWarningThreshold = 0.9
+	usage = testUsage(100, 0)
+	n.checkQuota(volumeID, usage)
+	if got := testutil.ToFloat64(warnings); got != 0 {
+		t.Errorf("Expected no warnings of an unknown allocation, got %v", got)
+	}
+}
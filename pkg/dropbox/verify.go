@@ -0,0 +1,63 @@
+package dropbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// Verify checks that the node can reach and authenticate to Dropbox with
+// token. If testMount is set, the default backend is also mounted to a temporary directory
+// and torn down immediately.
+func Verify(ctx context.Context, cfg *Config, token string, testMount bool) error {
+	n := NewNodeServer(cfg)
+	return n.verify(ctx, newAPIClient(cfg, token), token, testMount)
+}
+
+func (n *nodeServer) verify(ctx context.Context, client *apiClient, token string, testMount bool) error {
+	dir, err := ioutil.TempDir("", "csi-dropbox-verify")
+	if err != nil {
+		return fmt.Errorf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	acc, err := client.getCurrentAccount(ctx)
+	if err != nil {
+		if isAPIAuthError(err) {
+			return fmt.Errorf("Dropbox authentication failed: %v", err)
+		}
+		return fmt.Errorf("Can't reach Dropbox: %v", err)
+	}
+	glog.Infof("Authenticated to Dropbox as %s", acc.Email)
+
+	if !testMount {
+		return nil
+	}
+
+	mountDir := path.Join(dir, "data")
+	if err := os.MkdirAll(mountDir, 0750); err != nil {
+		return fmt.Errorf("Can't create mount directory: %v", err)
+	}
+	backend, err := n.backend(nil)
+	if err != nil {
+		return err
+	}
+	_, err = backend.Mount(ctx, &mountRequest{
+		MountPath: mountDir,
+		ConfigDir: dir,
+		Token:     token,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("Test mount failed: %v", err)
+	}
+	if err := backend.Unmount(mountDir); err != nil {
+		return fmt.Errorf("Can't unmount test mount: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// newTestAPIClient returns a client of an API server answering every call with
+// status and body.
+func newTestAPIClient(t *testing.T, status int, body string) *apiClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	client := newAPIClient(&Config{DropboxAPIURL: server.URL}, "fake")
+	return client
+}
+
+func TestVerifyMountsAndUnmounts(t *testing.T) {
+	var config map[string]interface{}
+	mounter := mount.NewFakeMounter(nil)
+	n, runner := newDbxfsTestNodeServer(&Config{}, func(call int, name string, args []string) (string, string, error) {
+		data, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return "", "", err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", "", err
+		}
+		return "", "", mounter.Mount("dbxfs", args[0], "fuse", nil)
+	})
+	useMounter(n, mounter)
+	client := newTestAPIClient(t, http.StatusOK, `{"account_id": "dbid:1", "email": "user@example.com"}`)
+
+	if err := n.verify(context.Background(), client, "fake", true); err != nil {
+		t.Fatal(err)
+	}
+	commands := runner.commands()
+	if len(commands) != 1 {
+		t.Fatalf("Expected one test mount, got %v", commands)
+	}
+	if !strings.Contains(strings.Join(commands[0], " "), "-o ro") {
+		t.Errorf("Test mount isn't read-only: %v", commands[0])
+	}
+	if _, ok := config["access_token_command"]; !ok {
+		t.Errorf("dbxfs config has no token: %v", config)
+	}
+	if config["send_error_reports"] != false {
+		t.Errorf("dbxfs sends error reports with config %v", config)
+	}
+	if mps, _ := mounter.List(); len(mps) != 0 {
+		t.Errorf("Test mount isn't torn down: %v", mps)
+	}
+}
+
+func TestVerifyWithoutTestMount(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{}, nil)
+	client := newTestAPIClient(t, http.StatusOK, `{"account_id": "dbid:1", "email": "user@example.com"}`)
+
+	if err := n.verify(context.Background(), client, "fake", false); err != nil {
+		t.Fatal(err)
+	}
+	if commands := runner.commands(); len(commands) != 0 {
+		t.Errorf("Mounted without a test mount: %v", commands)
+	}
+}
+
+func TestVerifyFailsWithoutAuthentication(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{}, nil)
+	client := newTestAPIClient(t, http.StatusUnauthorized, `{"error_summary": "invalid_access_token/"}`)
+
+	err := n.verify(context.Background(), client, "revoked", true)
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected an authentication failure, got %v", err)
+	}
+	if commands := runner.commands(); len(commands) != 0 {
+		t.Errorf("Mounted without authentication: %v", commands)
+	}
+}
@@ -0,0 +1,248 @@
+package dropbox
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	backendDbxfs  = "dbxfs"
+	backendRclone = "rclone"
+	backendNative = "native"
+)
+
+// Volume context keys and the backends supporting them
+var volumeContextKeys = map[string][]string{
+	"backend":          {backendDbxfs, backendRclone, backendNative},
+	"path":             {backendDbxfs, backendRclone, backendNative},
+	"createPath":       {backendDbxfs, backendRclone, backendNative},
+	"mountOptions":     {backendDbxfs, backendRclone, backendNative},
+	"capacity":         {backendDbxfs, backendRclone, backendNative},
+	enforceCapacityKey: {backendDbxfs, backendRclone, backendNative},
+	conflictFilesKey:   {backendDbxfs, backendRclone, backendNative},
+	"sharedLink":       {backendDbxfs, backendRclone, backendNative},
+	"onDelete":         {backendDbxfs, backendRclone, backendNative},
+	encryptionKey:      {backendRclone},
+	"uid":              {backendDbxfs, backendRclone, backendNative},
+	"gid":              {backendDbxfs, backendRclone, backendNative},
+	"fileMode":         {backendRclone, backendNative},
+	"dirMode":          {backendRclone, backendNative},
+	allowOtherKey:      {backendDbxfs, backendRclone, backendNative},
+	defaultPermsKey:    {backendDbxfs, backendRclone, backendNative},
+	umaskKey:           {backendDbxfs, backendRclone, backendNative},
+	"cacheMode":        {backendRclone},
+	"cacheMaxSize":     {backendRclone},
+	"cacheMaxAge":      {backendRclone},
+	"bwLimitUpload":    {backendRclone},
+	"bwLimitDownload":  {backendRclone},
+	"exclude":          {backendRclone},
+	syncModeKey:        {backendRclone},
+	namespaceIDKey:     {backendRclone, backendNative},
+	teamMemberIDKey:    {backendRclone, backendNative},
+}
+
+// StorageClass parameters passed to the volumes as volume context
+var storageClassVolumeContextKeys = []string{
+	"mountOptions",
+	"uid", "gid", "fileMode", "dirMode",
+	allowOtherKey, defaultPermsKey, umaskKey,
+	"cacheMode", "cacheMaxSize", "cacheMaxAge",
+	"bwLimitUpload", "bwLimitDownload",
+	"exclude",
+	"createPath",
+	syncModeKey,
+	encryptionKey,
+	enforceCapacityKey,
+	conflictFilesKey,
+}
+
+// validateVolumeContext checks that every key in volCtx is supported by the
+// backend. Prefixed keys (e.g. csi.storage.k8s.io/pod.name) are set by
+// kubernetes and are always allowed. Unknown keys are only logged, so that
+// volumes created with attributes of other driver versions still stage.
+func validateVolumeContext(backend string, volCtx map[string]string) error {
+	for key := range volCtx {
+		if strings.Contains(key, "/") {
+			continue
+		}
+		backends, ok := volumeContextKeys[key]
+		if !ok {
+			glog.Warningf("Ignoring unknown volume context key %q", key)
+			continue
+		}
+		if !contains(backends, backend) {
+			return fmt.Errorf("Volume context key %q is not supported by %s backend", key, backend)
+		}
+		if contains(unsupportedVolumeContextKeys, key) {
+			return fmt.Errorf("Volume context key %q is not supported on %s", key, runtime.GOOS)
+		}
+	}
+	return nil
+}
+
+// capacityFromVolumeContext returns the capacity volume attribute set by
+// CreateVolume, or 0 if there is none.
+func capacityFromVolumeContext(volCtx map[string]string) (int64, error) {
+	c, ok := volCtx["capacity"]
+	if !ok {
+		return 0, nil
+	}
+	capacity, err := strconv.ParseInt(c, 10, 64)
+	if err != nil || capacity < 0 {
+		return 0, fmt.Errorf("Invalid capacity %q", c)
+	}
+	return capacity, nil
+}
+
+// Variables of a path template, and the volume context keys set by kubelet
+// for them when the CSIDriver has podInfoOnMount
+var pathTemplateVariables = map[string]string{
+	"pod.name":            "csi.storage.k8s.io/pod.name",
+	"pod.namespace":       "csi.storage.k8s.io/pod.namespace",
+	"pod.uid":             "csi.storage.k8s.io/pod.uid",
+	"serviceAccount.name": "csi.storage.k8s.io/serviceAccount.name",
+}
+
+var pathTemplateRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+func isPathTemplate(p string) bool {
+	return pathTemplateRegexp.MatchString(p)
+}
+
+// expandPathTemplate replaces the ${...} variables in p with the pod info in
+// volCtx, e.g. backups/${pod.namespace}/${pod.name}.
+func expandPathTemplate(p string, volCtx map[string]string) (string, error) {
+	var err error
+	expanded := pathTemplateRegexp.ReplaceAllStringFunc(p, func(m string) string {
+		name := pathTemplateRegexp.FindStringSubmatch(m)[1]
+		key, ok := pathTemplateVariables[name]
+		if !ok {
+			err = fmt.Errorf("Unknown variable %q in path %q", name, p)
+			return ""
+		}
+		value := volCtx[key]
+		if value == "" || strings.Contains(value, "/") || value == ".." {
+			err = fmt.Errorf("Invalid value %q of %s for path %q, is podInfoOnMount enabled?", value, name, p)
+			return ""
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// validateSubPath rejects a path which is absolute or has a ".." segment,
+// even one that stays inside the volume root after cleaning.
+func validateSubPath(sub string) error {
+	if strings.ContainsRune(sub, 0) {
+		return fmt.Errorf("Path %q contains a NUL byte", sub)
+	}
+	if path.IsAbs(sub) {
+		return fmt.Errorf("Path %q must be relative", sub)
+	}
+	for _, segment := range strings.Split(sub, "/") {
+		if segment == ".." {
+			return fmt.Errorf("Path %q must not contain ..", sub)
+		}
+	}
+	return nil
+}
+
+// resolveSubPath joins sub to base. sub must pass validateSubPath, "" and "."
+// refer to base itself.
+func resolveSubPath(base, sub string) (string, error) {
+	if err := validateSubPath(sub); err != nil {
+		return "", err
+	}
+	cleaned := path.Clean(sub)
+	if cleaned == "." {
+		return base, nil
+	}
+	return path.Join(base, cleaned), nil
+}
+
+// mountOwner is the owner and the permissions the files of a mount show up
+// with. Unset fields keep the defaults of the backend.
+type mountOwner struct {
+	UID      string
+	GID      string
+	FileMode string
+	DirMode  string
+	// FUSE options letting other users than the driver access the mount,
+	// checking the permissions of the files in the kernel, and masking them
+	AllowOther         bool
+	DefaultPermissions bool
+	Umask              string
+	// context= mount option labeling the files for SELinux
+	SELinuxContext string
+}
+
+// mountOwnerFromVolumeContext returns the owner of a mount from the uid, gid,
+// fileMode and dirMode attributes in volCtx, and its FUSE options from the
+// allowOther, defaultPermissions and umask attributes, or cfg if unset.
+// mountGroup is the group kubelet delegates the fsGroup of the pod with, used
+// unless gid is set, and makes the files writable by the group by default.
+func mountOwnerFromVolumeContext(volCtx map[string]string, mountGroup string, cfg *Config) (mountOwner, error) {
+	owner := mountOwner{
+		UID:                volCtx["uid"],
+		GID:                volCtx["gid"],
+		FileMode:           volCtx["fileMode"],
+		DirMode:            volCtx["dirMode"],
+		AllowOther:         cfg.AllowOther,
+		DefaultPermissions: cfg.DefaultPermissions,
+		Umask:              cfg.Umask,
+	}
+	for key, opt := range map[string]*bool{allowOtherKey: &owner.AllowOther, defaultPermsKey: &owner.DefaultPermissions} {
+		v, ok := volCtx[key]
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return mountOwner{}, fmt.Errorf("Invalid %s %q", key, v)
+		}
+		*opt = b
+	}
+	if umask, ok := volCtx[umaskKey]; ok {
+		if err := validateUmask(umask); err != nil {
+			return mountOwner{}, err
+		}
+		owner.Umask = umask
+	}
+	if owner.GID == "" && mountGroup != "" {
+		owner.GID = mountGroup
+		if owner.FileMode == "" {
+			owner.FileMode = "0664"
+		}
+		if owner.DirMode == "" {
+			owner.DirMode = "0775"
+		}
+	}
+
+	for key, id := range map[string]string{"uid": owner.UID, "gid": owner.GID} {
+		if id == "" {
+			continue
+		}
+		if n, err := strconv.ParseUint(id, 10, 32); err != nil || n == math.MaxUint32 {
+			return mountOwner{}, fmt.Errorf("Invalid %s %q", key, id)
+		}
+	}
+	for key, mode := range map[string]string{"fileMode": owner.FileMode, "dirMode": owner.DirMode} {
+		if mode == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(mode, 8, 12); err != nil {
+			return mountOwner{}, fmt.Errorf("Invalid %s %q, must be an octal mode like 0644", key, mode)
+		}
+	}
+	return owner, nil
+}
@@ -0,0 +1,173 @@
+package dropbox
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolveSubPath(t *testing.T) {
+	for _, tc := range []struct {
+		sub     string
+		want    string
+		wantErr bool
+	}{
+		{sub: "", want: "/staging"},
+		{sub: ".", want: "/staging"},
+		{sub: "a/b", want: "/staging/a/b"},
+		{sub: "./", want: "/staging"},
+		{sub: "a/b/", want: "/staging/a/b"},
+		{sub: "a//b", want: "/staging/a/b"},
+		{sub: "./a", want: "/staging/a"},
+		{sub: "a/../b", wantErr: true},
+		{sub: "a/..", wantErr: true},
+		{sub: "a\x00b", wantErr: true},
+		{sub: "a..b/..c", want: "/staging/a..b/..c"},
+		{sub: "//a", wantErr: true},
+		{sub: "../../etc", wantErr: true},
+		{sub: "..", wantErr: true},
+		{sub: "/etc", wantErr: true},
+		{sub: "/", wantErr: true},
+		{sub: "a/../..", wantErr: true},
+		{sub: "a/b/../../..", wantErr: true},
+		{sub: "./..", wantErr: true},
+		{sub: "\x00", wantErr: true},
+	} {
+		got, err := resolveSubPath("/staging", tc.sub)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.sub, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q: expected %q, got %q, %v", tc.sub, tc.want, got, err)
+		}
+	}
+}
+
+func TestExpandPathTemplate(t *testing.T) {
+	volCtx := func(podName string) map[string]string {
+		return map[string]string{
+			"csi.storage.k8s.io/pod.name":      podName,
+			"csi.storage.k8s.io/pod.namespace": "default",
+		}
+	}
+	for _, tc := range []struct {
+		template string
+		podName  string
+		want     string
+		wantErr  bool
+	}{
+		{template: "backups/${pod.namespace}/${pod.name}", podName: "web", want: "backups/default/web"},
+		{template: "${pod.name}", podName: "..", wantErr: true},
+		{template: "a/${pod.name}/b", podName: "../..", wantErr: true},
+		{template: "${pod.name}", podName: "", wantErr: true},
+		{template: "${pod.unknown}", podName: "web", wantErr: true},
+	} {
+		got, err := expandPathTemplate(tc.template, volCtx(tc.podName))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q with pod %q: expected an error, got %q", tc.template, tc.podName, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q with pod %q: expected %q, got %q, %v", tc.template, tc.podName, tc.want, got, err)
+		}
+	}
+}
+
+// Malicious paths are rejected before anything is mounted, when staging and
+// when publishing.
+func TestVolumePathTraversal(t *testing.T) {
+	n := newTestNodeServer(t, &Config{})
+	ctx := context.Background()
+	dir := t.TempDir()
+	stagingPath := path.Join(dir, "staging")
+
+	for _, p := range []string{"../../etc", "/etc", "a/../..", "${pod.name}/.."} {
+		_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "traversal",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  mountCapability(),
+			VolumeContext:     map[string]string{"path": p},
+			Secrets:           tokenSecrets(),
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	}
+
+	volCtx := map[string]string{"path": testFolder(t)}
+	if _, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "traversal",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     volCtx,
+		Secrets:           tokenSecrets(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"../../etc", "/etc", "a/../..", "${pod.name}/..", "${pod.name}"} {
+		_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "traversal",
+			StagingTargetPath: stagingPath,
+			TargetPath:        path.Join(dir, "target"),
+			VolumeCapability:  mountCapability(),
+			VolumeContext: map[string]string{
+				"path":                        p,
+				"csi.storage.k8s.io/pod.name": "..",
+			},
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	}
+	if mps, _ := n.mounter.List(); len(mps) != 1 {
+		t.Errorf("Expected only the staging mount, got %+v", mps)
+	}
+}
+
+func TestValidateVolumeContext(t *testing.T) {
+	for _, tc := range []struct {
+		backend string
+		key     string
+		wantErr bool
+	}{
+		{backend: backendRclone, key: "cacheMode"},
+		{backend: backendDbxfs, key: "cacheMode", wantErr: true},
+		{backend: backendDbxfs, key: encryptionKey, wantErr: true},
+		{backend: backendDbxfs, key: "uid"},
+		{backend: backendFake, key: "path"},
+		{backend: backendFake, key: "cacheMode", wantErr: true},
+		{backend: backendNative, key: "uid"},
+		// Unknown keys are logged only, e.g. of a newer driver version
+		{backend: backendRclone, key: "compress"},
+		{backend: backendDbxfs, key: "csi.storage.k8s.io/pod.name"},
+	} {
+		err := validateVolumeContext(tc.backend, map[string]string{tc.key: "x"})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s with %s: expected error %v, got %v", tc.key, tc.backend, tc.wantErr, err)
+		}
+	}
+}
+
+func TestStageRejectsOptionOfOtherBackend(t *testing.T) {
+	n, runner := newDbxfsTestNodeServer(&Config{}, nil)
+	_, err := n.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "rclone-option",
+		StagingTargetPath: path.Join(t.TempDir(), "staging"),
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     map[string]string{"cacheMode": "full"},
+		Secrets:           tokenSecrets(),
+	})
+	expectCode(t, err, codes.InvalidArgument)
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "cacheMode") || !strings.Contains(msg, backendDbxfs) {
+		t.Errorf("Error doesn't name the key and the backend: %s", msg)
+	}
+	if len(runner.commands()) != 0 {
+		t.Errorf("dbxfs ran: %v", runner.commands())
+	}
+}
@@ -0,0 +1,118 @@
+#!/bin/bash
+# Runs the end-to-end test in a kind cluster: the driver is deployed with the
+# native backend and a fake Dropbox in a sidecar, and a claim is provisioned,
+# mounted by a pod, written to, unmounted and deleted. Needs go, docker, kind
+# and kubectl on PATH. The cluster is deleted afterwards unless KEEP_CLUSTER
+# is set.
+set -euo pipefail
+
+CLUSTER=${CLUSTER:-dropbox-csi-e2e}
+KIND_NODE_IMAGE=${KIND_NODE_IMAGE:-kindest/node:v1.17.17}
+IMAGE=${IMAGE:-quay.io/woohhan/dropbox-csi:e2e}
+FAKE_IMAGE=${FAKE_IMAGE:-quay.io/woohhan/fake-dropbox:e2e}
+FAKE_ADDRESS=127.0.0.1:18080
+TIMEOUT=${TIMEOUT:-180s}
+DIR=$(dirname "$0")
+DEPLOY=$DIR/../../deploy/k8s-1.17
+
+plugin() {
+	kubectl exec csi-dropboxplugin-0 -c dropbox-csi -- "$@"
+}
+
+fake() {
+	kubectl exec csi-dropboxplugin-0 -c fake-dropbox -- "$@"
+}
+
+dump() {
+	echo "--- e2e test failed, state of the cluster:"
+	kubectl get pods,pvc,pv -o wide || true
+	kubectl describe pod dropbox-e2e || true
+	kubectl logs csi-dropboxplugin-0 -c dropbox-csi --tail=200 || true
+	kubectl logs csi-dropboxplugin-0 -c fake-dropbox --tail=100 || true
+	kubectl logs csi-dropbox-provisioner-0 -c csi-provisioner --tail=100 || true
+}
+
+fail() {
+	echo "$@"
+	dump
+	exit 1
+}
+
+cleanup() {
+	if [ -z "${KEEP_CLUSTER:-}" ]; then
+		kind delete cluster --name "$CLUSTER" || true
+	fi
+}
+trap cleanup EXIT
+trap dump ERR
+
+docker build -t "$IMAGE" .
+CGO_ENABLED=0 go build -o build/fakedropbox ./test/fakedropbox
+docker build -t "$FAKE_IMAGE" -f "$DIR/fakedropbox.Dockerfile" build
+
+if ! kind get clusters | grep -qx "$CLUSTER"; then
+	kind create cluster --name "$CLUSTER" --image "$KIND_NODE_IMAGE" --wait "$TIMEOUT"
+fi
+kind load docker-image --name "$CLUSTER" "$IMAGE" "$FAKE_IMAGE"
+kubectl config use-context "kind-$CLUSTER"
+
+# The fake Dropbox accepts any token
+kubectl create secret generic dropbox-csi --from-literal=token=fake
+kubectl create -f "$DEPLOY/rbac.yaml"
+kubectl create -f "$DEPLOY/csi-dropbox-driverinfo.yaml"
+kubectl create -f "$DEPLOY/csi-dropbox-plugin.yaml"
+kubectl create -f "$DEPLOY/csi-dropbox-attacher.yaml"
+kubectl create -f "$DEPLOY/csi-dropbox-provisioner.yaml"
+
+# Serve the fake Dropbox from a sidecar of the driver, and mount it with the
+# native backend
+kubectl set image statefulset/csi-dropboxplugin dropbox-csi="$IMAGE"
+kubectl patch statefulset csi-dropboxplugin --type=json -p '[
+	{"op": "add", "path": "/spec/template/spec/containers/1/args/-", "value": "--backend=native"},
+	{"op": "add", "path": "/spec/template/spec/containers/1/args/-", "value": "--dropbox-api-url=http://'"$FAKE_ADDRESS"'/2"},
+	{"op": "add", "path": "/spec/template/spec/containers/1/args/-", "value": "--dropbox-content-url=http://'"$FAKE_ADDRESS"'/2"},
+	{"op": "add", "path": "/spec/template/spec/containers/1/args/-", "value": "--delete-provisioned-folders"},
+	{"op": "add", "path": "/spec/template/spec/containers/-", "value": {
+		"name": "fake-dropbox",
+		"image": "'"$FAKE_IMAGE"'",
+		"imagePullPolicy": "IfNotPresent",
+		"args": ["--dir=/fake-dropbox", "--address='"$FAKE_ADDRESS"'"],
+		"volumeMounts": [{"name": "fake-dropbox", "mountPath": "/fake-dropbox"}]
+	}},
+	{"op": "add", "path": "/spec/template/spec/volumes/-", "value": {"name": "fake-dropbox", "emptyDir": {}}}
+]'
+kubectl rollout status statefulset/csi-dropboxplugin --timeout="$TIMEOUT"
+
+echo "--- Provisioning a claim and mounting it in a pod"
+kubectl create -f "$DIR/pod.yaml"
+kubectl wait --for=condition=Ready pod/dropbox-e2e --timeout="$TIMEOUT"
+PV=$(kubectl get pvc dropbox-e2e -o jsonpath='{.spec.volumeName}')
+HANDLE=$(kubectl get pv "$PV" -o jsonpath='{.spec.csi.volumeHandle}')
+echo "Volume $HANDLE of $PV"
+
+echo "--- Writing to the volume"
+kubectl exec dropbox-e2e -- sh -c 'echo e2e > /data/e2e_test_file'
+[ "$(kubectl exec dropbox-e2e -- cat /data/e2e_test_file)" = e2e ] || fail "Can't read the file back"
+[ "$(fake cat "/fake-dropbox/$HANDLE/e2e_test_file")" = e2e ] || fail "File is not written to Dropbox"
+
+echo "--- Unmounting the volume"
+kubectl delete pod dropbox-e2e --timeout="$TIMEOUT"
+for i in $(seq 30); do
+	plugin grep -c "$PV" /proc/mounts >/dev/null || break
+	sleep 2
+done
+if plugin grep -q "$PV" /proc/mounts; then
+	fail "Volume $HANDLE is still mounted"
+fi
+
+echo "--- Deleting the claim"
+kubectl delete pvc dropbox-e2e --timeout="$TIMEOUT"
+for i in $(seq 30); do
+	fake test -e "/fake-dropbox/$HANDLE" || break
+	sleep 2
+done
+if fake test -e "/fake-dropbox/$HANDLE"; then
+	fail "Folder of volume $HANDLE is not deleted"
+fi
+
+echo "--- e2e test passed"
@@ -0,0 +1,29 @@
+// Command fakedropbox serves a fake Dropbox API from a local directory, for
+// the end-to-end test of the driver without a Dropbox account. The driver
+// reaches it with --dropbox-api-url and --dropbox-content-url set to
+// http://<address>/2.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/woohhan/dropbox-csi/internal/fakedropbox"
+)
+
+var (
+	dir     = flag.String("dir", "/fake-dropbox", "directory served as the fake Dropbox")
+	address = flag.String("address", "127.0.0.1:8080", "address to serve the fake Dropbox API on")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0750); err != nil {
+		glog.Fatalf("Can't create %s: %v", *dir, err)
+	}
+	glog.Infof("Serving a fake Dropbox from %s at http://%s/2", *dir, *address)
+	glog.Fatal(http.ListenAndServe(*address, fakedropbox.NewServer(*dir)))
+}